@@ -1,11 +1,16 @@
 // Send HTTP GET to the server
 // Parse the XML reponses, write the ports combination to the file /tmp/PID
 // Establish TCP connections with the service using the ports specified in the XML file
-// Poll the file /tmp/PID for 10s. If the file is not removed, print error, remove the file
+// Wait until the service confirms the session, see confirm.go. By default I poll the
+// file RUNTIME_DIR/knock_PID for 60s. If the file is not removed, print error, remove the file
+// SIGTERM or SIGINT stop the client, I remove the file before exit
 
 package main
 
 import (
+	"context"
+	"encoding/xml"
+	"errors"
 	"net/http"
 	"net/url"
 	"flag"
@@ -15,16 +20,22 @@ import (
 	"strings"
 	"io/ioutil"
 	"strconv"
+	"sync"
 	"port-knocking-ipc/utils"
+	"port-knocking-ipc/utils/lifecycle"
 )
 
 // Send HTTP GET to the host
 // Blocking
-func knock(host string) {
+func knock(ctx context.Context, host string) {
 	client := http.Client {
 	    Timeout: time.Duration(50 * time.Millisecond),
 	}	
-	response, err := client.Get(host)	
+	request, err := http.NewRequestWithContext(ctx, "GET", host, nil)
+	if err != nil {
+		return
+	}
+	response, err := client.Do(request)	
 	if err == nil {
 		fmt.Println("Connection unexpectedly succeeded")
 		defer response.Body.Close()
@@ -39,18 +50,74 @@ func knock(host string) {
 	}	
 } 
 
+// Time to wait after the "frame start" knock and after the tuple
+const framePause = time.Duration(50) * time.Millisecond
+
+func knockPort(ctx context.Context, port int) {
+	host := fmt.Sprintf("http://127.0.0.1:%d", port)
+	knock(ctx, host)
+}
+
+// Returns false if the context is done before the pause ends
+func pause(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 // Port knocking - send HTTP GET to the specified ports on the localhost
 // This is a blocking operation. I knock the ports in the exact order the server
 // required. I have to preserve order of knocks, because the service relies 
 // on the ascending order of ports in a tuple
-// An alternative is to use one port as a "frame start" signal  
-func portKnocking(ports []int) {
-	for _, port := range ports {
-		host := fmt.Sprintf("http://127.0.0.1:%d", port)
-		knock(host)
+// An alternative is to use one port as a "frame start" signal. If the frame start
+// port is not zero I knock the frame start port, pause, knock the ports 
+// of the tuple in parallel (any order), pause again 
+// I stop knocking when the context is done
+func portKnocking(ctx context.Context, tuples [][]int, framePort int) {
+	for _, tuple := range tuples {
+		if ctx.Err() != nil {
+			return
+		}
+		if framePort == 0 {
+			for _, port := range tuple {
+				knockPort(ctx, port)
+			}
+			continue
+		}
+		knockPort(ctx, framePort)
+		if !pause(ctx, framePause) {
+			return
+		}
+		var wg sync.WaitGroup
+		for _, port := range tuple {
+			wg.Add(1)
+			go func(port int) {
+				defer wg.Done()
+				knockPort(ctx, port)
+			}(port)
+		}
+		wg.Wait()
+		pause(ctx, framePause)
 	}	
 }
 
+// Parse line "frame_start=PORT" in the server response
+// Returns zero if the server does not use frame start mode
+func getFramePort(text string) int {
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, utils.FrameStartPrefix) {
+			port, ok := utils.AtoIPPort(strings.TrimPrefix(line, utils.FrameStartPrefix))
+			if ok {
+				return port
+			}
+		}
+	}
+	return 0
+}
+
 // Parse string "0,1,2,3,\n0,1,2,4,\n", return [[0,1,2,3], [0,1,2,4]]
 func getPorts(text string) [][]int{
 	tuplesStr := strings.Split(text, "\n")
@@ -71,66 +138,149 @@ func getPorts(text string) [][]int{
 	return tuples
 }
 
+// Create RUNTIME_DIR/knock_PID, mode 0600
+// The runtime directory belongs to me. If the file exists it was left by a 
+// process which had the same PID. I remove the file and try again
 func createPidFile(ports []int) (string, bool) {
 	pid := os.Getpid()
-	pidFilename := utils.GetPidFilename(pid)
-    text := []byte(fmt.Sprintf("%d\n%v\n", pid, ports))
-    err := ioutil.WriteFile(pidFilename, text, 0777)
-    if err != nil {
-		fmt.Println("Failed to write file", pidFilename)
+	pidFilename := utils.GetPidFilename(os.Getuid(), pid)
+	if _, err := utils.CreateRuntimeDir(); err != nil {
+		fmt.Println("Failed to create runtime directory", err)
+		return pidFilename, false
+	}
+	text := []byte(fmt.Sprintf("%d\n%v\n", pid, ports))
+	file, err := os.OpenFile(pidFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		os.Remove(pidFilename)
+		file, err = os.OpenFile(pidFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if err == nil {
+		_, err = file.Write(text)
+		file.Close()
+	}
+	if err != nil {
+		fmt.Println("Failed to write file", pidFilename, err)
 		return pidFilename, false
-    }
+	}
 	return pidFilename, true
 }
 
-// Wait until "server" removes the file
-func waitForPidfile(filename string) bool {
-	timeout := time.Duration(60) * time.Second
-	checkPeriod := time.Duration(100) * time.Millisecond
-	for loops := timeout/checkPeriod;utils.PathExists(filename) && loops > 0; loops-- {
-		time.Sleep(checkPeriod)
-	}	
-	return !utils.PathExists(filename)
+// Parse the XML document, see utils.XMLSession
+// I validate the ports the same way getPorts() does: skip the ports which are not
+// numbers and the empty tuples. Returns the tuples, the frame start port and the
+// session token
+func getXMLPorts(text string) ([][]int, int, string, error) {
+	var session utils.XMLSession
+	if err := xml.Unmarshal([]byte(text), &session); err != nil {
+		return nil, 0, "", err
+	}
+	tuples := [][]int{}
+	for _, tuple := range session.Tuples {
+		ports := []int{}
+		for _, portStr := range tuple.Ports {
+			port, err := strconv.Atoi(strings.TrimSpace(portStr))
+			if err == nil {
+				ports = append(ports, port)
+			}
+		}
+		if len(ports) > 0 {
+			tuples = append(tuples, ports)
+		}
+	}
+	framePort, ok := utils.AtoIPPort(session.FrameStart)
+	if !ok {
+		framePort = 0
+	}
+	return tuples, framePort, session.Token, nil
 }
 
-// Spawn goroutines to knock the ports specified in the server response 
-func handleResponse(text string) {
+// Knock the tuples, wait for the service
+func handleTuples(ctx context.Context, tuples [][]int, framePort int, channel confirmation) error {
 	ports := []int{}
-	tuples := getPorts(text)
 	for _, tuple := range tuples {
 		for _, port := range tuple {
 			ports = append(ports, port)
 		}	
 	}
-	// First thing create a PID file
-	pidFilename, ok := createPidFile(ports)
-	// portKnockig() does not block
-	portKnocking(ports)
-	if ok {
-		result := waitForPidfile(pidFilename)
-		if !result {
-			fmt.Printf("The file %s was not removed\n", pidFilename)
+	// First thing prepare the confirmation, for example create a PID file
+	if err := channel.prepare(ports); err != nil {
+		return err
+	}
+	defer channel.close()
+	portKnocking(ctx, tuples, framePort)
+	if !waitForConfirmation(ctx, channel) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("The session was not confirmed: %v", channel)
+	}
+	return nil
+}
+
+// Get the ports from the server, knock, wait for the service
+// The format is "text" or "xml", the mode of the confirmation is "file", "server"
+// or "socket", see confirm.go
+func run(ctx context.Context, url string, format string, mode string) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if format == "xml" {
+		request.Header.Set("Accept", "application/xml")
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}	
+	defer response.Body.Close()
+	text, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	tuples, framePort, token := getPorts(string(text)), getFramePort(string(text)), getSessionToken(string(text))
+	if strings.Contains(response.Header.Get("Content-Type"), "xml") {
+		tuples, framePort, token, err = getXMLPorts(string(text))
+		if err != nil {
+			return err
 		}
 	}
+	channel, err := createConfirmation(mode, url, token)
+	if err != nil {
+		return err
+	}
+	return handleTuples(ctx, tuples, framePort, channel)
 }
 
 func main() {
-	flag.Parse()
 	hostRef := flag.String("host", "127.0.0.1", "Server name")
 	portRef := flag.Int("port", 8080, "Server port")
+	format := flag.String("format", "text", "Format of the server response: text or xml")
+	mode := flag.String("confirm", "file", "Confirmation of the session: file, server or socket")
 	flag.Parse()
 	host := fmt.Sprintf("%s:%d", *hostRef, *portRef)  
 	url := &url.URL{
 		Scheme:   "http",
 		Host:     host,
 	}
-	response, err := http.Get(url.String())
-	if err != nil {
-		panic(err)
-	}	
-	defer response.Body.Close()
-	text, err := ioutil.ReadAll(response.Body)
-	if err == nil {
-		handleResponse(string(text))
-	}
+	life := lifecycle.New(time.Duration(1) * time.Second)
+	life.HandleSignals()
+	finished := make(chan struct{})
+	// The hook waits until run() closes the confirmation channel
+	life.OnShutdown("client", func(ctx context.Context) error {
+		select {
+		case <-finished:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	go func() {
+		err := run(life.Context(), url.String(), *format, *mode)
+		close(finished)
+		if errors.Is(err, context.Canceled) {
+			err = nil
+		}
+		life.Stop(err)
+	}()
+	life.Exit()
 }
\ No newline at end of file
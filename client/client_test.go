@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 	"port-knocking-ipc/utils"
 )
 
@@ -27,11 +34,159 @@ func TestGetPorts(t *testing.T) {
 func TestCreatePidFile(t *testing.T) {
 	pid := os.Getpid()
 	ports := []int{1,2,3,4}
-	filename := utils.GetPidFilename(pid)
+	filename := utils.GetPidFilename(os.Getuid(), pid)
 	createPidFile(ports)
 	if !utils.PathExists(filename) {
 		t.Errorf("File %s not found\n", filename)
 	} else {
+		if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("Got mode %v, %v\n", info.Mode().Perm(), err)
+		}
+		// A stale file does not block the next client
+		if _, ok := createPidFile(ports); !ok {
+			t.Errorf("Failed to replace %s\n", filename)
+		}
 		os.Remove(filename)		
 	}
-}
\ No newline at end of file
+}
+func TestGetFramePort(t *testing.T) {
+	text := "frame_start=21379\n21380,21381\n21382,21383\n"
+	if port := getFramePort(text); port != 21379 {
+		t.Errorf("Got frame start port %d expected 21379\n", port)
+	}
+	tuples := getPorts(text)
+	if len(tuples) != 2 || !utils.Compare(tuples[0], []int{21380, 21381}) {
+		t.Errorf("Got %v\n", tuples)
+	}
+	if port := getFramePort("0,1,2,3\n"); port != 0 {
+		t.Errorf("Got frame start port %d expected 0\n", port)
+	}
+}
+
+// SIGTERM cancels the context, the client stops waiting and removes the PID file
+func TestHandleResponseCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	text := "frame_start=1\n2,3\n"
+	err := handleTuples(ctx, getPorts(text), getFramePort(text), &fileConfirmation{})
+	if err != context.Canceled {
+		t.Errorf("Got %v\n", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Took %v\n", time.Since(start))
+	}
+	if filename := utils.GetPidFilename(os.Getuid(), os.Getpid()); utils.PathExists(filename) {
+		t.Errorf("File %s is not removed\n", filename)
+	}
+}
+
+func TestGetXMLPorts(t *testing.T) {
+	text := `<?xml version="1.0" encoding="UTF-8"?>
+<session version="1" id="7" token="0123" expires="2018-04-23T10:00:10Z" tuple_size="2" frame_start="21379">
+  <tuple><port>21380</port><port>21383</port></tuple>
+  <tuple><port>x</port><port>21381</port></tuple>
+  <tuple></tuple>
+  <tuple><port> 21382 </port><port>21384</port></tuple>
+</session>`
+	tuples, framePort, token, err := getXMLPorts(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]int{{21380, 21383}, {21381}, {21382, 21384}}
+	if len(tuples) != len(expected) || framePort != 21379 || token != "0123" {
+		t.Fatalf("Got %v, frame start %d, token %s\n", tuples, framePort, token)
+	}
+	for i := range expected {
+		if !utils.Compare(tuples[i], expected[i]) {
+			t.Errorf("Got %v expected %v\n", tuples, expected)
+		}
+	}
+	_, framePort, _, _ = getXMLPorts(`<session version="1" id="7"><tuple><port>1</port></tuple></session>`)
+	if framePort != 0 {
+		t.Errorf("Got frame start %d\n", framePort)
+	}
+	if _, _, _, err := getXMLPorts("0,1,\n"); err == nil {
+		t.Errorf("Expected error for CSV\n")
+	}
+}
+
+func TestGetSessionToken(t *testing.T) {
+	if token := getSessionToken("frame_start=21379\ntoken=0123\n21380,21381\n"); token != "0123" {
+		t.Errorf("Got token '%s' expected 0123\n", token)
+	}
+	if token := getSessionToken("21380,21381\n"); token != "" {
+		t.Errorf("Got token '%s'\n", token)
+	}
+	if tuples := getPorts("token=0123\n21380,21381\n"); len(tuples) != 1 {
+		t.Errorf("Got %v\n", tuples)
+	}
+}
+
+// The service connects to the socket and writes "matched"
+func TestSocketConfirmation(t *testing.T) {
+	channel := &socketConfirmation{}
+	if err := channel.prepare(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer channel.close()
+	if info, err := os.Stat(channel.filename); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Got mode %v, %v\n", info.Mode().Perm(), err)
+	}
+	go func() {
+		// A peer which writes garbage does not confirm the session
+		for _, text := range []string{"hello\n", "matched\n"} {
+			conn, err := net.Dial("unix", channel.filename)
+			if err != nil {
+				return
+			}
+			fmt.Fprint(conn, text)
+			conn.Close()
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !channel.wait(ctx) {
+		t.Errorf("Session is not confirmed\n")
+	}
+	channel.close()
+	if utils.PathExists(channel.filename) {
+		t.Errorf("Socket %s is not removed\n", channel.filename)
+	}
+}
+
+// The server responds "pending", "ambiguous", then "matched". The client sends
+// the sequence of the last event
+func TestServerConfirmation(t *testing.T) {
+	var polls int32
+	statuses := []string{"pending", "ambiguous", "matched"}
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/session/0123/status" {
+			http.Error(response, "not_found", http.StatusNotFound)
+			return
+		}
+		poll := int(atomic.AddInt32(&polls, 1))
+		if request.URL.Query().Get("after") != fmt.Sprintf("%d", poll-1) {
+			http.Error(response, "Bad sequence", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(response, `{"version":1,"sequence":%d,"status":"%s"}`, poll, statuses[poll-1])
+	}))
+	defer server.Close()
+	if _, err := createConfirmation("server", server.URL, ""); err == nil {
+		t.Errorf("Expected error for missing session token\n")
+	}
+	channel, err := createConfirmation("server", server.URL, "0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitForConfirmation(context.Background(), channel) || atomic.LoadInt32(&polls) != 3 {
+		t.Errorf("Session is not confirmed after %d polls\n", polls)
+	}
+	channel, _ = createConfirmation("server", server.URL, "4567")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if channel.wait(ctx) {
+		t.Errorf("Unknown session is confirmed\n")
+	}
+}
@@ -0,0 +1,271 @@
+// Confirmation channels
+// The client knocks and waits until the service reports the session to the server
+// Modes
+//     file    I create RUNTIME_DIR/knock_PID, the server removes the file when the
+//             session is matched. Works only if the server runs on the same machine
+//     server  I poll GET /session/TOKEN/status, the server responds when the status of
+//             the session changes, see server/confirm.go
+//     socket  I listen on RUNTIME_DIR/knock_PID.sock, the service connects and writes
+//             "matched" when the server matched the session, see service/notify.go
+// RUNTIME_DIR is the per-user directory, mode 0700, see utils.GetRuntimeDir()
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"port-knocking-ipc/utils"
+)
+
+type confirmation interface {
+	// Called before the first knock
+	prepare(ports []int) error
+	// Blocks until the session is confirmed or the context is done
+	// Returns true if the session is confirmed
+	wait(ctx context.Context) bool
+	// Called before exit
+	close()
+	String() string
+}
+
+// Time to wait for the confirmation after the last knock
+const confirmationTimeout = time.Duration(60) * time.Second
+
+// Parse line "token=TOKEN" in the server response
+func getSessionToken(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, utils.SessionTokenPrefix) {
+			return strings.TrimSpace(strings.TrimPrefix(line, utils.SessionTokenPrefix))
+		}
+	}
+	return ""
+}
+
+// Create the confirmation channel for the session, the mode is file, server or socket
+func createConfirmation(mode string, serverURL string, token string) (confirmation, error) {
+	switch mode {
+	case "file":
+		return &fileConfirmation{}, nil
+	case "server":
+		if token == "" {
+			return nil, fmt.Errorf("The server did not send the session token")
+		}
+		return &serverConfirmation{serverURL: serverURL, token: token, client: &http.Client{}}, nil
+	case "socket":
+		return &socketConfirmation{}, nil
+	}
+	return nil, fmt.Errorf("Unknown confirmation mode '%s'", mode)
+}
+
+// The server removes the PID file
+type fileConfirmation struct {
+	filename string
+}
+
+func (c *fileConfirmation) prepare(ports []int) error {
+	filename, ok := createPidFile(ports)
+	if !ok {
+		return fmt.Errorf("Failed to create %s", filename)
+	}
+	c.filename = filename
+	return nil
+}
+
+func (c *fileConfirmation) wait(ctx context.Context) bool {
+	checkPeriod := time.Duration(100) * time.Millisecond
+	for utils.PathExists(c.filename) {
+		if !pause(ctx, checkPeriod) {
+			break
+		}
+	}
+	return !utils.PathExists(c.filename)
+}
+
+// The file is useless after I exit
+func (c *fileConfirmation) close() {
+	if c.filename != "" {
+		os.Remove(c.filename)
+	}
+}
+
+func (c *fileConfirmation) String() string {
+	return fmt.Sprintf("file %s", c.filename)
+}
+
+// Long poll of the server
+type serverConfirmation struct {
+	serverURL string
+	token     string
+	client    *http.Client
+}
+
+// An event of the session, see server/confirm.go
+type sessionEvent struct {
+	Sequence int    `json:"sequence"`
+	Status   string `json:"status"`
+}
+
+func (c *serverConfirmation) prepare(ports []int) error {
+	return nil
+}
+
+// Returns the latest event of the session, blocks until the server has an event
+// after 'after' or the timeout expires
+func (c *serverConfirmation) poll(ctx context.Context, after int, timeout time.Duration) (sessionEvent, error) {
+	var event sessionEvent
+	query := url.Values{}
+	query.Set("after", fmt.Sprintf("%d", after))
+	// The server accepts seconds, I do not want to spin
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+	query.Set("timeout", fmt.Sprintf("%d", int(timeout/time.Second)))
+	statusURL := fmt.Sprintf("%s/session/%s/status?%s", c.serverURL, url.PathEscape(c.token), query.Encode())
+	request, err := http.NewRequestWithContext(ctx, "GET", statusURL, nil)
+	if err != nil {
+		return event, err
+	}
+	request.Header.Set("Accept", "application/json")
+	response, err := c.client.Do(request)
+	if err != nil {
+		return event, err
+	}
+	defer response.Body.Close()
+	text, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return event, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return event, fmt.Errorf("Status %d %s", response.StatusCode, strings.TrimSpace(string(text)))
+	}
+	err = json.Unmarshal(text, &event)
+	return event, err
+}
+
+// I poll again while the session is pending or ambiguous
+// The session expires or the server forgets it, I do not poll forever
+func (c *serverConfirmation) wait(ctx context.Context) bool {
+	after := 0
+	for ctx.Err() == nil {
+		timeout := time.Duration(30) * time.Second
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+			timeout = time.Until(deadline)
+		}
+		event, err := c.poll(ctx, after, timeout)
+		if err != nil {
+			fmt.Println("Failed to get status", err)
+			if !pause(ctx, time.Second) {
+				return false
+			}
+			continue
+		}
+		after = event.Sequence
+		switch event.Status {
+		case "pending":
+		case "ambiguous":
+			fmt.Println("Session is ambiguous, waiting")
+		default:
+			fmt.Println("Session", event.Status)
+			return event.Status == "matched"
+		}
+	}
+	return false
+}
+
+func (c *serverConfirmation) close() {
+}
+
+func (c *serverConfirmation) String() string {
+	return fmt.Sprintf("session status on %s", c.serverURL)
+}
+
+// The service connects to the unix socket
+type socketConfirmation struct {
+	listener net.Listener
+	filename string
+}
+
+// I remove a stale socket of a process which had the same PID. Nobody else can
+// write to the runtime directory
+func (c *socketConfirmation) prepare(ports []int) error {
+	if _, err := utils.CreateRuntimeDir(); err != nil {
+		return err
+	}
+	filename := utils.GetSocketFilename(os.Getuid(), os.Getpid())
+	os.Remove(filename)
+	listener, err := net.Listen("unix", filename)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(filename, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	c.listener = listener
+	c.filename = filename
+	return nil
+}
+
+// Returns true if the peer wrote "matched"
+func readNotification(conn net.Conn) bool {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	return err == nil && strings.TrimSpace(line) == "matched"
+}
+
+func (c *socketConfirmation) wait(ctx context.Context) bool {
+	matched := make(chan struct{})
+	go func() {
+		for {
+			conn, err := c.listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			if readNotification(conn) {
+				close(matched)
+				return
+			}
+		}
+	}()
+	select {
+	case <-matched:
+		return true
+	case <-ctx.Done():
+		// Unblock Accept()
+		c.listener.Close()
+		return false
+	}
+}
+
+// Closing the listener removes the socket
+func (c *socketConfirmation) close() {
+	if c.listener != nil {
+		c.listener.Close()
+	}
+}
+
+func (c *socketConfirmation) String() string {
+	return fmt.Sprintf("socket %s", c.filename)
+}
+
+// Wait until the service confirms the session, the timeout or the context is done
+func waitForConfirmation(ctx context.Context, channel confirmation) bool {
+	ctx, cancel := context.WithTimeout(ctx, confirmationTimeout)
+	defer cancel()
+	return channel.wait(ctx)
+}
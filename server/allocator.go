@@ -0,0 +1,135 @@
+// Unpredictable allocation of ports tuples
+// The combinations generator returns the tuples in the lexicographic order. An adversary
+// who got a session can predict the tuples of the following sessions.
+// I number all combinations of the ports range in the lexicographic order 0..N-1 
+// (see combinations.RankBig()) and
+// walk the indexes 0, 1, 2, ... through a keyed permutation of [0, N). The
+// permutation is a small Feistel network over the smallest domain of even number
+// of bits which covers N. The round function is HMAC-SHA256 with a key from 
+// crypto/rand, I chain HMAC blocks if the half of the domain is wider than 256 bits.
+// If the Feistel network produces an index outside of [0, N) I apply the 
+// network again (cycle walking). A permutation never repeats an index, so
+// no combination repeats until all N combinations are allocated. When the space is 
+// exhausted I generate a new key and start over
+// N does not fit uint64 for the large ranges, for example 300 choose 150 is about
+// 2^296. I use math/big for the indexes
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sync"
+	"port-knocking-ipc/utils/combinations"
+)
+
+// Anything which returns the next tuple and wraps around, for example 
+// combinations.State
+type tupleAllocator interface {
+	NextWrap() []int
+}
+
+const feistelRounds = 6
+
+type permutationAllocator struct {
+	source    []int
+	tupleSize int
+	count     *big.Int
+	halfBits  uint
+	halfMask  *big.Int
+	key       []byte
+	counter   *big.Int
+	mutex     sync.Mutex
+}
+
+// Create an allocator for the combinations of 'tupleSize' ports from the 'source' 
+func createPermutationAllocator(source []int, tupleSize int) (*permutationAllocator, error) {
+	count := combinations.CountBig(len(source), tupleSize)
+	if count.Sign() == 0 {
+		return nil, fmt.Errorf("Can not allocate %d-tuples from %d ports", tupleSize, len(source))
+	}
+	domainBits := uint(new(big.Int).Sub(count, big.NewInt(1)).BitLen())
+	if domainBits < 2 {
+		domainBits = 2
+	}
+	domainBits += domainBits & 1
+	halfMask := new(big.Int).Lsh(big.NewInt(1), domainBits / 2)
+	halfMask.Sub(halfMask, big.NewInt(1))
+	a := &permutationAllocator{
+		source:    source,
+		tupleSize: tupleSize,
+		count:     count,
+		halfBits:  domainBits / 2,
+		halfMask:  halfMask,
+	}
+	if err := a.rekey(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Generate a new permutation key, restart the counter
+func (a *permutationAllocator) rekey() error {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	a.key = key
+	a.counter = big.NewInt(0)
+	return nil
+}
+
+// HMAC(key, round | block | value) for block 0, 1, ... until I have halfBits bits
+func (a *permutationAllocator) round(round int, value *big.Int) *big.Int {
+	halfBytes := int(a.halfBits + 7) / 8
+	input := make([]byte, 5 + halfBytes)
+	input[0] = byte(round)
+	value.FillBytes(input[5:])
+	output := make([]byte, 0, halfBytes + sha256.Size)
+	for block := uint32(0); len(output) < halfBytes; block++ {
+		binary.BigEndian.PutUint32(input[1:5], block)
+		mac := hmac.New(sha256.New, a.key)
+		mac.Write(input)
+		output = mac.Sum(output)
+	}
+	result := new(big.Int).SetBytes(output[:halfBytes])
+	return result.And(result, a.halfMask)
+}
+
+// Feistel network over [0, 2^(2*halfBits))
+func (a *permutationAllocator) feistel(value *big.Int) *big.Int {
+	left := new(big.Int).Rsh(value, a.halfBits)
+	right := new(big.Int).And(value, a.halfMask)
+	for round := 0; round < feistelRounds; round++ {
+		left, right = right, left.Xor(left, a.round(round, right))
+	}
+	return left.Lsh(left, a.halfBits).Or(left, right)
+}
+
+// Keyed permutation of [0, count)
+func (a *permutationAllocator) permute(index *big.Int) *big.Int {
+	index = a.feistel(index)
+	for index.Cmp(a.count) >= 0 {
+		index = a.feistel(index)
+	}
+	return index
+}
+
+// NextWrap returns the next tuple
+// I panic if crypto/rand fails. I can not allocate predictable tuples
+func (a *permutationAllocator) NextWrap() []int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.counter.Cmp(a.count) >= 0 {
+		if err := a.rekey(); err != nil {
+			panic(err)
+		}
+	}
+	index := a.permute(a.counter)
+	a.counter = new(big.Int).Add(a.counter, big.NewInt(1))
+	return combinations.UnrankBig(a.source, a.tupleSize, index)
+}
@@ -0,0 +1,100 @@
+// JSON API of the server
+// A client which sends "Accept: application/json" or uses the path prefix /v1/ 
+// gets JSON. Other clients get the text. The HTTP status code is the same for
+// both formats
+// Allocation GET /v1/
+//     {"version":1,"session_id":1,"token":"...","expires":"2018-04-23T10:00:10Z","tuple_size":2,"tuples":[[21380,21382]],"frame_start":21379}
+// Allocation with a payload POST /v1/ with the payload in the body
+// Session report GET /v1/session?ports=...&pid=...&service=...&ts=...&nonce=...&key=...&sig=...
+//     {"version":1,"status":"matched","message":"...","sessions":[1],"tuples":[[21380,21382]],"pid_file":"/run/user/1000/port-knocking-ipc/knock_1234","pid_file_removed":true}
+// Statuses of the session report
+//     matched    200 the session is found and removed
+//     ambiguous  409 the ports match more than one session
+//     not_found  404 no session matches the ports
+//     malformed  400 the query can not be parsed
+//     expired    410 the ports match an expired session
+//     unauthorized 401 the signature of the report is bad, see signature.go
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const apiVersion = 1
+const apiPathPrefix = "v1/"
+
+const (
+	statusMatched   = "matched"
+	statusAmbiguous = "ambiguous"
+	statusNotFound  = "not_found"
+	statusMalformed = "malformed"
+	statusExpired   = "expired"
+	statusUnauthorized = "unauthorized"
+)
+
+type allocationResponse struct {
+	Version    int       `json:"version"`
+	SessionID  uint32    `json:"session_id"`
+	// The session status is /session/TOKEN/status, see confirm.go
+	Token      string    `json:"token"`
+	Expires    time.Time `json:"expires"`
+	TupleSize  int       `json:"tuple_size"`
+	Tuples     [][]int   `json:"tuples"`
+	FrameStart int       `json:"frame_start,omitempty"`
+}
+
+type sessionReport struct {
+	Version        int      `json:"version"`
+	Status         string   `json:"status"`
+	// The text which the server sends in the text format
+	Message        string   `json:"message"`
+	Sessions       []uint32 `json:"sessions,omitempty"`
+	Tuples         [][]int  `json:"tuples,omitempty"`
+	PidFile        string   `json:"pid_file,omitempty"`
+	PidFileRemoved bool     `json:"pid_file_removed"`
+	// Enrolled service which reported the session, see enroll.go
+	Service        string   `json:"service,omitempty"`
+	// Payload of the matched session encrypted to the key of the service, base64,
+	// see payload.go
+	Payload        []byte   `json:"payload,omitempty"`
+}
+
+func newSessionReport(status string, message string) sessionReport {
+	return sessionReport{Version: apiVersion, Status: status, Message: message}
+}
+
+func (c *configuration) allocationToJSON(session sessionState) allocationResponse {
+	return allocationResponse{
+		Version:    apiVersion,
+		SessionID:  uint32(session.id),
+		Token:      session.token,
+		Expires:    session.expirationTime,
+		TupleSize:  c.tupleSize,
+		Tuples:     session.tuples,
+		FrameStart: c.framePort,
+	}
+}
+
+// Returns the path without the leading slash and the version prefix, true if the 
+// client wants JSON
+func negotiateJSON(request *http.Request) (string, bool) {
+	path := strings.TrimPrefix(request.URL.Path, "/")
+	if path + "/" == apiPathPrefix {
+		return "", true
+	}
+	if strings.HasPrefix(path, apiPathPrefix) {
+		return strings.TrimPrefix(path, apiPathPrefix), true
+	}
+	return path, strings.Contains(request.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(response http.ResponseWriter, code int, v interface{}) {
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	response.Header().Set("Cache-Control", "no-store")
+	response.WriteHeader(code)
+	json.NewEncoder(response).Encode(v)
+}
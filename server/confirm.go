@@ -0,0 +1,317 @@
+// Status of the session
+// Every allocated session gets an opaque token. The token is the only way to ask
+// about the session, the session IDs are sequential and easy to guess
+//     GET /session/TOKEN/status?after=SEQUENCE&timeout=SECONDS
+// Long poll: the server responds with the latest event when the sequence of the
+// event is greater than 'after' or the timeout expires. The client sends the
+// sequence of the last event it got in the next request
+// Server-Sent Events: a client which sends "Accept: text/event-stream" gets the
+// events after 'after' (or Last-Event-ID) as they come until the final event
+// Events
+//     pending    the session is allocated, no report yet, always the first event
+//     ambiguous  the service reported ports which match this and other sessions
+//     matched    the service reported the session, final
+//     expired    the session expired before the report, final
+// Only the matched event contains the identity of the reported process. The tokens of
+// the colliding sessions can belong to other users, the ambiguous event has no identity
+// The text format of the long poll is the status, the JSON format is
+//     {"version":1,"sequence":2,"status":"matched","time":"...","identity":{"pid":1234,...}}
+//
+// Every session has a list of events and a channel. When I add an event I close the
+// channel and create a new one. All waiters of the session wake up at once. There is
+// no polling and no goroutine besides the HTTP handler, a waiter costs a timer
+// I keep a min-heap of (time, token), see utils/timeheap. The reaper pops the heap: publishes "expired"
+// for the pending sessions at the expiration time and removes the resolved sessions
+// after expiredSessionGrace. The client can ask after the session was resolved
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"port-knocking-ipc/utils/process"
+)
+
+const statusPending = "pending"
+
+const defaultStatusTimeout = time.Duration(30) * time.Second
+const maxStatusTimeout = time.Duration(60) * time.Second
+
+// A misbehaving service can report ambiguous ports many times. I ignore the
+// ambiguous events when the session has this many events
+const maxSessionEvents = 16
+
+type eventIdentity struct {
+	PID        int      `json:"pid"`
+	PPID       int      `json:"ppid"`
+	UID        int      `json:"uid"`
+	User       string   `json:"user,omitempty"`
+	Executable string   `json:"exe,omitempty"`
+	Cmdline    []string `json:"cmdline,omitempty"`
+}
+
+type sessionEvent struct {
+	Sequence int            `json:"sequence"`
+	Status   string         `json:"status"`
+	Time     time.Time      `json:"time"`
+	Identity *eventIdentity `json:"identity,omitempty"`
+}
+
+type statusResponse struct {
+	Version int `json:"version"`
+	sessionEvent
+}
+
+type confirmation struct {
+	expirationTime time.Time
+	events         []sessionEvent
+	// Closed and replaced when I add an event
+	changed        chan struct{}
+	// The last event is matched or expired
+	final          bool
+	resolved       time.Time
+}
+
+// 128 random bits
+func createToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+func toEventIdentity(identity process.Identity) *eventIdentity {
+	return &eventIdentity{identity.PID, identity.PPID, identity.RealUID, identity.User, identity.Executable, identity.Cmdline}
+}
+
+// Start tracking of the session, called by addSession
+func (c *configuration) addConfirmation(token string, expirationTime time.Time) {
+	c.confirmationsMutex.Lock()
+	defer c.confirmationsMutex.Unlock()
+	if c.confirmations == nil {
+		c.confirmations = make(map[string]*confirmation)
+	}
+	event := sessionEvent{Sequence: 1, Status: statusPending, Time: time.Now().UTC()}
+	c.confirmations[token] = &confirmation{
+		expirationTime: expirationTime,
+		events:         []sessionEvent{event},
+		changed:        make(chan struct{}),
+	}
+	c.confirmationExpirations.Push(expirationTime, token)
+}
+
+// Add the event, wake up the waiters. Called with confirmationsMutex locked
+func (c *configuration) publishEventLocked(token string, status string, identity *eventIdentity, now time.Time) {
+	entry, ok := c.confirmations[token]
+	if !ok || entry.final {
+		return
+	}
+	final := (status == statusMatched) || (status == statusExpired)
+	if !final && len(entry.events) >= maxSessionEvents {
+		return
+	}
+	sequence := entry.events[len(entry.events)-1].Sequence + 1
+	entry.events = append(entry.events, sessionEvent{sequence, status, now, identity})
+	if final {
+		entry.final = true
+		entry.resolved = now
+		c.confirmationExpirations.Push(now.Add(expiredSessionGrace), token)
+	}
+	close(entry.changed)
+	entry.changed = make(chan struct{})
+}
+
+func (c *configuration) publishEvent(token string, status string, identity *eventIdentity) {
+	c.confirmationsMutex.Lock()
+	defer c.confirmationsMutex.Unlock()
+	c.publishEventLocked(token, status, identity, time.Now().UTC())
+}
+
+// Publish "expired" for the pending sessions which expired by 'now', remove the
+// sessions resolved before now-expiredSessionGrace. Returns number of removed sessions
+func (c *configuration) expireConfirmations(now time.Time) int {
+	c.confirmationsMutex.Lock()
+	defer c.confirmationsMutex.Unlock()
+	removed := 0
+	for {
+		_, token, ok := c.confirmationExpirations.PopExpired(now)
+		if !ok {
+			break
+		}
+		entry, ok := c.confirmations[token]
+		if !ok {
+			continue
+		}
+		if !entry.final && !entry.expirationTime.After(now) {
+			c.publishEventLocked(token, statusExpired, nil, now)
+			continue
+		}
+		// Stale entry: the session was resolved, another entry removes the session
+		if entry.final && !entry.resolved.Add(expiredSessionGrace).After(now) {
+			delete(c.confirmations, token)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Returns the events with the sequence greater than 'after', the channel which
+// I close on the next event, false if there is no such session
+func (c *configuration) getEvents(token string, after int) ([]sessionEvent, <-chan struct{}, bool) {
+	c.confirmationsMutex.Lock()
+	defer c.confirmationsMutex.Unlock()
+	entry, ok := c.confirmations[token]
+	if !ok {
+		return nil, nil, false
+	}
+	events := []sessionEvent{}
+	for _, event := range entry.events {
+		if event.Sequence > after {
+			events = append(events, event)
+		}
+	}
+	// Nothing is going to happen after the final event
+	var changed <-chan struct{}
+	if !entry.final {
+		changed = entry.changed
+	}
+	return events, changed, true
+}
+
+// Wait for an event after 'after', returns the latest event
+// I return the latest event when the client goes away or the server shuts down
+func (c *configuration) waitEvent(done <-chan struct{}, token string, after int, timeout time.Duration) (sessionEvent, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		events, changed, ok := c.getEvents(token, -1)
+		if !ok {
+			return sessionEvent{}, false
+		}
+		latest := events[len(events)-1]
+		if latest.Sequence > after || changed == nil {
+			return latest, true
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return latest, true
+		case <-done:
+			return latest, true
+		case <-c.done:
+			return latest, true
+		}
+	}
+}
+
+// Parse "session/TOKEN/status", returns the token
+func parseStatusPath(path string) (string, bool) {
+	fields := strings.Split(path, "/")
+	if len(fields) != 3 || fields[0] != "session" || fields[2] != "status" || fields[1] == "" {
+		return "", false
+	}
+	return fields[1], true
+}
+
+func parseStatusQuery(query url.Values, request *http.Request) (int, time.Duration, error) {
+	after := 0
+	afterStr := query.Get("after")
+	if lastEventID := request.Header.Get("Last-Event-ID"); lastEventID != "" {
+		afterStr = lastEventID
+	}
+	if afterStr != "" {
+		var err error
+		after, err = strconv.Atoi(afterStr)
+		if err != nil || after < 0 {
+			return 0, 0, fmt.Errorf("Bad sequence '%s'", afterStr)
+		}
+	}
+	timeout := defaultStatusTimeout
+	if timeoutStr := query.Get("timeout"); timeoutStr != "" {
+		seconds, err := strconv.Atoi(timeoutStr)
+		if err != nil || seconds < 0 {
+			return 0, 0, fmt.Errorf("Bad timeout '%s'", timeoutStr)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	if timeout > maxStatusTimeout {
+		timeout = maxStatusTimeout
+	}
+	return after, timeout, nil
+}
+
+// Send the events until the final event, the client goes away or the server shuts down
+func (c *configuration) streamEvents(response http.ResponseWriter, request *http.Request, token string, after int) {
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		http.Error(response, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-store")
+	response.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		events, changed, ok := c.getEvents(token, after)
+		if !ok {
+			return
+		}
+		for _, event := range events {
+			data, _ := json.Marshal(statusResponse{apiVersion, event})
+			fmt.Fprintf(response, "id: %d\nevent: %s\ndata: %s\n\n", event.Sequence, event.Status, data)
+			after = event.Sequence
+		}
+		flusher.Flush()
+		if changed == nil {
+			return
+		}
+		select {
+		case <-changed:
+		case <-request.Context().Done():
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Handle /session/TOKEN/status
+func (c *configuration) httpHandlerSessionStatus(response http.ResponseWriter, request *http.Request, token string, asJSON bool) {
+	after, timeout, err := parseStatusQuery(request.URL.Query(), request)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, _, ok := c.getEvents(token, after); !ok {
+		if asJSON {
+			writeJSON(response, http.StatusNotFound, statusResponse{Version: apiVersion, sessionEvent: sessionEvent{Status: statusNotFound}})
+		} else {
+			http.Error(response, statusNotFound, http.StatusNotFound)
+		}
+		return
+	}
+	if strings.Contains(request.Header.Get("Accept"), "text/event-stream") {
+		c.streamEvents(response, request, token, after)
+		return
+	}
+	event, ok := c.waitEvent(request.Context().Done(), token, after, timeout)
+	if !ok {
+		http.Error(response, statusNotFound, http.StatusNotFound)
+		return
+	}
+	if asJSON {
+		writeJSON(response, http.StatusOK, statusResponse{apiVersion, event})
+		return
+	}
+	response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	response.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(response, event.Status)
+}
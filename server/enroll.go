@@ -0,0 +1,475 @@
+// Enrollment of the services
+// Anybody who guesses the tuples can report the session. I do not hand the payload
+// of the session to anybody. The service generates a long-term X25519 keypair on
+// the first start and enrolls the public key. The server encrypts the payload to
+// the key of the enrolled service, see utils/envelope. The payload is useless
+// for a process which reports the session without the private key
+// Enrollment  POST /enroll with "Authorization: Bearer ENROLLMENT_TOKEN"
+//     {"public_key":"BASE64"}
+//     {"version":1,"status":"enrolled","service_id":"...","secret":"...","key_id":"..."}
+// Rotation    POST /enroll
+//     {"service_id":"...","secret":"...","public_key":"BASE64"}
+//     {"version":1,"status":"rotated","service_id":"...","secret":"...","key_id":"..."}
+// The enrollment is disabled if the server has no -enrollment_token. The secret of
+// the service authenticates the rotation, I keep SHA-256 of the secret
+// SHA-256 of the secret is the key which signs the reports, see utils/signature. The 
+// file of the enrollments holds the signing keys: whoever reads the file can sign 
+// the reports of any service. I write the file with mode 0600 and refuse to load 
+// the file if the group or other users can read it
+// The rotation replaces the secret too. I accept the reports signed with the previous
+// secrets for previousSecretLifetime, the service can send the reports signed before
+// the rotation. The previous secrets authenticate the rotation too: the service 
+// which lost the response of the rotation retries with the secret it has
+// Statuses
+//     enrolled, rotated  200
+//     malformed          400 the request can not be parsed, the key is bad
+//     denied             401 bad enrollment token or service secret
+//     revoked            403 the service is revoked
+//     disabled           403 the server has no enrollment token
+//     error              500 failed to write the file
+// The enrollments are in the JSON file -enrollments. I write a temporary file and
+// rename it. "server -revoke ID" marks the service revoked in the file. The running
+// server reloads the file when the modification time changes, see reaper.go
+// A revoked service can not rotate the key and gets no payloads
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"port-knocking-ipc/utils/envelope"
+	"port-knocking-ipc/utils/signature"
+)
+
+const (
+	statusEnrolled = "enrolled"
+	statusRotated  = "rotated"
+	statusDenied   = "denied"
+	statusRevoked  = "revoked"
+	statusDisabled = "disabled"
+	statusError    = "error"
+)
+
+const previousSecretLifetime = time.Duration(10) * time.Minute
+
+var errEnrollmentDisabled = errors.New("Enrollment is disabled")
+var errEnrollmentDenied = errors.New("Enrollment is denied")
+var errServiceRevoked = errors.New("Service is revoked")
+
+type enrollment struct {
+	ServiceID  string    `json:"service_id"`
+	PublicKey  []byte    `json:"public_key"`
+	KeyID      string    `json:"key_id"`
+	SecretHash string    `json:"secret_hash"`
+	Created    time.Time `json:"created"`
+	Rotated    time.Time `json:"rotated"`
+	Revoked    bool      `json:"revoked"`
+	// Secrets replaced by the rotation which sign the reports until expired
+	PreviousSecrets []previousSecret `json:"previous_secrets,omitempty"`
+}
+
+type previousSecret struct {
+	SecretHash string    `json:"secret_hash"`
+	Expires    time.Time `json:"expires"`
+}
+
+type enrollmentStore struct {
+	// Empty if I keep the enrollments in memory
+	path     string
+	// Empty if the enrollment is disabled
+	token    string
+	// Modification time of the file when I read or wrote it
+	modTime  time.Time
+	services map[string]enrollment
+	mutex    sync.Mutex
+}
+
+type enrollRequest struct {
+	ServiceID string `json:"service_id,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+	PublicKey []byte `json:"public_key"`
+}
+
+type enrollResponse struct {
+	Version   int    `json:"version"`
+	Status    string `json:"status"`
+	Message   string `json:"message,omitempty"`
+	ServiceID string `json:"service_id,omitempty"`
+	// Only in the response to the enrollment and the rotation
+	Secret    string `json:"secret,omitempty"`
+	KeyID     string `json:"key_id,omitempty"`
+}
+
+// I keep the enrollments in the user config, for example /root/.config/port-knocking-ipc
+func defaultEnrollmentsPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "port-knocking-ipc", "enrollments.json")
+}
+
+// Load the enrollments from the file, the file is created by the first enrollment
+func createEnrollmentStore(path string, token string) (*enrollmentStore, error) {
+	s := &enrollmentStore{path: path, token: token, services: make(map[string]enrollment)}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Read the file if the file was modified, returns true if I read the file
+func (s *enrollmentStore) reload() (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.reloadLocked()
+}
+
+func (s *enrollmentStore) reloadLocked() (bool, error) {
+	if s.path == "" {
+		return false, nil
+	}
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return false, nil
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return false, fmt.Errorf("File %s holds the signing keys and is readable by others, mode %v. Run chmod 600", s.path, info.Mode().Perm())
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	enrollments := []enrollment{}
+	if err := json.Unmarshal(data, &enrollments); err != nil {
+		return false, fmt.Errorf("Failed to parse %s: %v", s.path, err)
+	}
+	services := make(map[string]enrollment)
+	for _, e := range enrollments {
+		services[e.ServiceID] = e
+	}
+	s.services = services
+	s.modTime = info.ModTime()
+	return true, nil
+}
+
+// Write a temporary file and rename it, the readers never see a partial file
+// Called with the mutex locked
+func (s *enrollmentStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	enrollments := []enrollment{}
+	for _, e := range s.services {
+		enrollments = append(enrollments, e)
+	}
+	sort.Slice(enrollments, func(i, j int) bool { return enrollments[i].ServiceID < enrollments[j].ServiceID })
+	data, err := json.MarshalIndent(enrollments, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	err = file.Chmod(0600)
+	if err == nil {
+		_, err = file.Write(data)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), s.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// The hash is the key which signs the reports, not a protection of the secret
+func hashSecret(secret string) string {
+	return hex.EncodeToString(signature.ReportKey(secret))
+}
+
+func (s *enrollmentStore) checkToken(token string) error {
+	if s.token == "" {
+		return errEnrollmentDisabled
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		return errEnrollmentDenied
+	}
+	return nil
+}
+
+// Enroll the public key, returns the enrollment and the secret of the service
+func (s *enrollmentStore) enroll(token string, publicKey []byte, now time.Time) (enrollment, string, error) {
+	if err := s.checkToken(token); err != nil {
+		return enrollment{}, "", err
+	}
+	if _, err := envelope.ParsePublicKey(publicKey); err != nil {
+		return enrollment{}, "", err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Do not lose a revocation which I did not reload yet
+	if _, err := s.reloadLocked(); err != nil {
+		return enrollment{}, "", err
+	}
+	secret := createToken()
+	e := enrollment{
+		ServiceID:  createToken()[:16],
+		PublicKey:  publicKey,
+		KeyID:      envelope.KeyID(publicKey),
+		SecretHash: hashSecret(secret),
+		Created:    now,
+	}
+	s.services[e.ServiceID] = e
+	if err := s.saveLocked(); err != nil {
+		delete(s.services, e.ServiceID)
+		return enrollment{}, "", err
+	}
+	return e, secret, nil
+}
+
+// Returns SHA-256 of the current secret and of the previous secrets which did not expire
+func (e enrollment) secretHashes(now time.Time) []string {
+	hashes := []string{e.SecretHash}
+	for _, p := range e.PreviousSecrets {
+		if p.Expires.After(now) {
+			hashes = append(hashes, p.SecretHash)
+		}
+	}
+	return hashes
+}
+
+// Returns true if the secret is the current secret or a previous secret which did not expire
+func (e enrollment) checkSecret(secret string, now time.Time) bool {
+	hash := []byte(hashSecret(secret))
+	matched := false
+	for _, h := range e.secretHashes(now) {
+		if subtle.ConstantTimeCompare(hash, []byte(h)) == 1 {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// Replace the public key and the secret of the service, returns the new secret
+// The previous secret signs the reports for previousSecretLifetime
+func (s *enrollmentStore) rotate(serviceID string, secret string, publicKey []byte, now time.Time) (enrollment, string, error) {
+	if _, err := envelope.ParsePublicKey(publicKey); err != nil {
+		return enrollment{}, "", err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.reloadLocked(); err != nil {
+		return enrollment{}, "", err
+	}
+	e, ok := s.services[serviceID]
+	if !ok || !e.checkSecret(secret, now) {
+		return enrollment{}, "", errEnrollmentDenied
+	}
+	if e.Revoked {
+		return enrollment{}, "", errServiceRevoked
+	}
+	previous := e
+	newSecret := createToken()
+	e.PublicKey = publicKey
+	e.KeyID = envelope.KeyID(publicKey)
+	e.Rotated = now
+	e.PreviousSecrets = []previousSecret{{e.SecretHash, now.Add(previousSecretLifetime)}}
+	for _, p := range previous.PreviousSecrets {
+		if p.Expires.After(now) {
+			e.PreviousSecrets = append(e.PreviousSecrets, p)
+		}
+	}
+	e.SecretHash = hashSecret(newSecret)
+	s.services[serviceID] = e
+	if err := s.saveLocked(); err != nil {
+		s.services[serviceID] = previous
+		return enrollment{}, "", err
+	}
+	return e, newSecret, nil
+}
+
+// Mark the service revoked, I keep the record
+func (s *enrollmentStore) revoke(serviceID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.reloadLocked(); err != nil {
+		return err
+	}
+	e, ok := s.services[serviceID]
+	if !ok {
+		return fmt.Errorf("Service '%s' is not enrolled", serviceID)
+	}
+	e.Revoked = true
+	s.services[serviceID] = e
+	return s.saveLocked()
+}
+
+// Returns number of the services which are not revoked
+func (s *enrollmentStore) active() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for _, e := range s.services {
+		if !e.Revoked {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns the enrollment if the service is enrolled and not revoked
+func (s *enrollmentStore) lookup(serviceID string) (enrollment, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.services[serviceID]
+	if !ok || e.Revoked {
+		return enrollment{}, false
+	}
+	return e, true
+}
+
+// Returns the key which signs the reports of the service, the current secret or
+// a previous secret which did not expire
+func (s *enrollmentStore) reportKey(serviceID string, keyID string, now time.Time) ([]byte, bool) {
+	e, ok := s.lookup(serviceID)
+	if !ok {
+		return nil, false
+	}
+	for _, hash := range e.secretHashes(now) {
+		key, err := hex.DecodeString(hash)
+		if err == nil && signature.KeyID(key) == keyID {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func enrollmentErrorToResponse(err error) (enrollResponse, int) {
+	response := enrollResponse{Version: apiVersion, Message: err.Error()}
+	switch {
+	case errors.Is(err, errEnrollmentDisabled):
+		response.Status = statusDisabled
+		return response, http.StatusForbidden
+	case errors.Is(err, errEnrollmentDenied):
+		response.Status = statusDenied
+		return response, http.StatusUnauthorized
+	case errors.Is(err, errServiceRevoked):
+		response.Status = statusRevoked
+		return response, http.StatusForbidden
+	}
+	// Failed to save the file
+	response.Status = statusError
+	return response, http.StatusInternalServerError
+}
+
+// Handle POST /enroll, the request without the service ID is an enrollment
+func (c *configuration) httpHandlerEnroll(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(response, "Use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if c.enrollments == nil {
+		result, code := enrollmentErrorToResponse(errEnrollmentDisabled)
+		writeJSON(response, code, result)
+		return
+	}
+	var enrollRequest enrollRequest
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, maxPayloadSize))
+	if err == nil {
+		err = json.Unmarshal(body, &enrollRequest)
+	}
+	if err == nil {
+		_, err = envelope.ParsePublicKey(enrollRequest.PublicKey)
+	}
+	if err != nil {
+		writeJSON(response, http.StatusBadRequest, enrollResponse{Version: apiVersion, Status: statusMalformed, Message: err.Error()})
+		return
+	}
+	now := time.Now().UTC()
+	if enrollRequest.ServiceID == "" {
+		token := ""
+		if authorization := request.Header.Get("Authorization"); len(authorization) > len("Bearer ") {
+			token = authorization[len("Bearer "):]
+		}
+		e, secret, err := c.enrollments.enroll(token, enrollRequest.PublicKey, now)
+		if err != nil {
+			result, code := enrollmentErrorToResponse(err)
+			writeJSON(response, code, result)
+			return
+		}
+		fmt.Printf("Enrolled service %s key %s\n", e.ServiceID, e.KeyID)
+		writeJSON(response, http.StatusOK, enrollResponse{Version: apiVersion, Status: statusEnrolled, ServiceID: e.ServiceID, Secret: secret, KeyID: e.KeyID})
+		return
+	}
+	e, secret, err := c.enrollments.rotate(enrollRequest.ServiceID, enrollRequest.Secret, enrollRequest.PublicKey, now)
+	if err != nil {
+		result, code := enrollmentErrorToResponse(err)
+		writeJSON(response, code, result)
+		return
+	}
+	fmt.Printf("Rotated key of service %s to %s\n", e.ServiceID, e.KeyID)
+	writeJSON(response, http.StatusOK, enrollResponse{Version: apiVersion, Status: statusRotated, ServiceID: e.ServiceID, Secret: secret, KeyID: e.KeyID})
+}
+
+// Encrypt the payload of the matched session to the key of the reporting service
+// Returns the message for the report. I withhold the payload if the service is
+// not enrolled or revoked, the payload is gone with the session
+func (c *configuration) sealPayload(report *sessionReport, session sessionState, serviceID string) string {
+	var e enrollment
+	ok := false
+	if c.enrollments != nil && serviceID != "" {
+		e, ok = c.enrollments.lookup(serviceID)
+	}
+	var sealed []byte
+	var err error
+	if ok {
+		sealed, err = envelope.Seal(e.PublicKey, session.payload, envelope.AssociatedData(serviceID, uint32(session.id)))
+	}
+	c.mapMutex.Lock()
+	defer c.mapMutex.Unlock()
+	if !ok {
+		c.statistics.PayloadsWithheld++
+		return fmt.Sprintf("Payload withheld, service '%s' is not enrolled\n", serviceID)
+	}
+	if err != nil {
+		c.statistics.PayloadsWithheld++
+		return fmt.Sprintf("Payload withheld, failed to encrypt: %v\n", err)
+	}
+	report.Service = serviceID
+	report.Payload = sealed
+	c.statistics.PayloadsDelivered++
+	return fmt.Sprintf("Payload encrypted to key %s\n", e.KeyID)
+}
@@ -0,0 +1,142 @@
+// Ports which the services advertise
+// A service periodically sends the ports it bound and the ports it failed
+// to bind: /ports?bound=21380,21381,&failed=21382,
+// I keep the ports by the IP address of the service. When a browser from the
+// same address requests a session I try to allocate tuples which do not
+// contain the failed ports. If the allocator can not find such tuple the
+// service still can recover the tuple, see tolerance
+// The advertisement expires unless the service repeats it
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"port-knocking-ipc/utils"
+)
+
+const hostPortsTimeout = time.Duration(60) * time.Second
+// Limit the memory a flood of advertisements can consume
+const maxHosts = 64*1024
+// Attempts to find a tuple without failed ports
+const maxAllocationAttempts = 16
+
+type hostPorts struct {
+	boundPorts     []int
+	failedToBind   []int
+	expirationTime time.Time
+}
+
+// Returns the IP address of the peer
+func remoteHost(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// Parse "21380,21381," and check that the ports are in the range
+func (c *configuration) parsePortsList(s string) ([]int, bool) {
+	ports := []int{}
+	for _, portStr := range strings.Split(s, ",") {
+		if portStr == "" {
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || !utils.Contains(c.portsRange, port) {
+			return nil, false
+		}
+		ports = append(ports, port)
+	}
+	return ports, true
+}
+
+// Remove expired advertisements, called with hostsMutex locked
+func (c *configuration) expireHostsLocked(now time.Time) {
+	for host, ports := range c.hosts {
+		if !ports.expirationTime.After(now) {
+			delete(c.hosts, host)
+		}
+	}
+}
+
+func (c *configuration) setHostPorts(host string, ports hostPorts) bool {
+	c.hostsMutex.Lock()
+	defer c.hostsMutex.Unlock()
+	if c.hosts == nil {
+		c.hosts = make(map[string]hostPorts)
+	}
+	if _, ok := c.hosts[host]; !ok && len(c.hosts) >= maxHosts {
+		c.expireHostsLocked(time.Now().UTC())
+		if len(c.hosts) >= maxHosts {
+			return false
+		}
+	}
+	c.hosts[host] = ports
+	return true
+}
+
+// Returns the ports the service on the host failed to bind
+func (c *configuration) getFailedPorts(host string) []int {
+	c.hostsMutex.Lock()
+	defer c.hostsMutex.Unlock()
+	ports, ok := c.hosts[host]
+	if !ok {
+		return []int{}
+	}
+	if !ports.expirationTime.After(time.Now().UTC()) {
+		delete(c.hosts, host)
+		return []int{}
+	}
+	return ports.failedToBind
+}
+
+func containsAny(tuple []int, ports []int) bool {
+	for _, port := range tuple {
+		if utils.Contains(ports, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allocate tuples, skip the tuples which contain the failed ports
+// I give up after maxAllocationAttempts and use the last tuple
+func getPortsCombinationsAvoiding(allocator tupleAllocator, count int, failedToBind []int) ([][]int, int) {
+	if len(failedToBind) == 0 {
+		return getPortsCombinations(allocator, count), 0
+	}
+	tuples := make([][]int, 0, count)
+	skipped := 0
+	for ;count > 0;count-- {
+		tuple := allocator.NextWrap()
+		for attempt := 1;attempt < maxAllocationAttempts && containsAny(tuple, failedToBind);attempt++ {
+			tuple = allocator.NextWrap()
+			skipped++
+		}
+		tuples = append(tuples, tuple)
+	}
+	return tuples, skipped
+}
+
+// Handle /ports?bound=...&failed=...
+func (c *configuration) httpHandlerPorts(response http.ResponseWriter, query url.Values, host string) {
+	boundPorts, okBound := c.parsePortsList(query.Get("bound"))
+	failedToBind, okFailed := c.parsePortsList(query.Get("failed"))
+	if !okBound || !okFailed {
+		http.Error(response, "Bad ports", http.StatusBadRequest)
+		return
+	}
+	ports := hostPorts{boundPorts, failedToBind, time.Now().UTC().Add(hostPortsTimeout)}
+	if !c.setHostPorts(host, ports) {
+		http.Error(response, "Too many hosts", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(response, "Host %s, failed ports %v\n", host, failedToBind)
+}
@@ -1,15 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 	"port-knocking-ipc/utils/combinations"
+	"port-knocking-ipc/utils/envelope"
 	"port-knocking-ipc/utils"
+	"port-knocking-ipc/utils/process"
+	"port-knocking-ipc/utils/signature"
 )
 
 
 func TestGenerator(t *testing.T) {
 	var generator = combinations.Init(([]int{0,1,2,3})[:], 2)
-	var tuples = getPortsCombinations(&generator, 2, 0)
+	var tuples = getPortsCombinations(&generator, 2)
 	var text = tuplesToText(tuples)
 	var expectedText = "0,1\n0,2\n"
 	if text != expectedText {
@@ -17,34 +34,6 @@ func TestGenerator(t *testing.T) {
 	}	
 }
 
-func testKeyTupleConverter(t *testing.T, expectedTuple []int, expectedKey keyID) {
-	base := uint64(1)
-	key := tupleToKey(base, expectedTuple)
-	if key != expectedKey {
-		t.Errorf("Got '%x' expected '%x'\n", key, expectedKey)
-	}		
-	tuple := keyToTuple(base, key)
-	if !utils.Compare(tuple, expectedTuple) {
-		t.Errorf("Got '%v' expected '%v'\n", tuple, expectedTuple)
-	}		
-}
-
-type keyTupleConverterTestSet struct {
-	tuple []int
-	key keyID
-}
-
-func TestKeyTupleConverter(t *testing.T) {
-	testSets := []keyTupleConverterTestSet {
-		{[]int{2,3,4,5,6,7,8,9}, keyID(0x0102030405060708)},
-		{[]int{1,1,1,1,1,1,1,1}, keyID(0x0000000000000000)},
-	}
-	
-	for _, testSet := range testSets {
-		testKeyTupleConverter(t, testSet.tuple, testSet.key)
-	}
-}
-
 type parseURLQuerySessionPortsTestSet struct {
 	portsStr []string
 	tupleSize int
@@ -75,35 +64,1117 @@ func TestParseUrlQuerySessionPorts(t *testing.T) {
 	}
 }
 
-type parseURLQuerySessionPidSet struct {
-	pidStr []string
-	pid int
+func createTestConfiguration() *configuration {
+	c := configuration{
+		portsBase : 0,
+		portsRangeSize : 4,
+		tolerance : 20,
+		mapSessions : make(map[sessionID]sessionState),        
+		unsignedReports : true,
+	}
+	result, _ := c.initCombinationsGenerator()
+	return result
+}
+
+func TestExpireSessions(t *testing.T) {
+	c := createTestConfiguration()
+	c.addSession(sessionID(1), [][]int{{0,1}, {0,2}}, nil)
+	c.addSession(sessionID(2), [][]int{{1,2}, {1,3}}, nil)
+	if expired := c.expireSessions(time.Now().UTC()); expired != 0 {
+		t.Errorf("Got %d expired sessions expected 0\n", expired)
+	}
+	c.removeSession(sessionID(2))
+	expired := c.expireSessions(time.Now().UTC().Add(time.Minute))
+	if expired != 1 {
+		t.Errorf("Got %d expired sessions expected 1\n", expired)
+	}
+	if len(c.mapSessions) != 0 || c.mapTuples.size() != 0 || c.expirations.Len() != 0 {
+		t.Errorf("Got sessions %v, tuples %v, expirations %v\n", c.mapSessions, c.mapTuples, c.expirations)
+	}
+	if c.statistics.SessionsExpired != 1 || c.statistics.TuplesExpired != 2 {
+		t.Errorf("Got statistics %v\n", c.statistics)
+	}
+}
+
+func TestFindSessionsExpired(t *testing.T) {
+	c := createTestConfiguration()
+	tuples := [][]int{{0,1}, {0,2}}
+	c.addSession(sessionID(1), tuples, nil)
+	if sessions := c.findSessions(tuples); len(sessions) != 1 {
+		t.Errorf("Got sessions %v expected 1 session\n", sessions)
+	}
+	session := c.mapSessions[sessionID(1)]
+	session.expirationTime = time.Now().UTC().Add(-time.Second)
+	c.mapSessions[sessionID(1)] = session
+	if sessions := c.findSessions(tuples); len(sessions) != 0 {
+		t.Errorf("Got sessions %v expected none\n", sessions)
+	}
+}
+
+type tupleMapTestSet struct {
+	base int
+	portsRangeSize int
+	tupleSize int
 	ok bool
 }
 
-// Warning! Test the method which handles URL parsing 
-func TestParseUrlQuerySessionPid(t *testing.T) {
-	testSets := []parseURLQuerySessionPidSet {
-		{[]string{"1"}, int(1), bool(true)},
-		{[]string{"-1"}, int(0), bool(false)},
-		{[]string{"0"}, int(0), bool(false)},
-		{[]string{"9999999999999999999999999999999999999999999999999999999999999999999999999"}, int(0), bool(false)},
-		{[]string{"a1"}, int(0), bool(false)},
-		{[]string{" "}, int(0), bool(false)},
-		{[]string{""}, int(0), bool(false)},
-		{[]string{"1", "2"}, int(0), bool(false)},
-		{[]string(nil), int(0), bool(false)},
+func TestCreateTupleMap(t *testing.T) {
+	testSets := []tupleMapTestSet {
+		{21380, 10, 5, true},
+		{21380, 256, 8, true},
+		{21380, 257, 8, true},
+		{21380, 16, 9, true},
+		{1000, 2000, 20, true},
+		{21380, 0, 0, false},
+		{0xFFF0, 100, 4, false},
+		{21380, 4, 5, false},
 	}
-	
 	for testIndex, testSet := range testSets {
-		pid, ok := parseURLQuerySessionPid(testSet.pidStr)
-		if ok != testSet.ok {
-			t.Errorf("Got ok '%t' expected '%t' for test %d\n", ok, testSet.ok, testIndex)			
+		ports := utils.MakeRange(testSet.base, testSet.portsRangeSize)
+		_, err := createTupleMap(ports, testSet.tupleSize)
+		if (err == nil) != testSet.ok {
+			t.Errorf("Got err '%v' expected ok '%t' for test %d\n", err, testSet.ok, testIndex)
+		}
+	}
+}
+
+// Every combination shall get a unique key
+func testTupleMapNoCollisions(t *testing.T, ports []int, tupleSize int) {
+	m, err := createTupleMap(ports, tupleSize)
+	if err != nil {
+		t.Fatalf("Failed to create map %v\n", err)
+	}
+	generator := combinations.Init(ports, tupleSize)
+	count := 0
+	for tuple := generator.Next(); tuple != nil && count < 10000; tuple = generator.Next() {
+		if !m.set(tuple, sessionID(count)) {
+			t.Fatalf("Failed to add tuple %v\n", tuple)
+		}
+		count++
+		if m.size() != count {
+			t.Fatalf("Collision for tuple %v, size %d, expected %d\n", tuple, m.size(), count)
+		}
+	}
+}
+
+func TestTupleMapNoCollisions(t *testing.T) {
+	testTupleMapNoCollisions(t, utils.MakeRange(21380, 10), 5)
+	testTupleMapNoCollisions(t, utils.MakeRange(21380, 300), 2)
+	testTupleMapNoCollisions(t, utils.MakeRange(21380, 20), 10)
+	ports, _ := utils.ParsePortsRanges("21380-21389,31000-31015")
+	testTupleMapNoCollisions(t, ports, 4)
+}
+
+func TestTupleMapOutOfRange(t *testing.T) {
+	m, _ := createTupleMap(utils.MakeRange(100, 10), 2)
+	m.set([]int{100, 101}, sessionID(1))
+	testSets := [][]int {
+		{100, 101, 102},
+		{101},
+		{99, 101},
+		{100, 110},
+		{100+256, 101},
+	}
+	for testIndex, tuple := range testSets {
+		if id, ok := m.get(tuple); ok {
+			t.Errorf("Got session %d for tuple %v, test %d\n", id, tuple, testIndex)
+		}
+	}
+	if id, ok := m.get([]int{100, 101}); !ok || id != sessionID(1) {
+		t.Errorf("Got session %d, %t expected 1\n", id, ok)
+	}
+}
+
+func benchmarkTupleMap(b *testing.B, m tupleMap, portsRange []int, tupleSize int) {
+	generator := combinations.Init(portsRange, tupleSize)
+	tuples := [][]int{}
+	for i := 0;i < 1024;i++ {
+		tuples = append(tuples, generator.NextWrap())
+	}
+	for i, tuple := range tuples {
+		m.set(tuple, sessionID(i))
+	}
+	b.ResetTimer()
+	for i := 0;i < b.N;i++ {
+		m.get(tuples[i & 1023])
+	}
+}
+
+func BenchmarkTupleMapUint64(b *testing.B) {
+	portsRange := utils.MakeRange(21380, 16)
+	m := &tupleMapUint64{createPortsIndex(portsRange), 8, make(map[keyID]sessionID)}
+	benchmarkTupleMap(b, m, portsRange, 8)
+}
+
+func BenchmarkTupleMapString(b *testing.B) {
+	portsRange := utils.MakeRange(21380, 16)
+	m := &tupleMapString{createPortsIndex(portsRange), 8, 1, make(map[string]sessionID)}
+	benchmarkTupleMap(b, m, portsRange, 8)
+}
+
+func BenchmarkTupleMapStringWide(b *testing.B) {
+	portsRange := utils.MakeRange(21380, 1000)
+	m, _ := createTupleMap(portsRange, 8)
+	benchmarkTupleMap(b, m, portsRange, 8)
+}
+
+type portsRangesTestSet struct {
+	ranges string
+	ports []int
+	ok bool
+}
+
+func TestParsePortsRanges(t *testing.T) {
+	testSets := []portsRangesTestSet {
+		{"21380-21383", []int{21380, 21381, 21382, 21383}, true},
+		{"31000-31001,21380-21381", []int{21380, 21381, 31000, 31001}, true},
+		{"21380,21380-21381, 21385", []int{21380, 21381, 21385}, true},
+		{"21381-21380", nil, false},
+		{"21380-", nil, false},
+		{"a-b", nil, false},
+		{"", nil, false},
+	}
+	for testIndex, testSet := range testSets {
+		ports, err := utils.ParsePortsRanges(testSet.ranges)
+		if (err == nil) != testSet.ok {
+			t.Errorf("Got err '%v' expected ok '%t' for test %d\n", err, testSet.ok, testIndex)
+		}
+		if !utils.Compare(ports, testSet.ports) {
+			t.Errorf("Got ports '%v' expected '%v' for test %d\n", ports, testSet.ports, testIndex)
+		}
+	}
+}
+
+// Tuples spanning sub-ranges shall be found
+func TestDisjointRanges(t *testing.T) {
+	ports, _ := utils.ParsePortsRanges("21380-21381,31000-31001")
+	c := configuration{
+		portsRange : ports,
+		tolerance : 20,
+		mapSessions : make(map[sessionID]sessionState),        
+	}
+	if _, err := c.initCombinationsGenerator(); err != nil {
+		t.Fatalf("Failed to init %v\n", err)
+	}
+	tuples := getPortsCombinations(c.allocator, 6)
+	c.addSession(sessionID(1), tuples, nil)
+	if c.mapTuples.size() != len(tuples) {
+		t.Errorf("Got %d tuples expected %d\n", c.mapTuples.size(), len(tuples))
+	}
+	if sessions := c.findSessions([][]int{{21381, 31000}}); len(sessions) != 1 {
+		t.Errorf("Got sessions %v for tuples %v\n", sessions, tuples)
+	}
+	if sessions := c.findSessions([][]int{{21382, 31000}}); len(sessions) != 0 {
+		t.Errorf("Got sessions %v for tuples %v\n", sessions, tuples)
+	}
+}
+
+// All combinations shall be allocated before any combination repeats
+func TestPermutationAllocator(t *testing.T) {
+	source := utils.MakeRange(21380, 10)
+	allocator, err := createPermutationAllocator(source, 5)
+	if err != nil {
+		t.Fatalf("Failed to create allocator %v\n", err)
+	}
+	for epoch := 0;epoch < 2;epoch++ {
+		m, _ := createTupleMap(source, 5)
+		for i := 0;i < 252;i++ {
+			tuple := allocator.NextWrap()
+			if _, ok := m.get(tuple); ok {
+				t.Fatalf("Tuple %v repeats after %d allocations\n", tuple, i)
+			}
+			m.set(tuple, sessionID(i))
+		}
+	}
+	// 128 choose 64 does not fit uint64
+	allocator, err = createPermutationAllocator(utils.MakeRange(21380, 128), 64)
+	if err != nil {
+		t.Fatalf("Failed to create allocator for 128 choose 64 %v\n", err)
+	}
+	if tuple := allocator.NextWrap(); len(tuple) != 64 {
+		t.Errorf("Got tuple %v\n", tuple)
+	}
+}
+
+// The server starts with a 300 ports range, the allocated tuples open the session
+func TestLargePortsRange(t *testing.T) {
+	c := configuration{
+		portsBase : 21380,
+		portsRangeSize : 300,
+		tolerance : 20,
+		mapSessions : make(map[sessionID]sessionState),        
+		unsignedReports : true,
+	}
+	if _, err := c.initCombinationsGenerator(); err != nil {
+		t.Fatalf("Failed to init %v\n", err)
+	}
+	session := c.allocateSession("127.0.0.1", nil)
+	if len(session.tuples) != c.tuples {
+		t.Fatalf("Got %d tuples expected %d\n", len(session.tuples), c.tuples)
+	}
+	ports := ""
+	for _, tuple := range session.tuples {
+		if len(tuple) != 150 {
+			t.Fatalf("Got tuple of %d ports\n", len(tuple))
+		}
+		for _, port := range tuple {
+			ports += fmt.Sprintf("%d,", port)
+		}
+	}
+	query := url.Values{}
+	query.Set("ports", ports)
+	query.Set("pid", "1234567")
+	recorder := httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("GET", "/session?"+query.Encode(), nil))
+	if !strings.Contains(recorder.Body.String(), "Removed tuples") {
+		t.Errorf("Got '%s'\n", recorder.Body.String())
+	}
+}
+
+// JS free harness: extract the sequence of ports from the generated script
+func parseKnockScriptSequence(t *testing.T, script string) []int {
+	re := regexp.MustCompile(`(?m)^var knockSequence = \[([0-9,]*)\];$`)
+	match := re.FindStringSubmatch(script)
+	if len(match) != 2 {
+		t.Fatalf("No knock sequence in the script\n%s\n", script)
+	}
+	sequence := []int{}
+	for _, portStr := range strings.Split(match[1], ",") {
+		port, ok := utils.AtoIPPort(portStr)
+		if !ok {
+			t.Fatalf("Bad port '%s' in the sequence '%s'\n", portStr, match[1])
+		}
+		sequence = append(sequence, port)
+	}
+	return sequence
+}
+
+func TestKnockScript(t *testing.T) {
+	tuples := [][]int{{21380, 21382}, {21381, 21383}, {21380, 21381}}
+	for _, method := range []string{knockMethodFetch, knockMethodImage, knockMethodWebSocket} {
+		script := knockScript(sessionID(1), "0123", tuples, 0, method)
+		sequence := parseKnockScriptSequence(t, script)
+		expected := []int{21380, 21382, 21381, 21383, 21380, 21381}
+		if !utils.Compare(sequence, expected) {
+			t.Errorf("Got sequence %v expected %v\n", sequence, expected)
+		}
+		if !strings.Contains(script, fmt.Sprintf(`var knockMethod = "%s";`, method)) {
+			t.Errorf("Method %s is missing in the script\n", method)
+		}
+		if !strings.Contains(script, `var knockToken = "0123";`) {
+			t.Errorf("Token is missing in the script\n")
+		}
+		page := knockPage(sessionID(1), "0123", tuples, 0, method)
+		if !strings.Contains(page, script) {
+			t.Errorf("Script is missing in the page\n")
+		}
+		if !strings.Contains(page, `new EventSource("/session/0123/status")`) {
+			t.Errorf("Status subscription is missing in the page\n")
+		}
+	}
+}
+
+func TestHttpHandlerScript(t *testing.T) {
+	c := createTestConfiguration()
+	recorder := httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("GET", "/knock.js", nil))
+	sequence := parseKnockScriptSequence(t, recorder.Body.String())
+	if len(sequence) != c.tuples*c.tupleSize {
+		t.Fatalf("Got sequence %v for %d tuples\n", sequence, c.tuples)
+	}
+	// The knocked ports shall match the allocated session
+	tuples := [][]int{}
+	for i := 0;i < len(sequence);i += c.tupleSize {
+		tuples = append(tuples, sequence[i:i+c.tupleSize])
+	}
+	if sessions := c.findSessions(tuples); len(sessions) != 1 {
+		t.Errorf("Got sessions %v for tuples %v\n", sessions, tuples)
+	}
+
+	recorder = httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("GET", "/knock.js?method=flash", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for unknown method\n", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept", "text/html,application/xhtml+xml")
+	c.httpHandler(recorder, request)
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("Got content type %s\n", recorder.Header().Get("Content-Type"))
+	}
+}
+
+func TestKnockScriptFrameStart(t *testing.T) {
+	tuples := [][]int{{21380, 21382}, {21381, 21383}}
+	script := knockScript(sessionID(1), "0123", tuples, 21379, knockMethodFetch)
+	sequence := parseKnockScriptSequence(t, script)
+	expected := []int{21379, 21380, 21382, 21379, 21381, 21383}
+	if !utils.Compare(sequence, expected) {
+		t.Errorf("Got sequence %v expected %v\n", sequence, expected)
+	}
+	if !strings.Contains(script, "var knockFrameStart = 21379;") {
+		t.Errorf("Frame start port is missing in the script\n")
+	}
+}
+
+// The frame start port shall never be allocated 
+func TestFramePortReserved(t *testing.T) {
+	c := configuration{
+		portsBase : 21380,
+		portsRangeSize : 5,
+		framePort : 21382,
+		tolerance : 20,
+		mapSessions : make(map[sessionID]sessionState),        
+	}
+	if _, err := c.initCombinationsGenerator(); err != nil {
+		t.Fatalf("Failed to init %v\n", err)
+	}
+	if utils.Contains(c.portsRange, c.framePort) || c.portsRangeSize != 4 {
+		t.Errorf("Got ports range %v, frame start port %d\n", c.portsRange, c.framePort)
+	}
+	recorder := httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("GET", "/", nil))
+	lines := strings.Split(recorder.Body.String(), "\n")
+	if lines[0] != "frame_start=21382" {
+		t.Errorf("Got first line '%s'\n", lines[0])
+	}
+	for _, line := range lines[1:] {
+		if strings.Contains(line, "21382") {
+			t.Errorf("Frame start port is allocated in '%s'\n", line)
 		}
-		if pid != testSet.pid {
-			t.Errorf("Got pid '%d' expected '%d' for test %d\n", pid, testSet.pid, testIndex)			
+	}
+}
+
+func TestParseUrlQuerySessionCandidates(t *testing.T) {
+	candidates, ok := parseURLQuerySessionCandidates([]string{"0,1,0,2,;0,1,1,2,"}, 2)
+	expected := [][][]int{{{0,1}, {0,2}}, {{0,1}, {1,2}}}
+	if !ok || len(candidates) != len(expected) {
+		t.Fatalf("Got %v, %t expected %v\n", candidates, ok, expected)
+	}
+	for i := range expected {
+		for j := range expected[i] {
+			if !utils.Compare(candidates[i][j], expected[i][j]) {
+				t.Errorf("Got %v expected %v\n", candidates, expected)
+			}
 		}
 	}
+	if _, ok := parseURLQuerySessionCandidates([]string{"0,1,;"}, 2); ok {
+		t.Errorf("Expected failure for an empty candidate\n")
+	}
 }
 
+// Only the candidate which tuples belong to the same session matches
+func TestFindSessionsCandidates(t *testing.T) {
+	c := createTestConfiguration()
+	c.addSession(sessionID(1), [][]int{{0,1}, {0,2}}, nil)
+	c.addSession(sessionID(2), [][]int{{1,2}, {2,3}}, nil)
+	candidates := [][][]int{{{0,1}, {1,2}}, {{0,1}, {0,2}}}
+	sessions, tuples := c.findSessionsCandidates(candidates)
+	if len(sessions) != 1 || sessions[0].id != sessionID(1) {
+		t.Errorf("Got sessions %v\n", sessions)
+	}
+	if len(tuples) != 2 || !utils.Compare(tuples[1], []int{0,2}) {
+		t.Errorf("Got tuples %v\n", tuples)
+	}
+	sessions, _ = c.findSessionsCandidates([][][]int{{{0,1}, {1,2}}})
+	if len(sessions) != 2 {
+		t.Errorf("Got sessions %v expected 2 sessions\n", sessions)
+	}
+}
 
+// The response shows the identity of the knocking process
+func TestHttpHandlerSessionIdentity(t *testing.T) {
+	c := createTestConfiguration()
+	c.addSession(sessionID(1), [][]int{{0,1}, {0,2}}, nil)
+	query := url.Values{}
+	query.Set("ports", "0,1,0,2,")
+	root := process.Identity{PID: 1234567, PPID: 1, RealUID: 1000, EffectiveUID: 1000, User: "knocker", Executable: "/usr/bin/firefox"}
+	process.Group{Root: root, PIDs: []int{1234568, 1234569}}.Encode(query)
+	recorder := httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("GET", "/session?"+query.Encode(), nil))
+	text := recorder.Body.String()
+	for _, expected := range []string{"Removed tuples", "pid=1234567", "user=knocker", "exe=/usr/bin/firefox", "pids=[1234568 1234569]"} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("'%s' is missing in '%s'\n", expected, text)
+		}
+	}
+	recorder = httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("GET", "/session?ports=0,1,&pid=1&uid=x", nil))
+	if !strings.Contains(recorder.Body.String(), "Failed to parse process identity") {
+		t.Errorf("Got '%s'\n", recorder.Body.String())
+	}
+}
+
+// The service sends the candidates in one 'ports' parameter separated by semicolons
+// The semicolon survives the trip through the HTTP server only if it is escaped
+func TestHttpHandlerSessionCandidates(t *testing.T) {
+	c := createTestConfiguration()
+	c.addSession(sessionID(1), [][]int{{0,1}, {0,2}}, nil)
+	server := httptest.NewServer(http.HandlerFunc(c.httpHandler))
+	defer server.Close()
+	query := url.Values{}
+	query.Set("ports", "0,1,1,2,;0,1,0,2,")
+	query.Set("pid", "1234567")
+	response, err := http.Get(server.URL + "/session?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || !strings.Contains(string(body), "Removed tuples") {
+		t.Errorf("Got %d '%s'\n", response.StatusCode, body)
+	}
+	if _, ok := c.mapSessions[sessionID(1)]; ok {
+		t.Errorf("Session is not removed\n")
+	}
+}
+
+func TestAdvertisedPorts(t *testing.T) {
+	c := createTestConfiguration()
+	testSets := []struct {
+		query string
+		code int
+	}{
+		{"/ports?bound=0,1,2,&failed=3,", http.StatusOK},
+		{"/ports?bound=0,1,&failed=7,", http.StatusBadRequest},
+		{"/ports?bound=x&failed=", http.StatusBadRequest},
+	}
+	for _, testSet := range testSets {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", testSet.query, nil)
+		request.RemoteAddr = "192.0.2.1:36518"
+		c.httpHandler(recorder, request)
+		if recorder.Code != testSet.code {
+			t.Errorf("Got %d for %s\n", recorder.Code, testSet.query)
+		}
+	}
+	if failed := c.getFailedPorts("192.0.2.1"); !utils.Compare(failed, []int{3}) {
+		t.Fatalf("Got failed ports %v\n", failed)
+	}
+	// The allocator visits all tuples in a cycle, I always find a tuple without the port 3
+	for i := 0;i < 20;i++ {
+		tuples := c.allocateSession("192.0.2.1", nil).tuples
+		for _, tuple := range tuples {
+			if utils.Contains(tuple, 3) {
+				t.Fatalf("Allocated %v\n", tuple)
+			}
+		}
+	}
+	if c.statistics.TuplesSkipped == 0 {
+		t.Errorf("No tuples skipped\n")
+	}
+	if failed := c.getFailedPorts("192.0.2.2"); len(failed) != 0 {
+		t.Errorf("Got failed ports %v for another host\n", failed)
+	}
+	// The advertisement expires
+	c.setHostPorts("192.0.2.1", hostPorts{[]int{0, 1, 2}, []int{3}, time.Now().UTC().Add(-time.Second)})
+	if failed := c.getFailedPorts("192.0.2.1"); len(failed) != 0 {
+		t.Errorf("Got expired failed ports %v\n", failed)
+	}
+}
+
+func TestJSONAllocation(t *testing.T) {
+	c := createTestConfiguration()
+	c.framePort = 21379
+	for _, accept := range []string{"", "application/json"} {
+		path := "/v1/"
+		if accept != "" {
+			path = "/"
+		}
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", path, nil)
+		request.Header.Set("Accept", accept)
+		c.httpHandler(recorder, request)
+		var allocation allocationResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &allocation); err != nil {
+			t.Fatalf("Failed to parse '%s': %v\n", recorder.Body.String(), err)
+		}
+		session, ok := c.mapSessions[sessionID(allocation.SessionID)]
+		if !ok || allocation.Version != apiVersion || allocation.TupleSize != c.tupleSize || allocation.FrameStart != 21379 {
+			t.Errorf("Got %+v\n", allocation)
+		}
+		if !allocation.Expires.Equal(session.expirationTime) || len(allocation.Tuples) != len(session.tuples) {
+			t.Errorf("Got %+v, session %v\n", allocation, session)
+		}
+	}
+	// The text format for the Go client
+	recorder := httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("GET", "/", nil))
+	if !strings.HasPrefix(recorder.Body.String(), "frame_start=21379\n") {
+		t.Errorf("Got '%s'\n", recorder.Body.String())
+	}
+}
+
+func TestJSONSessionStatus(t *testing.T) {
+	c := createTestConfiguration()
+	c.addSession(sessionID(1), [][]int{{0,1}, {0,2}}, nil)
+	c.addSession(sessionID(2), [][]int{{1,2}, {2,3}}, nil)
+	c.addSession(sessionID(3), [][]int{{0,3}, {1,3}}, nil)
+	session := c.mapSessions[sessionID(3)]
+	session.expirationTime = time.Now().UTC().Add(-time.Second)
+	c.mapSessions[sessionID(3)] = session
+	testSets := []struct {
+		query string
+		status string
+		code int
+	}{
+		{"ports=0,1,&uid=1", statusMalformed, http.StatusBadRequest},
+		{"ports=0,x,&pid=1", statusMalformed, http.StatusBadRequest},
+		{"ports=0,1,1,2,&pid=1", statusAmbiguous, http.StatusConflict},
+		{"ports=0,3,1,3,&pid=1", statusExpired, http.StatusGone},
+		{"ports=0,1,0,2,&pid=1", statusMatched, http.StatusOK},
+		{"ports=0,1,0,2,&pid=1", statusNotFound, http.StatusNotFound},
+	}
+	for _, testSet := range testSets {
+		recorder := httptest.NewRecorder()
+		c.httpHandler(recorder, httptest.NewRequest("GET", "/v1/session?"+testSet.query, nil))
+		var report sessionReport
+		if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Failed to parse '%s': %v\n", recorder.Body.String(), err)
+		}
+		if report.Status != testSet.status || recorder.Code != testSet.code || report.Version != apiVersion {
+			t.Errorf("Got %s %d for %s, expected %s %d\n", report.Status, recorder.Code, testSet.query, testSet.status, testSet.code)
+		}
+		if report.Status == statusMatched && (len(report.Sessions) != 1 || report.Sessions[0] != 1 || len(report.Tuples) != 2) {
+			t.Errorf("Got %+v\n", report)
+		}
+	}
+	// The text format has the same status code
+	recorder := httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("GET", "/session?ports=1,2,2,3,&pid=1", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "Removed tuples") {
+		t.Errorf("Got %d '%s'\n", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestXMLAllocation(t *testing.T) {
+	c := createTestConfiguration()
+	c.framePort = 21379
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept", "application/xml")
+	c.httpHandler(recorder, request)
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "application/xml") {
+		t.Errorf("Got content type %s\n", recorder.Header().Get("Content-Type"))
+	}
+	var allocation utils.XMLSession
+	if err := xml.Unmarshal(recorder.Body.Bytes(), &allocation); err != nil {
+		t.Fatalf("Failed to parse '%s': %v\n", recorder.Body.String(), err)
+	}
+	session, ok := c.mapSessions[sessionID(allocation.ID)]
+	if !ok || allocation.Version != utils.XMLSessionVersion || allocation.TupleSize != c.tupleSize || allocation.FrameStart != "21379" {
+		t.Fatalf("Got %+v\n", allocation)
+	}
+	if !allocation.Expires.Equal(session.expirationTime) || len(allocation.Tuples) != len(session.tuples) {
+		t.Errorf("Got %+v, session %v\n", allocation, session)
+	}
+	for i, tuple := range allocation.Tuples {
+		if strings.Join(tuple.Ports, ",") != utils.ToString(session.tuples[i], ",") {
+			t.Errorf("Got tuple %v, expected %v\n", tuple.Ports, session.tuples[i])
+		}
+	}
+	// Browsers accept XML too, but get the page
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	c.httpHandler(recorder, request)
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("Got content type %s\n", recorder.Header().Get("Content-Type"))
+	}
+}
+
+
+func getStatus(c *configuration, path string) (int, statusResponse) {
+	recorder := httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("GET", path, nil))
+	var status statusResponse
+	json.Unmarshal(recorder.Body.Bytes(), &status)
+	return recorder.Code, status
+}
+
+// The long poll returns when the service reports the session
+func TestSessionStatusLongPoll(t *testing.T) {
+	c := createTestConfiguration()
+	c.addSession(sessionID(1), [][]int{{0,1}, {0,2}}, nil)
+	c.addSession(sessionID(2), [][]int{{1,2}, {2,3}}, nil)
+	token := c.mapSessions[sessionID(1)].token
+	if len(token) != 32 || token == c.mapSessions[sessionID(2)].token {
+		t.Fatalf("Got token '%s'\n", token)
+	}
+	recorder := httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("GET", "/session/"+token+"/status?after=1&timeout=0", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != statusPending+"\n" {
+		t.Errorf("Got %d '%s'\n", recorder.Code, recorder.Body.String())
+	}
+	for path, code := range map[string]int{
+		"/v1/session/0123/status": http.StatusNotFound,
+		"/v1/session/"+token+"/status?after=x": http.StatusBadRequest,
+		"/v1/session/"+token+"/status?timeout=-1": http.StatusBadRequest,
+		"/v1/session/"+token+"/status": http.StatusOK,
+	} {
+		if got, status := getStatus(c, path); got != code || (code == http.StatusOK && status.Sequence != 1) {
+			t.Errorf("Got %d %+v for %s, expected %d\n", got, status, path, code)
+		}
+	}
+	// The reports wake up the waiters: ambiguous without the identity, then matched
+	reports := []struct {
+		query string
+		status string
+		identity bool
+	}{
+		{"ports=0,1,1,2,&pid=1", statusAmbiguous, false},
+		{"ports=0,1,0,2,&pid=1", statusMatched, true},
+	}
+	for i, report := range reports {
+		done := make(chan statusResponse)
+		go func(after int) {
+			_, status := getStatus(c, fmt.Sprintf("/v1/session/%s/status?after=%d&timeout=5", token, after))
+			done <- status
+		}(i+1)
+		time.Sleep(50 * time.Millisecond)
+		c.reportSession(mustParseQuery(t, report.query))
+		select {
+		case status := <-done:
+			if status.Status != report.status || status.Sequence != i+2 || (status.Identity != nil) != report.identity || (report.identity && status.Identity.PID != 1) {
+				t.Errorf("Got %+v, expected %s\n", status, report.status)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Long poll did not return after the report %s\n", report.query)
+		}
+	}
+	// The final event does not block
+	if _, status := getStatus(c, "/v1/session/"+token+"/status?after=3"); status.Status != statusMatched {
+		t.Errorf("Got %+v\n", status)
+	}
+	// The reaper expires the pending session, removes the resolved sessions after the grace
+	now := time.Now().UTC()
+	if removed := c.expireConfirmations(now.Add(time.Minute)); removed != 1 {
+		t.Errorf("Removed %d sessions\n", removed)
+	}
+	if _, status := getStatus(c, "/v1/session/"+c.mapSessions[sessionID(2)].token+"/status?after=2"); status.Status != statusExpired {
+		t.Errorf("Got %+v\n", status)
+	}
+	if removed := c.expireConfirmations(now.Add(2*time.Minute)); removed != 1 || len(c.confirmations) != 0 {
+		t.Errorf("Removed %d sessions, left %d\n", removed, len(c.confirmations))
+	}
+}
+
+func mustParseQuery(t *testing.T, query string) url.Values {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+// A single event wakes up all waiters of the session
+func TestSessionStatusWaiters(t *testing.T) {
+	c := createTestConfiguration()
+	session := c.addSession(sessionID(1), [][]int{{0,1}, {0,2}}, nil)
+	const waiters = 2000
+	done := make(chan sessionEvent, waiters)
+	for i := 0;i < waiters;i++ {
+		go func() {
+			event, _ := c.waitEvent(nil, session.token, 1, 10*time.Second)
+			done <- event
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	c.publishEvent(session.token, statusMatched, nil)
+	timeout := time.After(2 * time.Second)
+	for i := 0;i < waiters;i++ {
+		select {
+		case event := <-done:
+			if event.Status != statusMatched {
+				t.Fatalf("Got %+v\n", event)
+			}
+		case <-timeout:
+			t.Fatalf("%d waiters did not wake up\n", waiters-i)
+		}
+	}
+}
+
+func TestSessionStatusEvents(t *testing.T) {
+	c := createTestConfiguration()
+	session := c.addSession(sessionID(1), [][]int{{0,1}, {0,2}}, nil)
+	server := httptest.NewServer(http.HandlerFunc(c.httpHandler))
+	defer server.Close()
+	request, _ := http.NewRequest("GET", server.URL+"/session/"+session.token+"/status", nil)
+	request.Header.Set("Accept", "text/event-stream")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/event-stream") {
+		t.Errorf("Got content type %s\n", response.Header.Get("Content-Type"))
+	}
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	// Returns the "event:" lines until the empty line
+	readEvent := func() string {
+		event := ""
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return event
+				}
+				if line == "" {
+					return event
+				}
+				if strings.HasPrefix(line, "event: ") {
+					event = strings.TrimPrefix(line, "event: ")
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("No event\n")
+			}
+		}
+	}
+	if event := readEvent(); event != statusPending {
+		t.Errorf("Got event '%s'\n", event)
+	}
+	c.reportSession(mustParseQuery(t, "ports=0,1,0,2,&pid=1"))
+	if event := readEvent(); event != statusMatched {
+		t.Errorf("Got event '%s'\n", event)
+	}
+	// The stream ends after the final event
+	if event := readEvent(); event != "" {
+		t.Errorf("Got event '%s' after the final event\n", event)
+	}
+}
+
+// The long polls and the streams return when the server shuts down
+func TestSessionStatusShutdown(t *testing.T) {
+	c := createTestConfiguration()
+	shutdown := make(chan struct{})
+	c.done = shutdown
+	session := c.addSession(sessionID(1), [][]int{{0,1}, {0,2}}, nil)
+	server := httptest.NewServer(http.HandlerFunc(c.httpHandler))
+	defer server.Close()
+	done := make(chan string, 2)
+	for _, accept := range []string{"text/plain", "text/event-stream"} {
+		go func(accept string) {
+			request, _ := http.NewRequest("GET", server.URL+"/session/"+session.token+"/status?after=1&timeout=30", nil)
+			request.Header.Set("Accept", accept)
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				done <- err.Error()
+				return
+			}
+			defer response.Body.Close()
+			ioutil.ReadAll(response.Body)
+			done <- accept
+		}(accept)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(shutdown)
+	for i := 0;i < 2;i++ {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Request did not return on shutdown\n")
+		}
+	}
+}
+
+// Nobody can sign the reports: the server accepts the unsigned reports or refuses to start
+func TestCheckReportsAccepted(t *testing.T) {
+	key, _ := envelope.GenerateKey()
+	revoked := enrollment{ServiceID: "a1b2", PublicKey: key.PublicKey().Bytes(), Revoked: true}
+	active := enrollment{ServiceID: "c3d4", PublicKey: key.PublicKey().Bytes()}
+	testSets := []struct {
+		name          string
+		token         string
+		services      []enrollment
+		unsigned      bool
+		requireSigned bool
+		accept        bool
+		ok            bool
+	}{
+		{"defaults", "", nil, false, false, true, true},
+		{"require", "", nil, false, true, false, false},
+		{"unsigned", "", nil, true, false, true, true},
+		{"conflict", "", nil, true, true, false, false},
+		{"revoked service", "", []enrollment{revoked}, false, true, false, false},
+		{"enrolled service", "", []enrollment{revoked, active}, false, true, false, true},
+		{"token", "token", nil, false, false, false, true},
+		{"token and unsigned", "token", nil, true, false, true, true},
+	}
+	for _, testSet := range testSets {
+		enrollments, _ := createEnrollmentStore("", testSet.token)
+		for _, e := range testSet.services {
+			enrollments.services[e.ServiceID] = e
+		}
+		accept, err := checkReportsAccepted(enrollments, testSet.unsigned, testSet.requireSigned)
+		if accept != testSet.accept || (err == nil) != testSet.ok {
+			t.Errorf("%s: got %t %v\n", testSet.name, accept, err)
+		}
+	}
+}
+
+// The text response contains the session token
+func TestTextSessionToken(t *testing.T) {
+	c := createTestConfiguration()
+	recorder := httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("GET", "/", nil))
+	if !strings.HasPrefix(recorder.Body.String(), utils.SessionTokenPrefix+c.mapSessions[sessionID(1)].token+"\n") {
+		t.Errorf("Got '%s'\n", recorder.Body.String())
+	}
+}
+
+// The payload is handed out to the first unique match only
+func TestSessionPayload(t *testing.T) {
+	c := createTestConfiguration()
+	recorder := httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("POST", "/v1/", strings.NewReader("secret key")))
+	if recorder.Code != http.StatusOK || strings.Contains(recorder.Body.String(), "secret") {
+		t.Errorf("Got %d '%s'\n", recorder.Code, recorder.Body.String())
+	}
+	if payload := string(c.mapSessions[sessionID(1)].payload); payload != "secret key" {
+		t.Errorf("Got payload '%s'\n", payload)
+	}
+	recorder = httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("POST", "/v1/", strings.NewReader(strings.Repeat("x", maxPayloadSize+1))))
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Got %d for a large payload\n", recorder.Code)
+	}
+	c = createTestConfiguration()
+	c.enrollments, _ = createEnrollmentStore("", "token")
+	key, _ := envelope.GenerateKey()
+	e, secret, err := c.enrollments.enroll("token", key.PublicKey().Bytes(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.addSession(sessionID(1), [][]int{{0,1}, {0,2}}, []byte("secret key"))
+	c.addSession(sessionID(2), [][]int{{1,2}, {2,3}}, []byte("other key"))
+	c.addSession(sessionID(3), [][]int{{0,3}, {1,3}}, []byte("third key"))
+	testSets := []struct {
+		query string
+		signed bool
+		status string
+		payload string
+	}{
+		{"ports=0,1,1,2,&pid=1&service=" + e.ServiceID, true, statusAmbiguous, ""},
+		{"ports=0,1,0,2,&pid=1&service=" + e.ServiceID, true, statusMatched, "secret key"},
+		{"ports=0,1,0,2,&pid=1&service=" + e.ServiceID, true, statusNotFound, ""},
+		// The report is not signed, the payload is withheld
+		{"ports=0,3,1,3,&pid=1&service=" + e.ServiceID, false, statusMatched, ""},
+	}
+	for _, testSet := range testSets {
+		query := mustParseQuery(t, testSet.query)
+		if testSet.signed {
+			signature.Sign(query, signature.ReportKey(secret), time.Now())
+		}
+		recorder := httptest.NewRecorder()
+		c.httpHandler(recorder, httptest.NewRequest("GET", "/v1/session?"+query.Encode(), nil))
+		var report sessionReport
+		json.Unmarshal(recorder.Body.Bytes(), &report)
+		payload := []byte{}
+		if len(report.Payload) != 0 {
+			payload, err = envelope.Open(key, report.Payload, envelope.AssociatedData(e.ServiceID, report.Sessions[0]))
+			if err != nil {
+				t.Errorf("Failed to open the payload for %s: %v\n", testSet.query, err)
+			}
+		}
+		if report.Status != testSet.status || string(payload) != testSet.payload {
+			t.Errorf("Got %s '%s' for %s, expected %s '%s'\n", report.Status, payload, testSet.query, testSet.status, testSet.payload)
+		}
+		// The message never contains the payload
+		if strings.Contains(report.Message, "secret") || strings.Contains(report.Message, "third") || strings.Contains(string(report.Payload), "secret") {
+			t.Errorf("Payload in the report '%s'\n", report.Message)
+		}
+	}
+	if c.statistics.PayloadsDelivered != 1 || c.statistics.PayloadsWithheld != 1 {
+		t.Errorf("Got %+v\n", c.statistics)
+	}
+}
+
+func postEnroll(c *configuration, token string, request enrollRequest) (int, enrollResponse) {
+	body, _ := json.Marshal(request)
+	httpRequest := httptest.NewRequest("POST", "/enroll", strings.NewReader(string(body)))
+	if token != "" {
+		httpRequest.Header.Set("Authorization", "Bearer " + token)
+	}
+	recorder := httptest.NewRecorder()
+	c.httpHandler(recorder, httpRequest)
+	var response enrollResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, response
+}
+
+// Enrollment, rotation and revocation with the file store
+func TestEnrollment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "enrollments.json")
+	c := createTestConfiguration()
+	c.enrollments, _ = createEnrollmentStore(path, "token")
+	key, _ := envelope.GenerateKey()
+	newKey, _ := envelope.GenerateKey()
+	code, enrolled := postEnroll(c, "token", enrollRequest{PublicKey: key.PublicKey().Bytes()})
+	if code != http.StatusOK || enrolled.Status != statusEnrolled || enrolled.Secret == "" || enrolled.KeyID != envelope.KeyID(key.PublicKey().Bytes()) {
+		t.Fatalf("Got %d %+v\n", code, enrolled)
+	}
+	// The file never contains the secret
+	if data, _ := ioutil.ReadFile(path); !strings.Contains(string(data), enrolled.ServiceID) || strings.Contains(string(data), enrolled.Secret) {
+		t.Errorf("Got file '%s'\n", data)
+	}
+	// The file holds the signing keys, only the owner reads the file
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Got %v %v\n", info, err)
+	}
+	os.Chmod(path, 0644)
+	if _, err := createEnrollmentStore(path, "token"); err == nil {
+		t.Errorf("Loaded the file which others can read\n")
+	}
+	os.Chmod(path, 0600)
+	testSets := []struct {
+		name string
+		token string
+		request enrollRequest
+		code int
+		status string
+	}{
+		{"no token", "", enrollRequest{PublicKey: key.PublicKey().Bytes()}, http.StatusUnauthorized, statusDenied},
+		{"bad token", "other", enrollRequest{PublicKey: key.PublicKey().Bytes()}, http.StatusUnauthorized, statusDenied},
+		{"bad key", "token", enrollRequest{PublicKey: []byte("short")}, http.StatusBadRequest, statusMalformed},
+		{"bad secret", "", enrollRequest{ServiceID: enrolled.ServiceID, Secret: "other", PublicKey: newKey.PublicKey().Bytes()}, http.StatusUnauthorized, statusDenied},
+		{"unknown service", "", enrollRequest{ServiceID: "unknown", Secret: enrolled.Secret, PublicKey: newKey.PublicKey().Bytes()}, http.StatusUnauthorized, statusDenied},
+		{"rotation", "", enrollRequest{ServiceID: enrolled.ServiceID, Secret: enrolled.Secret, PublicKey: newKey.PublicKey().Bytes()}, http.StatusOK, statusRotated},
+		// The service lost the response and retries with the previous secret
+		{"retry", "", enrollRequest{ServiceID: enrolled.ServiceID, Secret: enrolled.Secret, PublicKey: newKey.PublicKey().Bytes()}, http.StatusOK, statusRotated},
+	}
+	secret := enrolled.Secret
+	for _, testSet := range testSets {
+		code, response := postEnroll(c, testSet.token, testSet.request)
+		if code != testSet.code || response.Status != testSet.status {
+			t.Errorf("%s: got %d %+v\n", testSet.name, code, response)
+		}
+		if response.Status == statusRotated {
+			secret = response.Secret
+		}
+	}
+	// The rotation replaced the secret
+	if secret == enrolled.Secret || secret == "" {
+		t.Errorf("Got secret '%s' after rotation\n", secret)
+	}
+	if e, ok := c.enrollments.lookup(enrolled.ServiceID); !ok || e.KeyID != envelope.KeyID(newKey.PublicKey().Bytes()) {
+		t.Errorf("Got %+v after rotation\n", e)
+	}
+	// Another process revokes the service in the file, the server reloads the file
+	other, err := createEnrollmentStore(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.revoke(enrolled.ServiceID); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.revoke("unknown"); err == nil {
+		t.Errorf("Revoked unknown service\n")
+	}
+	// The file system can keep the modification time
+	c.enrollments.modTime = time.Time{}
+	c.reloadEnrollments()
+	if _, ok := c.enrollments.lookup(enrolled.ServiceID); ok {
+		t.Errorf("Service is not revoked\n")
+	}
+	code, response := postEnroll(c, "", enrollRequest{ServiceID: enrolled.ServiceID, Secret: secret, PublicKey: key.PublicKey().Bytes()})
+	if code != http.StatusForbidden || response.Status != statusRevoked {
+		t.Errorf("Got %d %+v for the revoked service\n", code, response)
+	}
+	// No enrollment token, the enrollment is disabled
+	c.enrollments, _ = createEnrollmentStore("", "")
+	if code, response := postEnroll(c, "", enrollRequest{PublicKey: key.PublicKey().Bytes()}); code != http.StatusForbidden || response.Status != statusDisabled {
+		t.Errorf("Got %d %+v without the enrollment token\n", code, response)
+	}
+	recorder := httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("GET", "/enroll", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Got %d for GET\n", recorder.Code)
+	}
+}
+
+func signedReport(query string, serviceID string, secret string, now time.Time) string {
+	values, _ := url.ParseQuery(query)
+	values.Set("service", serviceID)
+	signature.Sign(values, signature.ReportKey(secret), now)
+	return values.Encode()
+}
+
+// Signed reports: bad signature, stale timestamp, replayed nonce, keys during the rotation
+func TestSignedReports(t *testing.T) {
+	c := createTestConfiguration()
+	c.unsignedReports = false
+	c.enrollments, _ = createEnrollmentStore("", "token")
+	key, _ := envelope.GenerateKey()
+	e, secret, _ := c.enrollments.enroll("token", key.PublicKey().Bytes(), time.Now())
+	other, otherSecret, _ := c.enrollments.enroll("token", key.PublicKey().Bytes(), time.Now())
+	now := time.Now().UTC()
+	replayed := signedReport("ports=0,1,0,2,&pid=1", e.ServiceID, secret, now)
+	tampered := strings.Replace(signedReport("ports=0,1,0,2,&pid=1", e.ServiceID, secret, now), "pid=1", "pid=2", 1)
+	c.enrollments.revoke(other.ServiceID)
+	testSets := []struct {
+		name string
+		query string
+		code int
+	}{
+		{"unsigned", "ports=0,1,0,2,&pid=1", http.StatusUnauthorized},
+		{"signed", replayed, http.StatusNotFound},
+		{"replayed", replayed, http.StatusUnauthorized},
+		{"tampered", tampered, http.StatusUnauthorized},
+		{"other secret", signedReport("ports=0,1,0,2,&pid=1", e.ServiceID, "other", now), http.StatusUnauthorized},
+		{"stale", signedReport("ports=0,1,0,2,&pid=1", e.ServiceID, secret, now.Add(-2*maxReportSkew)), http.StatusUnauthorized},
+		{"future", signedReport("ports=0,1,0,2,&pid=1", e.ServiceID, secret, now.Add(2*maxReportSkew)), http.StatusUnauthorized},
+		{"revoked", signedReport("ports=0,1,0,2,&pid=1", other.ServiceID, otherSecret, now), http.StatusUnauthorized},
+		{"unknown service", signedReport("ports=0,1,0,2,&pid=1", "unknown", secret, now), http.StatusUnauthorized},
+	}
+	for _, testSet := range testSets {
+		recorder := httptest.NewRecorder()
+		c.httpHandler(recorder, httptest.NewRequest("GET", "/v1/session?"+testSet.query, nil))
+		if recorder.Code != testSet.code {
+			t.Errorf("%s: got %d '%s'\n", testSet.name, recorder.Code, recorder.Body.String())
+		}
+	}
+	if c.statistics.ReportsRejected != uint64(len(testSets)-1) {
+		t.Errorf("Got %+v\n", c.statistics)
+	}
+	// A forged report does not remove the session
+	c.addSession(sessionID(1), [][]int{{0,1}, {0,2}}, nil)
+	recorder := httptest.NewRecorder()
+	c.httpHandler(recorder, httptest.NewRequest("GET", "/v1/session?"+tampered, nil))
+	if _, ok := c.mapSessions[sessionID(1)]; !ok || recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Got %d, the session is removed\n", recorder.Code)
+	}
+	// After the rotation the previous and the new secrets are active until the previous secret expires
+	_, newSecret, err := c.enrollments.rotate(e.ServiceID, secret, key.PublicKey().Bytes(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{secret, newSecret} {
+		if _, err := c.verifyReport(mustParseQuery(t, signedReport("ports=0,1,&pid=1", e.ServiceID, s, now)), now); err != nil {
+			t.Errorf("Failed to verify: %v\n", err)
+		}
+	}
+	later := now.Add(previousSecretLifetime)
+	if _, err := c.verifyReport(mustParseQuery(t, signedReport("ports=0,1,&pid=1", e.ServiceID, secret, later)), later); err == nil {
+		t.Errorf("Verified the expired secret\n")
+	}
+	if serviceID, err := c.verifyReport(mustParseQuery(t, signedReport("ports=0,1,&pid=1", e.ServiceID, newSecret, later)), later); err != nil || serviceID != e.ServiceID {
+		t.Errorf("Got '%s' %v\n", serviceID, err)
+	}
+	// The reaper removes the nonces
+	if removed := c.expireNonces(later.Add(2*maxReportSkew)); removed != 4 || len(c.nonces) != 0 {
+		t.Errorf("Removed %d nonces, left %d\n", removed, len(c.nonces))
+	}
+	// The expired secret does not authenticate the rotation
+	if _, _, err := c.enrollments.rotate(e.ServiceID, secret, key.PublicKey().Bytes(), later); !errors.Is(err, errEnrollmentDenied) {
+		t.Errorf("Got %v for the expired secret\n", err)
+	}
+}
@@ -0,0 +1,291 @@
+// Browser side of the port knocking
+// The server generates a JavaScript which knocks the allocated ports on 127.0.0.1 
+// in the exact order of the tuples. The service assumes the ascending order of ports 
+// in a tuple, so the script knocks one port at time: the script starts a connection,
+// waits until the connection fails (the service closes all accepted connections), 
+// or the knock timeout expires, pauses and only then knocks the next port.
+// The script supports three methods of knocking
+// * fetch() in 'no-cors' mode
+// * <img> element 
+// * WebSocket
+// The script is generated from a template. The template keeps the sequence of ports in 
+// a single line "var knockSequence = [...];" which allows to test the generated script 
+// without a JS engine
+// In the frame start mode the script knocks the frame start port before every tuple
+// and pauses after the frame start knock and after the tuple. The ports of a tuple
+// can be knocked in any order in this mode, the script knocks them in parallel
+// The script exports the session token, window.portKnockingToken. The page subscribes
+// to the session status /session/TOKEN/status and shows the status, see confirm.go
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+	"port-knocking-ipc/utils"
+)
+
+// Knocking parameters shared by the script and the Go client
+const knockTimeout = time.Duration(50) * time.Millisecond
+const knockPause = time.Duration(10) * time.Millisecond
+const knockFramePause = time.Duration(50) * time.Millisecond
+
+const knockMethodFetch = "fetch"
+const knockMethodImage = "img"
+const knockMethodWebSocket = "websocket"
+
+type knockScriptParameters struct {
+	Session  sessionID
+	Token      string
+	Sequence   string
+	FramePort  int
+	Method     string
+	Timeout    int64
+	Pause      int64
+	FramePause int64
+}
+
+var knockScriptTemplate = template.Must(template.New("knock.js").Parse(`// Generated by the port knocking server, session {{.Session}}
+(function() {
+var knockToken = "{{.Token}}";
+var knockSequence = [{{.Sequence}}];
+var knockMethod = "{{.Method}}";
+var knockTimeout = {{.Timeout}};
+var knockPause = {{.Pause}};
+var knockFrameStart = {{.FramePort}};
+var knockFramePause = {{.FramePause}};
+
+function delay(ms) {
+	return new Promise(function(resolve) { setTimeout(resolve, ms); });
+}
+
+// Resolves when the connection attempt is completed or the timeout expires
+function knockFetch(url) {
+	var options = {mode: "no-cors", cache: "no-store"};
+	var timer = null;
+	if (typeof AbortController !== "undefined") {
+		var controller = new AbortController();
+		options.signal = controller.signal;
+		timer = setTimeout(function() { controller.abort(); }, knockTimeout);
+	}
+	return Promise.race([
+		fetch(url, options).catch(function() {}),
+		delay(knockTimeout)
+	]).then(function() { if (timer) { clearTimeout(timer); } });
+}
+
+function knockImage(url) {
+	return new Promise(function(resolve) {
+		var image = new Image();
+		var timer = setTimeout(done, knockTimeout);
+		function done() {
+			clearTimeout(timer);
+			image.onload = image.onerror = null;
+			image.src = "";
+			resolve();
+		}
+		image.onload = image.onerror = done;
+		image.src = url + "?" + Date.now();
+	});
+}
+
+function knockWebSocket(port) {
+	return new Promise(function(resolve) {
+		var socket = null;
+		var timer = setTimeout(done, knockTimeout);
+		function done() {
+			clearTimeout(timer);
+			if (socket) {
+				socket.onopen = socket.onerror = socket.onclose = null;
+				try { socket.close(); } catch (e) {}
+			}
+			resolve();
+		}
+		try {
+			socket = new WebSocket("ws://127.0.0.1:" + port + "/");
+			socket.onopen = socket.onerror = socket.onclose = done;
+		} catch (e) {
+			done();
+		}
+	});
+}
+
+function knock(port) {
+	var url = "http://127.0.0.1:" + port + "/";
+	if (knockMethod === "{{.MethodImage}}") {
+		return knockImage(url);
+	}
+	if (knockMethod === "{{.MethodWebSocket}}") {
+		return knockWebSocket(port);
+	}
+	return knockFetch(url);
+}
+
+// Knock the ports one by one, never start a knock before the previous one completed
+function knockOrdered() {
+	return knockSequence.reduce(function(previous, port) {
+		return previous.then(function() {
+			return knock(port);
+		}).then(function() {
+			return delay(knockPause);
+		});
+	}, Promise.resolve());
+}
+
+// Split the sequence by the frame start port, knock the frame start port, pause, 
+// knock all ports of the tuple in parallel, pause
+function knockFrames() {
+	var frames = [];
+	knockSequence.forEach(function(port) {
+		if (port === knockFrameStart) {
+			frames.push([]);
+		} else if (frames.length > 0) {
+			frames[frames.length-1].push(port);
+		}
+	});
+	return frames.reduce(function(previous, frame) {
+		return previous.then(function() {
+			return knock(knockFrameStart);
+		}).then(function() {
+			return delay(knockFramePause);
+		}).then(function() {
+			return Promise.all(frame.map(knock));
+		}).then(function() {
+			return delay(knockFramePause);
+		});
+	}, Promise.resolve());
+}
+
+function knockAll() {
+	if (knockFrameStart > 0) {
+		return knockFrames();
+	}
+	return knockOrdered();
+}
+
+window.portKnockingToken = knockToken;
+window.portKnocking = knockAll();
+})();
+`))
+
+var knockPageTemplate = template.Must(template.New("knock.html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Port knocking</title>
+</head>
+<body>
+<p>Session {{.Session}}</p>
+<p id="status">pending</p>
+<script>
+{{.Script}}
+</script>
+<script>
+if (typeof EventSource !== "undefined") {
+	var knockStatus = new EventSource("/session/{{.Token}}/status");
+	["pending", "ambiguous", "matched", "expired"].forEach(function(status) {
+		knockStatus.addEventListener(status, function() {
+			document.getElementById("status").textContent = status;
+			if (status === "matched" || status === "expired") {
+				knockStatus.close();
+			}
+		});
+	});
+}
+</script>
+</body>
+</html>
+`))
+
+// Returns list of ports in the order the client shall knock them
+// If the frame start port is not zero every tuple is preceded by the frame start port
+func knockSequence(tuples [][]int, framePort int) []int {
+	sequence := []int{}
+	for _, tuple := range tuples {
+		if framePort != 0 {
+			sequence = append(sequence, framePort)
+		}
+		sequence = append(sequence, tuple...)
+	}
+	return sequence
+}
+
+// Returns the knocking method or an empty string if the method is not supported
+func parseKnockMethod(query url.Values) string {
+	method := query.Get("method")
+	switch method {
+	case "":
+		return knockMethodFetch
+	case knockMethodFetch, knockMethodImage, knockMethodWebSocket:
+		return method
+	}
+	return ""
+}
+
+// Generate the script knocking the tuples
+func knockScript(id sessionID, token string, tuples [][]int, framePort int, method string) string {
+	var text bytes.Buffer
+	parameters := struct {
+		knockScriptParameters
+		MethodImage     string
+		MethodWebSocket string
+	}{
+		knockScriptParameters{
+			Session:  id,
+			Token:      token,
+			Sequence:   utils.ToString(knockSequence(tuples, framePort), ","),
+			FramePort:  framePort,
+			Method:     method,
+			Timeout:    int64(knockTimeout / time.Millisecond),
+			Pause:      int64(knockPause / time.Millisecond),
+			FramePause: int64(knockFramePause / time.Millisecond),
+		},
+		knockMethodImage,
+		knockMethodWebSocket,
+	}
+	knockScriptTemplate.Execute(&text, parameters)
+	return text.String()
+}
+
+// Generate HTML page with the script knocking the tuples
+func knockPage(id sessionID, token string, tuples [][]int, framePort int, method string) string {
+	var text bytes.Buffer
+	knockPageTemplate.Execute(&text, struct {
+		Session sessionID
+		Token   string
+		Script  string
+	}{id, token, knockScript(id, token, tuples, framePort, method)})
+	return text.String()
+}
+
+// Handle /knock.js - allocate a session, send the script
+func (c *configuration) httpHandlerScript(response http.ResponseWriter, query url.Values, host string) {
+	method := parseKnockMethod(query)
+	if method == "" {
+		http.Error(response, fmt.Sprintf("Unknown method '%s'", query.Get("method")), http.StatusBadRequest)
+		return
+	}
+	session := c.allocateSession(host, nil)
+	id, tuples := session.id, session.tuples
+	response.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	response.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(response, knockScript(id, session.token, tuples, c.framePort, method))
+}
+
+// Handle requests for HTML - allocate a session, send the page
+func (c *configuration) httpHandlerPage(response http.ResponseWriter, query url.Values, host string) {
+	method := parseKnockMethod(query)
+	if method == "" {
+		http.Error(response, fmt.Sprintf("Unknown method '%s'", query.Get("method")), http.StatusBadRequest)
+		return
+	}
+	session := c.allocateSession(host, nil)
+	id, tuples := session.id, session.tuples
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	response.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(response, knockPage(id, session.token, tuples, c.framePort, method))
+}
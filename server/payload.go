@@ -0,0 +1,40 @@
+// Payload of the session
+// The integrator allocates a session with a payload, for example an API key or a
+// user token: POST / with the payload in the body. The server keeps the payload
+// with the session and sends it to the service in the response to the /session
+// report (JSON only) when the report matches the session uniquely
+// The server hands the payload only to the enrolled services. The service adds
+// its ID to the report, I encrypt the payload to the key of the service, see enroll.go
+// The server removes the session in the same critical section which hands out
+// the payload. A second report of the same ports gets not_found, the payload is
+// handed out at most once. The ambiguous reports never get the payload, the expired
+// sessions take the payload with them
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const maxPayloadSize = 4096
+
+// Returns the payload in the body of POST, nil if there is no payload
+func readPayload(request *http.Request) ([]byte, error) {
+	if request.Method != http.MethodPost || request.Body == nil {
+		return nil, nil
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(request.Body, maxPayloadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > maxPayloadSize {
+		return nil, fmt.Errorf("Payload is larger than %d bytes", maxPayloadSize)
+	}
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	return payload, nil
+}
@@ -0,0 +1,77 @@
+// Reaper removes expired sessions from the maps
+// Every session gets an expiration time when allocated. I keep a min-heap of
+// (expiration time, session ID) ordered by the expiration time. The reaper pops 
+// the heap until the top of the heap is in the future. This way I never scan
+// the whole map of sessions while holding the mapMutex 
+// Sessions removed by the /session handler leave stale entries in the heap. The
+// reaper skips such entries when popped
+// The reaper keeps expired sessions for expiredSessionGrace. The lookups ignore 
+// expired sessions, but the /session handler can tell "expired" from "not found"
+// The reaper publishes the "expired" status of the sessions and removes the old
+// statuses, see confirm.go
+// The reaper removes the expired nonces of the signed reports, see signature.go
+// The reaper reloads the enrollments when "server -revoke" modifies the file, see enroll.go
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const expiredSessionGrace = time.Duration(10) * time.Second
+
+// Remove all sessions which expired by 'now', return number of removed sessions
+func (c *configuration) expireSessions(now time.Time) int {
+	c.mapMutex.Lock()
+	defer c.mapMutex.Unlock()
+	expired := 0
+	for {
+		expirationTime, id, ok := c.expirations.PopExpired(now)
+		if !ok {
+			break
+		}
+		session, ok := c.mapSessions[id]
+		// The session could be removed by the /session handler 
+		if !ok || !session.expirationTime.Equal(expirationTime) {
+			continue
+		}
+		_, tuplesRemoved := c.removeSessionLocked(session)
+		c.statistics.SessionsExpired++
+		c.statistics.TuplesExpired += uint64(len(tuplesRemoved))
+		expired++
+	}
+	return expired
+}
+
+// Goroutine which periodically removes expired sessions until the context is done
+func (c *configuration) reaper(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now().UTC()
+			c.expireSessions(now.Add(-expiredSessionGrace))
+			c.expireConfirmations(now)
+			c.expireNonces(now)
+			c.reloadEnrollments()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Reload the enrollments if the file was modified
+func (c *configuration) reloadEnrollments() {
+	if c.enrollments == nil {
+		return
+	}
+	reloaded, err := c.enrollments.reload()
+	if err != nil {
+		fmt.Println("Failed to reload enrollments", err)
+	} else if reloaded {
+		fmt.Println("Reloaded enrollments")
+	}
+}
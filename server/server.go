@@ -9,19 +9,20 @@ package main
 
 import (
     "sync"
+    "context"
     "os"
     "strings"
     "sync/atomic"
     "net/url"
-    "math/rand"
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"bytes"
 	"time"
-	"port-knocking-ipc/utils/combinations"
 	"port-knocking-ipc/utils"
+	"port-knocking-ipc/utils/lifecycle"
+	"port-knocking-ipc/utils/process"
+	"port-knocking-ipc/utils/timeheap"
 )
 
 // Golang's map does not support a key to be a "slice". A key can be olnly fixed size array, string or a structure
@@ -30,14 +31,14 @@ import (
 // The idea (my speculation) is that the authors intended to force hashtable keys to be an integer or a string, enforce
 // specific designs 
 // The goog news are that uint64 and uint32 keys use a bypass - very fast hashing https://github.com/golang/go/issues/13271
-// I implement two functions which convert between the ports tuples and uint64. This approach introduces limitations:
+// tupleMapUint64 packs the indexes of the ports in a tuple into uint64, see tuplemap.go. This approach introduces limitations:
 // * Complicates use of multiple port ranges 
 // * Limits size of the ports range
 // * Limts number of ports in the ports tuple
 // Number of possible combinations for 8 ports tuple from a range of 128 ports https://www.wolframalpha.com/input/?i=128+choose+8
+// Configurations which do not fit the uint64 use a slower string key, see tuplemap.go
 
 const maxPortRangeSizeBits uint64 = 8 // bits 
-const maxPortMask uint64 = ((1 << maxPortRangeSizeBits)-1) 
 const maxPortRangeSize uint64 = (1 << maxPortRangeSizeBits)  // ports in a range
 const maxTupleSize uint64 = 64/maxPortRangeSizeBits // ports in a tuple   
 
@@ -47,76 +48,170 @@ type sessionState struct {
 	id sessionID
 	expirationTime time.Time
 	tuples [][]int
+	// Opaque token of the session status, see confirm.go
+	token string
+	// Handed out to the service once, nil if there is no payload, see payload.go
+	payload []byte
 }
 
+// The reports and the logs never show the token
+func (s sessionState) String() string {
+	return fmt.Sprintf("{%d %v %v}", s.id, s.expirationTime, s.tuples)
+}
+
+// Counters which the server exposes via /statistics
+// All counters are updated under mapMutex
+type statistics struct {
+	SessionsAllocated uint64
+	SessionsRemoved   uint64
+	SessionsExpired   uint64
+	TuplesExpired     uint64
+	ExpiredLookups    uint64
+	// Tuples skipped because the service advertised failed ports, see hosts.go
+	TuplesSkipped     uint64
+	PayloadsDelivered uint64
+	// The service is not enrolled, see enroll.go
+	PayloadsWithheld  uint64
+	// Bad signature, stale timestamp or replayed nonce, see signature.go
+	ReportsRejected   uint64
+}
 
 type configuration struct {
 	portsBase        int
+	// Optional "frame start" port, zero if disabled
+	framePort        int
 	portsRange      []int
 	portsRangeSize  int
 	tolerance       int
-	generator       combinations.State
+	allocator       tupleAllocator
 	tuples          int
 	tupleSize       int
 	lastSessionID   sessionID
 	mapSessions     map[sessionID]sessionState        
-	mapTuples       map[keyID]sessionID
-	// No generics in the Golang? RME. If I want a thread safe map 
-	// 'class' I have to duplicate the code for every map
-	// I will use a single mutex which rules them all 
+	mapTuples       tupleMap
+	// Session IDs by expiration time, see reaper.go
+	expirations     timeheap.Heap[sessionID]
+	statistics      statistics
+	// A single mutex protects mapSessions, mapTuples, expirations and statistics
 	mapMutex        sync.Mutex
+	// Ports advertised by the services, see hosts.go
+	hosts           map[string]hostPorts
+	hostsMutex      sync.Mutex
+	// Statuses of the sessions by token, see confirm.go
+	confirmations      map[string]*confirmation
+	confirmationExpirations timeheap.Heap[string]
+	confirmationsMutex sync.Mutex
+	// Enrolled services, see enroll.go
+	enrollments        *enrollmentStore
+	// Accept the reports without a signature, see signature.go
+	unsignedReports    bool
+	nonces             map[string]time.Time
+	noncesMutex        sync.Mutex
+	// Closed when the server shuts down, the long polls and the streams return
+	// Shutdown() of the HTTP server does not cancel the requests
+	done               <-chan struct{}
 }
 
 // Setup the server configuration accrding to the command line options
-func createConfiguration() *configuration   {
+func createConfiguration() (*configuration, error)   {
 	portsBase := flag.Int("port_base", 21380, "Base port number")
 	portsRangeSize := flag.Int("port_range", 10, "Size of the ports range")
+	portsRanges := flag.String("ports", "", "Ports ranges, for example 21380-21389,31000-31015. Overrides port_base and port_range")
 	tolerance := flag.Int("tolerance", 20, "Percent of tolerance for port bind failures")
+	framePort := flag.Int("frame_port", 0, "Frame start port, never allocated in the tuples, 0 to disable")
+	enrollmentsPath := flag.String("enrollments", defaultEnrollmentsPath(), "File of the enrolled services, empty to keep the enrollments in memory")
+	enrollmentToken := flag.String("enrollment_token", "", "Token which the services present to enroll, empty to disable the enrollment")
+	unsignedReports := flag.Bool("unsigned_reports", false, "Accept the reports which the service did not sign, the payloads are withheld")
+	requireSigned := flag.Bool("require_signed_reports", false, "Refuse to start if no service can sign the reports: no enrollment token and no enrolled services")
 	flag.Parse()
+	portsRange, err := utils.MakePortsRange(*portsRanges, *portsBase, *portsRangeSize)
+	if err != nil {
+		return nil, err
+	}
+	enrollments, err := createEnrollmentStore(*enrollmentsPath, *enrollmentToken)
+	if err != nil {
+		return nil, err
+	}
+	acceptUnsigned, err := checkReportsAccepted(enrollments, *unsignedReports, *requireSigned)
+	if err != nil {
+		return nil, err
+	}
 	c := configuration{
-		portsBase : *portsBase,
-		portsRangeSize : *portsRangeSize,
+		portsRange : portsRange,
+		framePort : *framePort,
 		tolerance : *tolerance,
 		lastSessionID : sessionID(0),
 		mapSessions : make(map[sessionID]sessionState),        
-		mapTuples : make(map[keyID]sessionID),
+		enrollments : enrollments,
+		unsignedReports : acceptUnsigned,
 	}
-	result := &c
-	result.initCombinationsGenerator()
-	
-	return result
+	return c.initCombinationsGenerator()
 }
 
-// Initialize the generation for port combinations 
-func (c *configuration) initCombinationsGenerator() *configuration {
-	c.portsRange  = utils.MakeRange(c.portsBase, c.portsRangeSize)
+// Initialize the generation for port combinations and the map of tuples
+// Fail if the tuples can not be represented by a map key
+// If the ports range is not set I use the contiguous range portsBase..portsBase+portsRangeSize
+// Tuples can span sub-ranges of the ports range
+// The frame start port is removed from the ports range 
+func (c *configuration) initCombinationsGenerator() (*configuration, error) {
+	if len(c.portsRange) == 0 {
+		c.portsRange  = utils.MakeRange(c.portsBase, c.portsRangeSize)
+	}
+	if c.framePort != 0 {
+		if c.framePort < 0 || c.framePort >= 0xFFFF {
+			return nil, fmt.Errorf("Bad frame start port %d", c.framePort)
+		}
+		c.portsRange = utils.ExcludePort(c.portsRange, c.framePort)
+	}
+	if len(c.portsRange) == 0 {
+		return nil, fmt.Errorf("Ports range is empty")
+	}
+	c.portsBase = c.portsRange[0]
+	c.portsRangeSize = len(c.portsRange)
 	c.tupleSize = utils.GetTupleSize(c.portsRangeSize)
 	c.tuples = utils.GetTuplesCount(c.tolerance, c.tupleSize)	
-	c.generator = combinations.Init(c.portsRange, c.tupleSize)
+	mapTuples, err := createTupleMap(c.portsRange, c.tupleSize)
+	if err != nil {
+		return nil, err
+	}
+	c.mapTuples = mapTuples
+	allocator, err := createPermutationAllocator(c.portsRange, c.tupleSize)
+	if err != nil {
+		return nil, err
+	}
+	c.allocator = allocator
 	
-	return c
+	return c, nil
 }
 
 // Get next set of port combinations
-// Randomly skip combinations with the specified probabilty. I do the skipping part
-// to thwart replay attacks. The idea is that the server will only rarely repeat  
-// allocated combinations. TODO More thinking is required here
-func getPortsCombinations(generator *combinations.State, count int, skipProbability int) ([][]int) {
-	tuples := make([][]int, 0)
-	for count > 0 {
-		toSkip := (skipProbability > 0) && (rand.Intn(100) < skipProbability)
-		if !toSkip {
-			// I have to clone the slice generator.Next() returns the same reference
-			tuple := generator.NextWrap()
-			tuples = append(tuples, tuple)
-			count--
-		}
+// The server uses permutationAllocator which returns the combinations in 
+// an unpredictable order and does not repeat a combination until all combinations 
+// are allocated. See allocator.go
+func getPortsCombinations(allocator tupleAllocator, count int) ([][]int) {
+	tuples := make([][]int, 0, count)
+	for ;count > 0;count-- {
+		tuple := allocator.NextWrap()
+		tuples = append(tuples, tuple)
 	}
 	return tuples
 }
 
 // Generate text containing the ports to knock
 // Every line is a list of ports separated by a comma
+// If frame start mode is enabled the first line is "frame_start=PORT"  
+func framePortToText(framePort int) string {
+	if framePort == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s%d\n", utils.FrameStartPrefix, framePort)
+}
+
+// The line "token=TOKEN" allows the client to poll /session/TOKEN/status
+func tokenToText(token string) string {
+	return fmt.Sprintf("%s%s\n", utils.SessionTokenPrefix, token)
+}
+
 func tuplesToText(tuples [][]int) string {
 	var text bytes.Buffer 
 	for i := 0;i < len(tuples);i++ {
@@ -127,36 +222,6 @@ func tuplesToText(tuples [][]int) string {
 	return text.String()
 }
 
-// Normalize the ports in the ports tuple by substracting the minimal port number (base)
-// mask the ports numner by  
-// tuple[0] goes to the MSB
-func tupleToKey(base uint64, tuple []int) keyID {
-	var key uint64
-	for  index := uint64(0);index < uint64(len(tuple));index++ {
-		if index >= maxTupleSize {
-			break
-		}
-		port := uint64(tuple[index]) 
-		port = port - base
-		port = port & maxPortMask
-		key = key << maxPortRangeSizeBits 
-		key = key | port
-	}
-	return keyID(key)	
-}
-
-// Reverse of tupleToKey 
-func keyToTuple(base uint64, key keyID) (tuple []int) {
-	for i := uint64(0);i < maxTupleSize;i++ {
-		port := uint64(key) & (maxPortMask << (64-maxPortRangeSizeBits))
-		port = port >> (64-maxPortRangeSizeBits)
-		port += base
-		tuple = append(tuple, int(port))
-		key = key << maxPortRangeSizeBits
-	}
-	return tuple	
-}
-
 func getExpirationTime() time.Time {
 	const sessionTimeout = time.Duration(10) //s
 	expirationTime := time.Now().UTC().Add(time.Second*sessionTimeout)
@@ -164,15 +229,19 @@ func getExpirationTime() time.Time {
 }
 
 // Add the session to the map of sessions, all tuples to the map of tuples
-func (c *configuration) addSession(id sessionID, tuples [][]int) {
+func (c *configuration) addSession(id sessionID, tuples [][]int, payload []byte) sessionState {
 	c.mapMutex.Lock()
 	defer c.mapMutex.Unlock()
-	c.mapSessions[id] = sessionState{id, getExpirationTime(), tuples}
-	base := uint64(c.portsBase)
+	expirationTime := getExpirationTime()
+	session := sessionState{id, expirationTime, tuples, createToken(), payload}
+	c.mapSessions[id] = session
+	c.addConfirmation(session.token, expirationTime)
+	c.expirations.Push(expirationTime, id)
+	c.statistics.SessionsAllocated++
 	for _, tuple := range tuples {
-		key := tupleToKey(base, tuple)
-		c.mapTuples[key] = id
+		c.mapTuples.set(tuple, id)
 	}
+	return session
 }
 
 func (c *configuration) removeSession(id sessionID) (tuples, tuplesRemoved [][]int, ok bool) {
@@ -182,19 +251,27 @@ func (c *configuration) removeSession(id sessionID) (tuples, tuplesRemoved [][]i
 	if !ok {
 		return nil, nil, false
 	}
+	tuples, tuplesRemoved = c.removeSessionLocked(sessionState)
+	c.statistics.SessionsRemoved++
+	return tuples, tuplesRemoved, true
+}
+
+// Remove the session and the session's tuples from the maps
+// The generator wraps around and a tuple can be reallocated to a newer session.  
+// I do not remove tuples which belong to another session
+// The caller holds the mapMutex
+func (c *configuration) removeSessionLocked(sessionState sessionState) (tuples, tuplesRemoved [][]int) {
 	tuples = sessionState.tuples
 	tuplesRemoved = [][]int{}
-	base := uint64(c.portsBase)
 	for _, tuple := range tuples {
-		key := tupleToKey(base, tuple)
-		_, ok = c.mapTuples[key]
-		if ok {
-			delete(c.mapTuples, key)
+		id, ok := c.mapTuples.get(tuple)
+		if ok && id == sessionState.id {
+			c.mapTuples.remove(tuple)
 			tuplesRemoved = append(tuplesRemoved, tuple)
 		}
 	}
-	delete(c.mapSessions, id)
-	return tuples, tuplesRemoved, true
+	delete(c.mapSessions, sessionState.id)
+	return tuples, tuplesRemoved
 }
 
 func parseURLQuerySessionPorts(portsStr []string, tupleSize int) ([][]int, bool) {
@@ -226,30 +303,41 @@ func parseURLQuerySessionPorts(portsStr []string, tupleSize int) ([][]int, bool)
 	return ports, true
 }
 
-func parseURLQuerySessionPid(pidStr []string) (int, bool) {
-	if len(pidStr) != 1 {
-		return 0, false 
+// The service sends all candidate sets of tuples separated by semicolons 
+// "0,1,0,2,;0,1,1,2,"
+func parseURLQuerySessionCandidates(portsStr []string, tupleSize int) ([][][]int, bool) {
+	if len(portsStr) != 1 {
+		return nil, false
 	}
-	pid,  ok := utils.AtoPID(pidStr[0])
-	if !ok {
-		return 0, false 		
+	candidates := [][][]int{}
+	for _, candidateStr := range strings.Split(portsStr[0], ";") {
+		tuples, ok := parseURLQuerySessionPorts([]string{candidateStr}, tupleSize)
+		if !ok {
+			return nil, false
+		}
+		candidates = append(candidates, tuples)
 	}
-	return pid, true
+	return candidates, true
 }
 
 // Look for all tuples in the map, collect session IDs
 // Number of sessions can be any positive number, can be zero.
 // The tuples can match more than one session if, for example, the client 
 // has failed to bind all ports  
+// I ignore sessions which expired, but were not removed by the reaper yet
 func (c *configuration) findSessions(tuples [][]int) []sessionState {
 	sessions := []sessionState{}
+	now := time.Now().UTC()
 	c.mapMutex.Lock()
 	defer c.mapMutex.Unlock()
 	for _, tuple := range tuples {
-		key := tupleToKey(uint64(c.portsBase), tuple)
-		sessionID, ok := c.mapTuples[key]
+		sessionID, ok := c.mapTuples.get(tuple)
 		if ok {
 			session, ok := c.mapSessions[sessionID]
+			if ok && !session.expirationTime.After(now) {
+				c.statistics.ExpiredLookups++
+				continue
+			}
 			if ok {
 				if len(sessions) > 0 {
 					if sessions[0].id != sessionID {
@@ -264,82 +352,287 @@ func (c *configuration) findSessions(tuples [][]int) []sessionState {
 	return sessions
 }
 
-// Handle URL query /session?ports=...&pid=...
-func (c *configuration) httpHandlerSession(response http.ResponseWriter, query url.Values) {
+// Returns the session if all tuples belong to the same session
+func (c *configuration) findSessionAllTuples(tuples [][]int) (sessionState, bool) {
+	sessions := c.findSessions(tuples)
+	if len(sessions) != 1 {
+		return sessionState{}, false
+	}
+	c.mapMutex.Lock()
+	defer c.mapMutex.Unlock()
+	for _, tuple := range tuples {
+		id, ok := c.mapTuples.get(tuple)
+		if !ok || id != sessions[0].id {
+			return sessionState{}, false
+		}
+	}
+	return sessions[0], true
+}
+
+// Look for sessions matching the candidate sets of tuples
+// A candidate matches a session if all tuples of the candidate belong to the session. If
+// no candidate matches I collect all sessions the candidates' tuples belong to
+// Returns the sessions and the tuples of the (first) matching candidate
+func (c *configuration) findSessionsCandidates(candidates [][][]int) ([]sessionState, [][]int) {
+	sessions := []sessionState{}
+	var matchingTuples [][]int
+	for _, tuples := range candidates {
+		session, ok := c.findSessionAllTuples(tuples)
+		if !ok {
+			continue
+		}
+		if matchingTuples == nil {
+			matchingTuples = tuples
+		}
+		sessions = appendSession(sessions, session)
+	}
+	if len(sessions) > 0 {
+		return sessions, matchingTuples
+	}
+	allTuples := [][]int{}
+	for _, tuples := range candidates {
+		for _, session := range c.findSessions(tuples) {
+			sessions = appendSession(sessions, session)
+		}
+		allTuples = append(allTuples, tuples...)
+	}
+	return sessions, allTuples
+}
+
+// Returns true if a tuple of the candidates belongs to an expired session
+// which the reaper did not remove yet
+func (c *configuration) findExpiredSession(candidates [][][]int) bool {
+	now := time.Now().UTC()
+	c.mapMutex.Lock()
+	defer c.mapMutex.Unlock()
+	for _, tuples := range candidates {
+		for _, tuple := range tuples {
+			id, ok := c.mapTuples.get(tuple)
+			if !ok {
+				continue
+			}
+			session, ok := c.mapSessions[id]
+			if ok && !session.expirationTime.After(now) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Add the session to the slice if the slice does not contain the session 
+func appendSession(sessions []sessionState, session sessionState) []sessionState {
+	for _, s := range sessions {
+		if s.id == session.id {
+			return sessions
+		}
+	}
+	return append(sessions, session)
+}
+
+// Handle URL query /session?ports=...&pid=...&ppid=...&uid=...&gid=...&user=...&exe=...&start=...&arg=...&pids=...&service=...
+func (c *configuration) reportSession(query url.Values) (sessionReport, int) {
 	portsStr, ok := query["ports"]
 	if !ok {
-		fmt.Fprintf(response, "No parameter 'ports'")
-		return
+		return newSessionReport(statusMalformed, "No parameter 'ports'"), http.StatusBadRequest
 	}
-	pidStr, ok := query["pid"]
+	_, ok = query["pid"]
 	if !ok {
-		fmt.Fprintf(response, "No parameter 'pid'")
-		return
+		return newSessionReport(statusMalformed, "No parameter 'pid'"), http.StatusBadRequest
 	}
-	tuples, ok := parseURLQuerySessionPorts(portsStr, c.tupleSize)
+	candidates, ok := parseURLQuerySessionCandidates(portsStr, c.tupleSize)
 	if !ok {
-		fmt.Fprintf(response, "Failed to parse '%s'", tuples)
-		return
+		return newSessionReport(statusMalformed, fmt.Sprintf("Failed to parse '%v'", portsStr)), http.StatusBadRequest
 	}
-	pid, ok := parseURLQuerySessionPid(pidStr)
+	// The service reports the root of the process group and the contributing PIDs
+	identity, ok := process.DecodeGroup(query)
 	if !ok {
-		fmt.Fprintf(response, "Failed to parse '%s'", pidStr)
-		return
+		return newSessionReport(statusMalformed, fmt.Sprintf("Failed to parse process identity '%v'", query)), http.StatusBadRequest
 	}
-	sessions := c.findSessions(tuples)
+	pid := identity.Root.PID
+	// I verify the signature before I look for the sessions, a forged report changes nothing
+	serviceID, err := c.verifyReport(query, time.Now().UTC())
+	if err != nil {
+		c.mapMutex.Lock()
+		c.statistics.ReportsRejected++
+		c.mapMutex.Unlock()
+		return newSessionReport(statusUnauthorized, err.Error()), http.StatusUnauthorized
+	}
+	sessions, tuples := c.findSessionsCandidates(candidates)
 	if len(sessions) == 0 {
-		fmt.Fprintf(response, "No session is found for %v, pid %d", tuples, pid)
-		return
+		if c.findExpiredSession(candidates) {
+			report := newSessionReport(statusExpired, fmt.Sprintf("Session expired for %v, %v", tuples, identity))
+			return report, http.StatusGone
+		}
+		report := newSessionReport(statusNotFound, fmt.Sprintf("No session is found for %v, %v", tuples, identity))
+		return report, http.StatusNotFound
 	}
 	if len(sessions) > 1 {
-		fmt.Fprintf(response, "Found %v (%d) sessions for tuples %v, pid %d", sessions, len(sessions), tuples, pid)
-		return
+		for _, session := range sessions {
+			// The tokens can belong to other users, I do not reveal the process, see confirm.go
+			c.publishEvent(session.token, statusAmbiguous, nil)
+		}
+		report := newSessionReport(statusAmbiguous, fmt.Sprintf("Found %v (%d) sessions for tuples %v, %v", sessions, len(sessions), tuples, identity))
+		for _, session := range sessions {
+			report.Sessions = append(report.Sessions, uint32(session.id))
+		}
+		return report, http.StatusConflict
 	}
 	session := sessions[0]
 	tuples, tuplesRemoved, ok := c.removeSession(session.id)
 	if !ok {
-		fmt.Fprintf(response, "Failed to remove sesion %v for %v, pid %d", session, tuples, pid)
-		return
+		// Another report removed the session
+		report := newSessionReport(statusNotFound, fmt.Sprintf("Failed to remove sesion %v for %v, %v", session, tuples, identity))
+		return report, http.StatusNotFound
+	}
+	// I removed the session, nobody else gets the payload
+	report := newSessionReport(statusMatched, "")
+	report.Sessions = []uint32{uint32(session.id)}
+	report.Tuples = tuples
+	payloadMessage := ""
+	if session.payload != nil {
+		payloadMessage = c.sealPayload(&report, session, serviceID)
 	}
+	c.publishEvent(session.token, statusMatched, toEventIdentity(identity.Root))
 	if len(tuples) != len(tuplesRemoved) {
-		fmt.Fprintf(response, "Failed to remove all tuples for %v, tuples=%v, removed=%v, pid=%d", session, tuples, tuplesRemoved, pid)
-		return
+		report.Message = fmt.Sprintf("Failed to remove all tuples for %v, tuples=%v, removed=%v, %v\n", session, tuples, tuplesRemoved, identity)
+		report.Message += payloadMessage
+		return report, http.StatusOK
 	}
-	pidFilename := utils.GetPidFilename(pid)
+	pidFilename := utils.GetPidFilename(identity.Root.RealUID, pid)
+	report.PidFile = pidFilename
 	if err := os.Remove(pidFilename); err != nil {
-		fmt.Fprintf(response, "Failed to remove file %s %s\n", pidFilename, err)		
+		report.Message = fmt.Sprintf("Failed to remove file %s %s\n", pidFilename, err)
 	} else {
-		fmt.Fprintf(response, "File %s removed\n", pidFilename)				
+		report.PidFileRemoved = true
+		report.Message = fmt.Sprintf("File %s removed\n", pidFilename)
+	}
+	report.Message += fmt.Sprintf("Removed tuples for session %v, %v\n", session, identity)
+	report.Message += payloadMessage
+	return report, http.StatusOK
+}
+
+// The service gets JSON or text, the HTTP status code is the same, see api.go
+func (c *configuration) httpHandlerSession(response http.ResponseWriter, query url.Values, asJSON bool) {
+	report, code := c.reportSession(query)
+	if asJSON {
+		writeJSON(response, code, report)
+		return
 	}
-	fmt.Fprintf(response, "Removed tuples for session %v, pid %d\n", session, pid)
+	response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	response.WriteHeader(code)
+	fmt.Fprint(response, report.Message)
 }
 
-// Allocate combinations of ports (ports tuples), generate response text, update the sessions map 
-func (c *configuration) httpHandlerRoot(response http.ResponseWriter, query url.Values) {
-	tuples := getPortsCombinations(&c.generator, c.tuples, 2)
-	id := atomic.AddUint32((*uint32)(&c.lastSessionID), 1)
-	c.addSession(sessionID(id), tuples) 
-	text := tuplesToText(tuples)
+// Allocate combinations of ports (ports tuples), update the sessions map 
+// I avoid the ports which the service on the host failed to bind
+func (c *configuration) allocateSession(host string, payload []byte) sessionState {
+	tuples, skipped := getPortsCombinationsAvoiding(c.allocator, c.tuples, c.getFailedPorts(host))
+	id := sessionID(atomic.AddUint32((*uint32)(&c.lastSessionID), 1))
+	session := c.addSession(id, tuples, payload) 
+	if skipped != 0 {
+		c.mapMutex.Lock()
+		c.statistics.TuplesSkipped += uint64(skipped)
+		c.mapMutex.Unlock()
+	}
+	return session
+}
+
+// Allocate a session, generate response text
+// POST binds the payload in the body to the session, see payload.go
+func (c *configuration) httpHandlerRoot(response http.ResponseWriter, request *http.Request, host string, asJSON bool, asXML bool) {
+	payload, err := readPayload(request)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	session := c.allocateSession(host, payload)
+	if asJSON {
+		writeJSON(response, http.StatusOK, c.allocationToJSON(session))
+		return
+	}
+	if asXML {
+		writeXML(response, http.StatusOK, c.allocationToXML(session))
+		return
+	}
+	text := framePortToText(c.framePort) + tokenToText(session.token) + tuplesToText(session.tuples)
 	fmt.Fprintf(response, text)
 }
 
+// Print the server counters 
+func (c *configuration) httpHandlerStatistics(response http.ResponseWriter, query url.Values) {
+	c.mapMutex.Lock()
+	statistics := c.statistics
+	sessions := len(c.mapSessions)
+	tuples := c.mapTuples.size()
+	c.mapMutex.Unlock()
+	fmt.Fprintf(response, "Sessions %d, tuples %d", sessions, tuples)
+	fmt.Fprintf(response, "%s\n", utils.StatisticsPrintf(statistics, 1, ""))
+}
+
 // HTTP server hook
 func (c *configuration) httpHandler(response http.ResponseWriter, request *http.Request) {
-	path := request.URL.Path[1:]
+	path, asJSON := negotiateJSON(request)
 	query := request.URL.Query()
+	host := remoteHost(request)
 	if path == "session" {
-		c.httpHandlerSession(response, query)
+		c.httpHandlerSession(response, query, asJSON)
+	} else if token, ok := parseStatusPath(path); ok {
+		c.httpHandlerSessionStatus(response, request, token, asJSON)
+	} else if path == "enroll" {
+		c.httpHandlerEnroll(response, request)
+	} else if path == "ports" {
+		c.httpHandlerPorts(response, query, host)
+	} else if path == "statistics" {
+		c.httpHandlerStatistics(response, query)
+	} else if path == "knock.js" {
+		c.httpHandlerScript(response, query, host)
+	} else if asJSON {
+		c.httpHandlerRoot(response, request, host, true, false)
+	} else if path == "knock.html" || strings.Contains(request.Header.Get("Accept"), "text/html") {
+		// Browsers get the page, the Go client gets the text
+		c.httpHandlerPage(response, query, host)
 	} else {
-		c.httpHandlerRoot(response, query)
+		// Integrators get XML
+		c.httpHandlerRoot(response, request, host, false, acceptsXML(request))
 	}
 }
 
 func main() {
 	utils.InitRand()
-	flag.Parse()
-	var c = createConfiguration() 
+	revoke := flag.String("revoke", "", "Revoke the enrolled service with this ID, exit")
+	c, err := createConfiguration() 
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// The running server reloads the enrollments, see reaper.go
+	if *revoke != "" {
+		if err := c.enrollments.revoke(*revoke); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Revoked service", *revoke)
+		return
+	}
+	// SIGTERM stops the server, the in-flight requests complete 
+	life := lifecycle.New(time.Duration(10) * time.Second)
+	life.HandleSignals()
+	c.done = life.Context().Done()
+	// Start a background thread to remove expired sessions
+	go c.reaper(life.Context(), time.Duration(1) * time.Second)
 	http.HandleFunc("/", c.httpHandler)
 	port := ":8080"
-	fmt.Println("Listening on", port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	server := &http.Server{Addr: port}
+	life.OnShutdown("http", func(ctx context.Context) error {
+		return server.Shutdown(ctx)
+	})
+	go func() {
+		fmt.Println("Listening on", port)
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			life.Stop(err)
+		}
+	}()
+	life.Exit()
 }
@@ -0,0 +1,102 @@
+// Verification of the signed /session reports
+// The enrolled service signs the report with the key derived from the secret of
+// the service, see utils/signature and enroll.go
+//     /session?ports=...&pid=...&service=ID&ts=UNIX_TIME&nonce=RANDOM&key=KEY_ID&sig=HMAC
+// I reject the report if
+//     the service is not enrolled or revoked, the key ID is not an active key of the service
+//     the signature does not match
+//     the timestamp is older or newer than maxReportSkew
+//     I have seen the nonce of the service
+// The statuses of the rejected reports are "unauthorized" 401. I reject the unsigned
+// reports unless -unsigned_reports is set. The payloads of the unsigned reports
+// are withheld
+// I keep the nonces for 2*maxReportSkew, an older report is stale anyway. The reaper
+// removes the expired nonces. Only the reports with a valid signature add a nonce
+// Nobody can sign the reports if the server has no enrollment token and no enrolled 
+// services. Such server warns and accepts the unsigned reports, the way the server
+// worked before the signatures. -require_signed_reports refuses to start instead
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+	"port-knocking-ipc/utils/signature"
+)
+
+const maxReportSkew = time.Duration(60) * time.Second
+
+// Returns true if I accept the unsigned reports
+// Returns an error if the signatures are required, but nobody can sign the reports
+func checkReportsAccepted(enrollments *enrollmentStore, unsignedReports bool, requireSigned bool) (bool, error) {
+	if unsignedReports && requireSigned {
+		return false, fmt.Errorf("-unsigned_reports and -require_signed_reports are mutually exclusive")
+	}
+	if unsignedReports {
+		return true, nil
+	}
+	if enrollments.token != "" || enrollments.active() != 0 {
+		return false, nil
+	}
+	if requireSigned {
+		return false, fmt.Errorf("No enrollment token and no enrolled services, the server would reject all reports. Set -enrollment_token")
+	}
+	fmt.Println("Warning: no enrollment token and no enrolled services, accepting the unsigned reports. Set -enrollment_token to enroll the services")
+	return true, nil
+}
+
+// Returns the ID of the service which signed the report, empty if the report is
+// not signed and I accept the unsigned reports
+func (c *configuration) verifyReport(query url.Values, now time.Time) (string, error) {
+	if !signature.Signed(query) {
+		if !c.unsignedReports {
+			return "", fmt.Errorf("Report is not signed")
+		}
+		return "", nil
+	}
+	serviceID := query.Get("service")
+	if c.enrollments == nil || serviceID == "" {
+		return "", fmt.Errorf("Report is signed by unknown service '%s'", serviceID)
+	}
+	key, ok := c.enrollments.reportKey(serviceID, query.Get(signature.KeyParam), now)
+	if !ok {
+		return "", fmt.Errorf("Report is signed by unknown key '%s' of service '%s'", query.Get(signature.KeyParam), serviceID)
+	}
+	if _, err := signature.Verify(query, key, now, maxReportSkew); err != nil {
+		return "", fmt.Errorf("Report of service '%s': %v", serviceID, err)
+	}
+	if !c.addNonce(serviceID + "/" + query.Get(signature.NonceParam), now.Add(2*maxReportSkew)) {
+		return "", fmt.Errorf("Report of service '%s' replays nonce %s", serviceID, query.Get(signature.NonceParam))
+	}
+	return serviceID, nil
+}
+
+// Returns false if I have seen the nonce
+func (c *configuration) addNonce(nonce string, expirationTime time.Time) bool {
+	c.noncesMutex.Lock()
+	defer c.noncesMutex.Unlock()
+	if c.nonces == nil {
+		c.nonces = make(map[string]time.Time)
+	}
+	if _, ok := c.nonces[nonce]; ok {
+		return false
+	}
+	c.nonces[nonce] = expirationTime
+	return true
+}
+
+// Remove the nonces which expired by 'now', returns number of removed nonces
+// The map is small: only the enrolled services add nonces
+func (c *configuration) expireNonces(now time.Time) int {
+	c.noncesMutex.Lock()
+	defer c.noncesMutex.Unlock()
+	removed := 0
+	for nonce, expirationTime := range c.nonces {
+		if !expirationTime.After(now) {
+			delete(c.nonces, nonce)
+			removed++
+		}
+	}
+	return removed
+}
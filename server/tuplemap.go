@@ -0,0 +1,202 @@
+// Map of ports tuples to session IDs
+// The ports range can be a union of disjoint ranges, for example 21380-21389,31000-31015
+// I replace every port by the port's index in the sorted ports range. The fast path 
+// packs the indexes into uint64, maxPortRangeSizeBits bits per index. The packing works 
+// for ranges up to maxPortRangeSize ports and tuples up to maxTupleSize ports.
+// For larger configurations I fall back to a string key: one or two bytes per 
+// index depending on the size of the range. The string key does not collide for 
+// any range which fits 16 bits
+// Lookups of tuples containing ports outside of the range or tuples of wrong size 
+// fail instead of being masked into a (wrong) key
+
+package main
+
+import (
+	"fmt"
+)
+
+type tupleMap interface {
+	get(tuple []int) (sessionID, bool)
+	set(tuple []int, id sessionID) bool
+	remove(tuple []int)
+	size() int
+}
+
+// Maps a port to the index of the port in the ports range
+// I use a slice instead of a map for the fast lookup. The slice covers ports
+// from the first to the last port in the range. Holes between the sub-ranges are -1  
+type portsIndex struct {
+	firstPort int
+	indexes   []int32
+}
+
+type tupleMapUint64 struct {
+	ports     portsIndex
+	tupleSize int
+	m         map[keyID]sessionID
+}
+
+type tupleMapString struct {
+	ports        portsIndex
+	tupleSize    int
+	bytesPerPort int
+	m            map[string]sessionID
+}
+
+// The ports shall be sorted
+func createPortsIndex(ports []int) portsIndex {
+	firstPort, lastPort := ports[0], ports[len(ports)-1]
+	indexes := make([]int32, lastPort-firstPort+1)
+	for i := range indexes {
+		indexes[i] = -1
+	}
+	for i, port := range ports {
+		indexes[port-firstPort] = int32(i)
+	}
+	return portsIndex{firstPort, indexes}
+}
+
+func (p *portsIndex) index(port int) (uint64, bool) {
+	offset := port - p.firstPort
+	if offset < 0 || offset >= len(p.indexes) {
+		return 0, false
+	}
+	index := p.indexes[offset]
+	if index < 0 {
+		return 0, false
+	}
+	return uint64(index), true
+}
+
+// Returns an error if no encoding can represent the configuration 
+func validateTupleConfiguration(ports []int, tupleSize int) error {
+	if len(ports) == 0 {
+		return fmt.Errorf("Ports range is empty")
+	}
+	for i, port := range ports {
+		if port < 0 || port >= 0xFFFF {
+			return fmt.Errorf("Port %d is out of the TCP ports range", port)
+		}
+		if i > 0 && port <= ports[i-1] {
+			return fmt.Errorf("Ports range %v is not sorted", ports)
+		}
+	}
+	if tupleSize <= 0 || tupleSize > len(ports) {
+		return fmt.Errorf("Tuple size %d does not fit ports range size %d", tupleSize, len(ports))
+	}
+	return nil
+}
+
+// Returns true if a uint64 key can represent all tuples in the configuration
+func fitsUint64Key(portsRangeSize, tupleSize int) bool {
+	return (uint64(portsRangeSize) <= maxPortRangeSize) && (uint64(tupleSize) <= maxTupleSize)
+}
+
+// Create a map for the specified configuration, use the fastest encoding
+// which can represent the configuration 
+func createTupleMap(ports []int, tupleSize int) (tupleMap, error) {
+	if err := validateTupleConfiguration(ports, tupleSize); err != nil {
+		return nil, err
+	}
+	index := createPortsIndex(ports)
+	if fitsUint64Key(len(ports), tupleSize) {
+		return &tupleMapUint64{index, tupleSize, make(map[keyID]sessionID)}, nil
+	}
+	bytesPerPort := 1
+	if len(ports) > 0x100 {
+		bytesPerPort = 2
+	}
+	return &tupleMapString{index, tupleSize, bytesPerPort, make(map[string]sessionID)}, nil
+}
+
+// Pack the indexes of the ports, tuple[0] goes to the MSB
+func (m *tupleMapUint64) key(tuple []int) (keyID, bool) {
+	if len(tuple) != m.tupleSize {
+		return 0, false
+	}
+	var key uint64
+	for _, port := range tuple {
+		index, ok := m.ports.index(port)
+		if !ok {
+			return 0, false
+		}
+		key = key << maxPortRangeSizeBits
+		key = key | index
+	}
+	return keyID(key), true
+}
+
+func (m *tupleMapUint64) get(tuple []int) (sessionID, bool) {
+	key, ok := m.key(tuple)
+	if !ok {
+		return 0, false
+	}
+	id, ok := m.m[key]
+	return id, ok
+}
+
+func (m *tupleMapUint64) set(tuple []int, id sessionID) bool {
+	key, ok := m.key(tuple)
+	if ok {
+		m.m[key] = id
+	}
+	return ok
+}
+
+func (m *tupleMapUint64) remove(tuple []int) {
+	key, ok := m.key(tuple)
+	if ok {
+		delete(m.m, key)
+	}
+}
+
+func (m *tupleMapUint64) size() int {
+	return len(m.m)
+}
+
+// Encode the indexes of the ports, the MSB first 
+func (m *tupleMapString) key(tuple []int) (string, bool) {
+	if len(tuple) != m.tupleSize {
+		return "", false
+	}
+	key := make([]byte, 0, len(tuple)*m.bytesPerPort)
+	for _, port := range tuple {
+		index, ok := m.ports.index(port)
+		if !ok {
+			return "", false
+		}
+		if m.bytesPerPort == 2 {
+			key = append(key, byte(index >> 8))
+		}
+		key = append(key, byte(index))
+	}
+	return string(key), true
+}
+
+func (m *tupleMapString) get(tuple []int) (sessionID, bool) {
+	key, ok := m.key(tuple)
+	if !ok {
+		return 0, false
+	}
+	id, ok := m.m[key]
+	return id, ok
+}
+
+func (m *tupleMapString) set(tuple []int, id sessionID) bool {
+	key, ok := m.key(tuple)
+	if ok {
+		m.m[key] = id
+	}
+	return ok
+}
+
+func (m *tupleMapString) remove(tuple []int) {
+	key, ok := m.key(tuple)
+	if ok {
+		delete(m.m, key)
+	}
+}
+
+func (m *tupleMapString) size() int {
+	return len(m.m)
+}
@@ -0,0 +1,52 @@
+// XML format of an allocated session for the integrators, see session.xsd
+// and utils.XMLSession. A client which sends "Accept: application/xml" gets XML
+
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"port-knocking-ipc/utils"
+)
+
+func (c *configuration) allocationToXML(session sessionState) utils.XMLSession {
+	result := utils.XMLSession{
+		Version:   utils.XMLSessionVersion,
+		ID:        uint32(session.id),
+		Token:     session.token,
+		Expires:   session.expirationTime,
+		TupleSize: c.tupleSize,
+		Tuples:    []utils.XMLTuple{},
+	}
+	if c.framePort != 0 {
+		result.FrameStart = strconv.Itoa(c.framePort)
+	}
+	for _, tuple := range session.tuples {
+		ports := []string{}
+		for _, port := range tuple {
+			ports = append(ports, strconv.Itoa(port))
+		}
+		result.Tuples = append(result.Tuples, utils.XMLTuple{Ports: ports})
+	}
+	return result
+}
+
+// Returns true if the client prefers XML: "application/xml" or "text/xml"
+// Browsers send "application/xml" after "text/html", I check HTML first
+func acceptsXML(request *http.Request) bool {
+	accept := request.Header.Get("Accept")
+	return strings.Contains(accept, "application/xml") || strings.Contains(accept, "text/xml")
+}
+
+func writeXML(response http.ResponseWriter, code int, v interface{}) {
+	response.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	response.Header().Set("Cache-Control", "no-store")
+	response.WriteHeader(code)
+	response.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(response)
+	encoder.Indent("", "  ")
+	encoder.Encode(v)
+	response.Write([]byte("\n"))
+}
@@ -0,0 +1,90 @@
+// Daemon behaviour of the service
+// systemd can open the ports and pass the sockets to the service, see the
+// package utils/systemd. This way systemd holds privileged or contested ports
+// The service notifies systemd when it is ready, pings the watchdog and
+// closes the listeners on SIGTERM
+// Example of the socket unit
+//     [Socket]
+//     ListenStream=127.0.0.1:21380
+//     ListenStream=[::1]:21380
+//     ...
+// I accept only the knocks from the loopback, see handleAccept. I refuse to start
+// if systemd passes a socket of the range on another address, for example 
+// ListenStream=0.0.0.0:21380, such socket never gets a knock
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"port-knocking-ipc/utils"
+	"port-knocking-ipc/utils/systemd"
+)
+
+// Use the sockets passed by systemd for the ports in the range
+// I close the sockets for other ports. Returns the listeners and the ports
+// Returns an error and closes all sockets if a socket of the range is not on the loopback
+func adoptListeners(inherited []systemd.Listener, ports []int) ([]net.Listener, []int, error) {
+	for _, l := range inherited {
+		address, ok := l.Listener.Addr().(*net.TCPAddr)
+		if ok && utils.Contains(ports, address.Port) && !address.IP.IsLoopback() {
+			for _, l := range inherited {
+				l.Listener.Close()
+			}
+			return nil, nil, fmt.Errorf("Socket %s %v is not on the loopback, the service accepts only local knocks", l.Name, address)
+		}
+	}
+	listeners := []net.Listener{}
+	adoptedPorts := []int{}
+	for _, l := range inherited {
+		address, ok := l.Listener.Addr().(*net.TCPAddr)
+		if !ok || !utils.Contains(ports, address.Port) {
+			fmt.Printf("Closed socket %s %v, the port is not in the range\n", l.Name, l.Listener.Addr())
+			l.Listener.Close()
+			continue
+		}
+		listeners = append(listeners, l.Listener)
+		if !utils.Contains(adoptedPorts, address.Port) {
+			adoptedPorts = append(adoptedPorts, address.Port)
+		}
+	}
+	sort.Ints(adoptedPorts)
+	if len(adoptedPorts) != 0 {
+		fmt.Println("Got from systemd", adoptedPorts)
+	}
+	return listeners, adoptedPorts, nil
+}
+
+// Use the sockets passed by systemd, bind the rest of the ports
+// Returns an error if systemd passed a socket which is not on the loopback
+func (k *knocks) bindAll(inherited []systemd.Listener, ports, portsToSkip []int) error {
+	listeners, adoptedPorts, err := adoptListeners(inherited, ports)
+	if err != nil {
+		return err
+	}
+	portsToBind := []int{}
+	for _, port := range ports {
+		if !utils.Contains(adoptedPorts, port) {
+			portsToBind = append(portsToBind, port)
+		}
+	}
+	k.bindMutex.Lock()
+	defer k.bindMutex.Unlock()
+	k.listeners, k.boundPorts, k.failedToBind, k.missingAddresses = bindPorts(k.addresses, portsToBind, portsToSkip)
+	k.listeners = append(listeners, k.listeners...)
+	k.boundPorts = append(adoptedPorts, k.boundPorts...)
+	sort.Ints(k.boundPorts)
+	return nil
+}
+
+// Close all listeners, the accept goroutines exit
+func (k *knocks) closeListeners() {
+	k.bindMutex.Lock()
+	defer k.bindMutex.Unlock()
+	k.closed = true
+	for _, listener := range k.listeners {
+		listener.Close()
+	}
+	k.listeners = []net.Listener{}
+}
@@ -0,0 +1,123 @@
+// Grouping of the knocking processes
+// Browsers open sockets from child processes - network service, content processes. 
+// Knocks of one WEB page can arrive from several PIDs. I attribute every knock to a 
+// logical process (group root) and collect the knocks by the root PID
+// * "pid" - every process is a group
+// * "browser" - the outermost ancestor in the chain of processes running a browser 
+//   executable, for example the main Chrome process for a renderer
+// * "pgid" - the process group leader
+// * "sid" - the session leader
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"port-knocking-ipc/utils/process"
+)
+
+type processGrouping interface {
+	// Returns the PID of the root of the group
+	group(pid int) (int, bool)
+}
+
+type pidGrouping struct {
+}
+
+type browserGrouping struct {
+	procRoot    string
+	executables []string
+}
+
+type processGroupGrouping struct {
+	procRoot string
+	session  bool
+}
+
+// Executables of the popular browsers
+const defaultBrowsers = "chrome,chromium,chromium-browser,firefox,firefox-esr,firefox-bin,brave,msedge,opera,vivaldi-bin"
+
+// Stop walking the chain of parents after this many processes 
+const maxProcessDepth = 64
+
+// Create a grouping by name: "pid", "browser", "pgid" or "sid"
+func createProcessGrouping(name string, procRoot string, browsers string) (processGrouping, error) {
+	switch name {
+	case "pid":
+		return &pidGrouping{}, nil
+	case "browser":
+		executables := []string{}
+		for _, browser := range strings.Split(browsers, ",") {
+			if browser = strings.TrimSpace(browser); browser != "" {
+				executables = append(executables, browser)
+			}
+		}
+		return &browserGrouping{procRoot, executables}, nil
+	case "pgid":
+		return &processGroupGrouping{procRoot, false}, nil
+	case "sid":
+		return &processGroupGrouping{procRoot, true}, nil
+	}
+	return nil, fmt.Errorf("Unknown process grouping '%s'", name)
+}
+
+func (g *pidGrouping) group(pid int) (int, bool) {
+	return pid, true
+}
+
+func (g *processGroupGrouping) group(pid int) (int, bool) {
+	stat, err := process.ReadStat(g.procRoot, pid)
+	if err != nil {
+		return 0, false
+	}
+	root := stat.ProcessGroup
+	if g.session {
+		root = stat.Session
+	}
+	// Kernel threads and some daemons have no group
+	if root <= 0 {
+		root = pid
+	}
+	return root, true
+}
+
+// Returns true if the process runs one of the browsers
+// I check the executable and the command name. Some processes, for example Firefox 
+// content processes, change the command name to "Web Content"
+func (g *browserGrouping) isBrowser(pid int, stat process.Stat) bool {
+	names := []string{stat.Command}
+	if executable := process.ReadExecutable(g.procRoot, pid); executable != "" {
+		names = append(names, filepath.Base(executable))
+	}
+	for _, name := range names {
+		for _, browser := range g.executables {
+			if name == browser {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Walk the chain of parents while the parents run a browser. If the process 
+// is not a browser the process is the root
+func (g *browserGrouping) group(pid int) (int, bool) {
+	stat, err := process.ReadStat(g.procRoot, pid)
+	if err != nil {
+		return 0, false
+	}
+	root := pid
+	if !g.isBrowser(pid, stat) {
+		return root, true
+	}
+	for depth := 0;depth < maxProcessDepth && stat.PPID > 1;depth++ {
+		parent, err := process.ReadStat(g.procRoot, stat.PPID)
+		if err != nil || !g.isBrowser(stat.PPID, parent) {
+			break
+		}
+		root = stat.PPID
+		stat = parent
+	}
+	return root, true
+}
@@ -0,0 +1,449 @@
+// Keyring of the service
+// The server hands the session payloads only to the enrolled services and encrypts
+// the payload to the public key of the service, see server/enroll.go and utils/envelope
+// On the first start I generate a X25519 keypair and enroll the public key with the
+// token -enrollment_token. The server responds with the service ID and the secret
+// which authenticates the key rotation. I add the service ID to the reports and sign
+// the reports with the key derived from the secret, see utils/signature
+// Files in -key_dir, the directory is mode 0700, the files are mode 0600
+//     service_id        the service ID
+//     secret            the secret of the service
+//     current           ID of the current key
+//     pending           ID of the key which I sent to the server, but got no response
+//     keys/KEY_ID.key   the private keys, hex
+// -rotate_key rotates the key on start, -key_lifetime rotates the key when the key
+// gets older. I keep the previous key after the rotation: the server could encrypt
+// a payload to the previous key just before the rotation. I remove older keys
+// The rotation replaces the secret too. The server accepts the reports signed
+// with the previous secret for a while
+// If the rotation fails I keep the new key: the server could accept the key and 
+// lose the response. I send the same key again until the server responds
+// I retry the enrollment and the rotation until the server responds
+// The server rejects the unsigned reports. The reports wait while the service has
+// the enrollment token and is not enrolled, unless the server rejects the token
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"port-knocking-ipc/utils/envelope"
+	"port-knocking-ipc/utils/signature"
+)
+
+type keyring struct {
+	dir       string
+	mutex     sync.Mutex
+	// Empty if the service is not enrolled
+	serviceID string
+	secret    string
+	// The service has an enrollment token, the reports wait for the enrollment
+	enrolling bool
+	current   string
+	// Sent to the server, not confirmed yet
+	pending   string
+	keys      map[string]*ecdh.PrivateKey
+}
+
+// Response of POST /enroll, see server/enroll.go
+type enrollResponse struct {
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+	ServiceID string `json:"service_id"`
+	Secret    string `json:"secret"`
+	KeyID     string `json:"key_id"`
+}
+
+// I keep the keys in the user config, for example /root/.config/port-knocking-ipc/service
+func defaultKeyDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "port-knocking-ipc", "service")
+}
+
+// Write a temporary file and rename it, mode 0600
+func writeFileAtomic(filename string, data []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+// Returns the trimmed content of the file, empty if there is no file
+func readKeyringFile(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// Load the keys, generate the first key if there is no key
+// I refuse a directory which other users can read
+func openKeyring(dir string) (*keyring, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "keys"), 0700); err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() || info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("Key directory %s is not a private directory, mode %v", dir, info.Mode())
+	}
+	r := &keyring{dir: dir, keys: make(map[string]*ecdh.PrivateKey)}
+	filenames, err := filepath.Glob(filepath.Join(dir, "keys", "*.key"))
+	if err != nil {
+		return nil, err
+	}
+	for _, filename := range filenames {
+		text, err := readKeyringFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := hex.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse %s: %v", filename, err)
+		}
+		key, err := envelope.ParsePrivateKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse %s: %v", filename, err)
+		}
+		r.keys[envelope.KeyID(key.PublicKey().Bytes())] = key
+	}
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{{"service_id", &r.serviceID}, {"secret", &r.secret}, {"current", &r.current}, {"pending", &r.pending}} {
+		if *field.value, err = readKeyringFile(filepath.Join(dir, field.name)); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := r.keys[r.pending]; !ok {
+		r.pending = ""
+	}
+	if _, ok := r.keys[r.current]; !ok {
+		// A key which the server does not know is useless
+		if r.serviceID != "" {
+			return nil, fmt.Errorf("Current key '%s' of service %s is missing in %s", r.current, r.serviceID, dir)
+		}
+		id, err := r.generateKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := r.setCurrent(id); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Generate and store a new key, the key is not current
+func (r *keyring) generateKey() (string, error) {
+	key, err := envelope.GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	id := envelope.KeyID(key.PublicKey().Bytes())
+	filename := filepath.Join(r.dir, "keys", id + ".key")
+	if err := writeFileAtomic(filename, []byte(hex.EncodeToString(key.Bytes()) + "\n")); err != nil {
+		return "", err
+	}
+	r.mutex.Lock()
+	r.keys[id] = key
+	r.mutex.Unlock()
+	return id, nil
+}
+
+// Make the key current, keep the previous key and the pending key, remove other keys
+func (r *keyring) setCurrent(id string) error {
+	if err := writeFileAtomic(filepath.Join(r.dir, "current"), []byte(id + "\n")); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	previous := r.current
+	r.current = id
+	for keyID := range r.keys {
+		if keyID != id && keyID != previous && keyID != r.pending {
+			r.removeKeyLocked(keyID)
+		}
+	}
+	return nil
+}
+
+// Set the key which I send to the server, empty if the server confirmed the key
+func (r *keyring) setPending(id string) error {
+	filename := filepath.Join(r.dir, "pending")
+	if id == "" {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := writeFileAtomic(filename, []byte(id + "\n")); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.pending = id
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *keyring) removeKeyLocked(id string) {
+	delete(r.keys, id)
+	os.Remove(filepath.Join(r.dir, "keys", id + ".key"))
+}
+
+// Store the service ID and the secret which the server sent
+func (r *keyring) setEnrollment(serviceID string, secret string) error {
+	if err := writeFileAtomic(filepath.Join(r.dir, "secret"), []byte(secret + "\n")); err != nil {
+		return err
+	}
+	// The service ID comes last, the service is enrolled when the file exists
+	if err := writeFileAtomic(filepath.Join(r.dir, "service_id"), []byte(serviceID + "\n")); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.serviceID = serviceID
+	r.secret = secret
+	r.mutex.Unlock()
+	return nil
+}
+
+// Returns true if the service is going to enroll, but is not enrolled yet
+// The server rejects the unsigned reports, the report queue holds the reports
+func (r *keyring) awaitingEnrollment() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.enrolling && r.serviceID == ""
+}
+
+func (r *keyring) setEnrolling(enrolling bool) {
+	r.mutex.Lock()
+	r.enrolling = enrolling
+	r.mutex.Unlock()
+}
+
+// Returns the service ID, empty if the service is not enrolled
+func (r *keyring) getServiceID() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.serviceID
+}
+
+func (r *keyring) publicKey(id string) []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.keys[id].PublicKey().Bytes()
+}
+
+func (r *keyring) getCurrent() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.current
+}
+
+// Returns the age of the current key
+func (r *keyring) keyAge(now time.Time) time.Duration {
+	info, err := os.Stat(filepath.Join(r.dir, "keys", r.getCurrent() + ".key"))
+	if err != nil {
+		return 0
+	}
+	return now.Sub(info.ModTime())
+}
+
+// Decrypt the payload which the server encrypted to a key of the service
+func (r *keyring) open(serviceID string, session uint32, sealed []byte) ([]byte, error) {
+	id, err := envelope.EnvelopeKeyID(sealed)
+	if err != nil {
+		return nil, err
+	}
+	r.mutex.Lock()
+	key, ok := r.keys[id]
+	ownServiceID := r.serviceID
+	r.mutex.Unlock()
+	if serviceID != ownServiceID {
+		return nil, fmt.Errorf("Payload is for service '%s', not '%s'", serviceID, ownServiceID)
+	}
+	if !ok {
+		return nil, fmt.Errorf("No key %s", id)
+	}
+	return envelope.Open(key, sealed, envelope.AssociatedData(serviceID, session))
+}
+
+// The server denied the token or the secret, the enrollment is disabled or the service is revoked
+var errEnrollmentRejected = errors.New("Server rejected the enrollment")
+
+// POST /enroll, returns an error if the server did not accept the request
+func postEnroll(client *http.Client, serverURL string, token string, request interface{}) (enrollResponse, error) {
+	var response enrollResponse
+	body, err := json.Marshal(request)
+	if err != nil {
+		return response, err
+	}
+	httpRequest, err := http.NewRequest("POST", serverURL + "/enroll", bytes.NewReader(body))
+	if err != nil {
+		return response, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		httpRequest.Header.Set("Authorization", "Bearer " + token)
+	}
+	httpResponse, err := client.Do(httpRequest)
+	if err != nil {
+		return response, err
+	}
+	defer httpResponse.Body.Close()
+	text, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return response, err
+	}
+	if err := json.Unmarshal(text, &response); err != nil {
+		return response, fmt.Errorf("Status %d %s", httpResponse.StatusCode, strings.TrimSpace(string(text)))
+	}
+	if httpResponse.StatusCode == http.StatusUnauthorized || httpResponse.StatusCode == http.StatusForbidden {
+		return response, fmt.Errorf("%w: status %d %s %s", errEnrollmentRejected, httpResponse.StatusCode, response.Status, response.Message)
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return response, fmt.Errorf("Status %d %s %s", httpResponse.StatusCode, response.Status, response.Message)
+	}
+	return response, nil
+}
+
+// Enroll the current key
+func (r *keyring) enroll(client *http.Client, serverURL string, token string) error {
+	request := struct {
+		PublicKey []byte `json:"public_key"`
+	}{r.publicKey(r.getCurrent())}
+	response, err := postEnroll(client, serverURL, token, request)
+	if err != nil {
+		return err
+	}
+	if response.ServiceID == "" || response.Secret == "" {
+		return fmt.Errorf("No service ID in the response")
+	}
+	return r.setEnrollment(response.ServiceID, response.Secret)
+}
+
+// Generate a new key and send it to the server
+// The new key is in the keyring before I send it: the server can encrypt to the
+// new key before I get the response
+// I keep the key if the request fails and send the same key on the next attempt
+func (r *keyring) rotate(client *http.Client, serverURL string) error {
+	r.mutex.Lock()
+	id := r.pending
+	r.mutex.Unlock()
+	if id == "" {
+		var err error
+		if id, err = r.generateKey(); err != nil {
+			return err
+		}
+		if err := r.setPending(id); err != nil {
+			return err
+		}
+	}
+	r.mutex.Lock()
+	request := struct {
+		ServiceID string `json:"service_id"`
+		Secret    string `json:"secret"`
+		PublicKey []byte `json:"public_key"`
+	}{r.serviceID, r.secret, r.keys[id].PublicKey().Bytes()}
+	r.mutex.Unlock()
+	response, err := postEnroll(client, serverURL, "", request)
+	if err != nil {
+		return err
+	}
+	// The server forgets the previous secret soon, I store the new secret first
+	if response.Secret != "" {
+		if err := r.setEnrollment(request.ServiceID, response.Secret); err != nil {
+			return err
+		}
+	}
+	if err := r.setPending(""); err != nil {
+		return err
+	}
+	return r.setCurrent(id)
+}
+
+// Add the service ID and the signature to the query of the report
+// I sign the report before every attempt, the timestamp is fresh
+// The reports of the service which is not enrolled are not signed
+func (r *keyring) sign(reportURL string, now time.Time) (string, error) {
+	r.mutex.Lock()
+	serviceID := r.serviceID
+	secret := r.secret
+	r.mutex.Unlock()
+	if serviceID == "" {
+		return reportURL, nil
+	}
+	parsed, err := url.Parse(reportURL)
+	if err != nil {
+		return "", err
+	}
+	query := parsed.Query()
+	query.Set("service", serviceID)
+	if err := signature.Sign(query, signature.ReportKey(secret), now); err != nil {
+		return "", err
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+// Goroutine which enrolls the service and rotates the key until the context is done
+func (r *keyring) maintain(ctx context.Context, client *http.Client, serverURL string, token string, rotate bool, lifetime time.Duration, period time.Duration) {
+	for {
+		if r.getServiceID() == "" {
+			if token == "" {
+				fmt.Println("Service is not enrolled and there is no enrollment token, the server withholds the payloads")
+				return
+			}
+			if err := r.enroll(client, serverURL, token); err != nil {
+				fmt.Println("Failed to enroll", err)
+				// I keep trying, but the reports do not wait
+				if errors.Is(err, errEnrollmentRejected) {
+					r.setEnrolling(false)
+				}
+			} else {
+				fmt.Printf("Enrolled service %s key %s\n", r.getServiceID(), r.getCurrent())
+			}
+		} else if rotate || (lifetime > 0 && r.keyAge(time.Now()) >= lifetime) {
+			if err := r.rotate(client, serverURL); err != nil {
+				fmt.Println("Failed to rotate key", err)
+			} else {
+				rotate = false
+				fmt.Printf("Rotated key of service %s to %s\n", r.getServiceID(), r.getCurrent())
+			}
+		}
+		select {
+		case <-time.After(period):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
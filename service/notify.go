@@ -0,0 +1,76 @@
+// Local notification of the knocking process
+// A client can listen on the unix socket RUNTIME_DIR/knock_PID.sock, see
+// utils.GetSocketFilename(). When the server confirms the report the service
+// connects to the sockets of the processes in the group and writes "matched\n"
+// The runtime directory belongs to the user of the process, mode 0700. I do not
+// connect if another user owns the directory
+// Most clients do not listen, I ignore the missing sockets
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+	"port-knocking-ipc/utils"
+	"port-knocking-ipc/utils/process"
+)
+
+const notifyTimeout = time.Duration(100) * time.Millisecond
+
+// Notify the process, returns false if the process does not listen
+func notifyProcess(uid int, pid int) (bool, error) {
+	path := utils.GetSocketFilename(uid, pid)
+	if !utils.PathExists(path) {
+		return false, nil
+	}
+	if err := utils.CheckRuntimeDir(uid); err != nil {
+		return false, err
+	}
+	conn, err := net.DialTimeout("unix", path, notifyTimeout)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+	if _, err := fmt.Fprintln(conn, "matched"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Notify the processes of the group in the report URL, called when the server
+// matched the session. Returns number of notified processes
+func notifyClients(reportURL string) int {
+	parsed, err := url.Parse(reportURL)
+	if err != nil {
+		return 0
+	}
+	group, ok := process.DecodeGroup(parsed.Query())
+	if !ok {
+		return 0
+	}
+	pids := []int{group.Root.PID}
+	for _, pid := range group.PIDs {
+		if !utils.Contains(pids, pid) {
+			pids = append(pids, pid)
+		}
+	}
+	notified := 0
+	for _, pid := range pids {
+		ok, err := notifyProcess(group.Root.RealUID, pid)
+		if err != nil {
+			fmt.Printf("Failed to notify pid=%d: %v\n", pid, err)
+		}
+		if ok {
+			notified++
+		}
+	}
+	return notified
+}
@@ -0,0 +1,175 @@
+// Payload delivery to a local consumer
+// The integrator can bind a payload to the session, for example an API key. The
+// server sends the payload in the response to the report which matched the session,
+// see server/payload.go. I hand the payload to the consumer configured by
+// -payload_consumer
+//     exec:COMMAND  run the command, the payload is in stdin, the environment contains
+//                   KNOCK_SESSION, KNOCK_PID and KNOCK_UID
+//     file:DIR      write the payload to DIR/payload_SESSION, mode 0600. I never
+//                   overwrite a file, the consumer removes the file
+//     unix:PATH     connect to the unix socket and write a JSON line
+//                   {"session":1,"pid":1234,"uid":1000,"payload":"BASE64"}
+// The server encrypts the payload to the key of the service, I decrypt the payload
+// before I hand it to the consumer, see keyring.go
+// The server hands the payload out once. If the consumer fails I drop the payload,
+// the integrator allocates a new session. I never print the payload
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"port-knocking-ipc/utils/process"
+)
+
+const payloadConsumerTimeout = time.Duration(10) * time.Second
+
+type payloadMessage struct {
+	Session uint32 `json:"session"`
+	PID     int    `json:"pid"`
+	UID     int    `json:"uid"`
+	Payload []byte `json:"payload"`
+}
+
+type payloadConsumer interface {
+	consume(message payloadMessage) error
+	String() string
+}
+
+// Create the consumer from "exec:COMMAND", "file:DIR" or "unix:PATH", nil if the
+// specification is empty
+func createPayloadConsumer(specification string) (payloadConsumer, error) {
+	if specification == "" {
+		return nil, nil
+	}
+	fields := strings.SplitN(specification, ":", 2)
+	if len(fields) != 2 || fields[1] == "" {
+		return nil, fmt.Errorf("Bad payload consumer '%s'", specification)
+	}
+	switch fields[0] {
+	case "exec":
+		return &execConsumer{fields[1]}, nil
+	case "file":
+		if err := os.MkdirAll(fields[1], 0700); err != nil {
+			return nil, err
+		}
+		return &fileConsumer{fields[1]}, nil
+	case "unix":
+		return &socketConsumer{fields[1]}, nil
+	}
+	return nil, fmt.Errorf("Unknown payload consumer '%s'", fields[0])
+}
+
+type execConsumer struct {
+	command string
+}
+
+func (c *execConsumer) consume(message payloadMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), payloadConsumerTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.command)
+	cmd.Stdin = bytes.NewReader(message.Payload)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("KNOCK_SESSION=%d", message.Session),
+		fmt.Sprintf("KNOCK_PID=%d", message.PID),
+		fmt.Sprintf("KNOCK_UID=%d", message.UID))
+	return cmd.Run()
+}
+
+func (c *execConsumer) String() string {
+	return fmt.Sprintf("exec:%s", c.command)
+}
+
+type fileConsumer struct {
+	dir string
+}
+
+// Write a temporary file and link it, the consumer never sees a partial payload
+func (c *fileConsumer) consume(message payloadMessage) error {
+	filename := filepath.Join(c.dir, fmt.Sprintf("payload_%d", message.Session))
+	tmpFilename := filename + ".tmp"
+	file, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFilename)
+	_, err = file.Write(message.Payload)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// Unlike rename the link fails if the file exists
+	return os.Link(tmpFilename, filename)
+}
+
+func (c *fileConsumer) String() string {
+	return fmt.Sprintf("file:%s", c.dir)
+}
+
+type socketConsumer struct {
+	path string
+}
+
+func (c *socketConsumer) consume(message payloadMessage) error {
+	conn, err := net.DialTimeout("unix", c.path, payloadConsumerTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(payloadConsumerTimeout))
+	return json.NewEncoder(conn).Encode(message)
+}
+
+func (c *socketConsumer) String() string {
+	return fmt.Sprintf("unix:%s", c.path)
+}
+
+// Decrypt the payload which the server encrypted to the key of the service
+func openPayload(keys *keyring, serviceID string, session uint32, sealed []byte) ([]byte, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("No keyring, dropped payload of session %d", session)
+	}
+	payload, err := keys.open(serviceID, session, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt payload of session %d: %v", session, err)
+	}
+	return payload, nil
+}
+
+// Hand the payload of the matched session to the consumer, called by the report
+// queue. I wipe the payload when done
+func deliverPayload(consumer payloadConsumer, reportURL string, session uint32, payload []byte) error {
+	defer func() {
+		for i := range payload {
+			payload[i] = 0
+		}
+	}()
+	if consumer == nil {
+		return fmt.Errorf("No payload consumer, dropped payload of session %d", session)
+	}
+	message := payloadMessage{Session: session, Payload: payload}
+	if parsed, err := url.Parse(reportURL); err == nil {
+		if group, ok := process.DecodeGroup(parsed.Query()); ok {
+			message.PID = group.Root.PID
+			message.UID = group.Root.RealUID
+		}
+	}
+	if err := consumer.consume(message); err != nil {
+		return fmt.Errorf("Failed to deliver payload of session %d to %v: %v", session, consumer, err)
+	}
+	return nil
+}
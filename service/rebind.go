@@ -0,0 +1,171 @@
+// Rebind the ports which the service failed to bind
+// Another program can release a port at any time. I periodically try to bind
+// the failed ports and the addresses which failed for the bound ports, for example
+// ::1, start accepting connections on the new listeners and
+// update the list of failed ports. I never retry the ports which I skip to
+// emulate failure of bind
+// After every attempt I send the bound and failed ports to the server:
+//     /ports?bound=21380,21381,&failed=21382,
+// The server can avoid allocating tuples which this host can not receive
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+	"port-knocking-ipc/utils"
+)
+
+// Returns a copy of the ports I failed to bind
+func (k *knocks) getFailedToBind() []int {
+	k.bindMutex.Lock()
+	defer k.bindMutex.Unlock()
+	return utils.CloneSlice(k.failedToBind)
+}
+
+// Returns copies of the bound and failed ports
+func (k *knocks) getPorts() ([]int, []int) {
+	k.bindMutex.Lock()
+	defer k.bindMutex.Unlock()
+	return utils.CloneSlice(k.boundPorts), utils.CloneSlice(k.failedToBind)
+}
+
+// Returns a copy of the addresses I failed to bind
+func (k *knocks) getMissingAddresses() map[int][]string {
+	k.bindMutex.Lock()
+	defer k.bindMutex.Unlock()
+	missingAddresses := make(map[int][]string, len(k.missingAddresses))
+	for port, missing := range k.missingAddresses {
+		missingAddresses[port] = append([]string{}, missing...)
+	}
+	return missingAddresses
+}
+
+// Try to bind the failed ports and the addresses I failed to bind for the bound
+// ports, returns the listeners I bound
+// The caller starts accepting the connections
+func (k *knocks) rebindPorts() []net.Listener {
+	missingAddresses := k.getMissingAddresses()
+	ports := []int{}
+	for port := range missingAddresses {
+		if !utils.Contains(k.skippedPorts, port) {
+			ports = append(ports, port)
+		}
+	}
+	sort.Ints(ports)
+	listeners := []net.Listener{}
+	stillMissing := make(map[int][]string)
+	for _, port := range ports {
+		portListeners, missing := bindPort(missingAddresses[port], port)
+		if len(portListeners) != 0 {
+			listeners = append(listeners, portListeners...)
+			stillMissing[port] = missing
+		}
+	}
+	if len(listeners) == 0 {
+		return listeners
+	}
+	k.bindMutex.Lock()
+	if k.closed {
+		k.bindMutex.Unlock()
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		return []net.Listener{}
+	}
+	k.listeners = append(k.listeners, listeners...)
+	required := knockAddress(k.addresses)
+	boundPorts := []int{}
+	for _, port := range ports {
+		missing, ok := stillMissing[port]
+		if !ok {
+			continue
+		}
+		if len(missing) == 0 {
+			delete(k.missingAddresses, port)
+		} else {
+			k.missingAddresses[port] = missing
+		}
+		if utils.Contains(k.failedToBind, port) && !containsAddress(missing, required) {
+			boundPorts = append(boundPorts, port)
+		}
+	}
+	k.boundPorts = append(k.boundPorts, boundPorts...)
+	sort.Ints(k.boundPorts)
+	failed := []int{}
+	for _, port := range k.failedToBind {
+		if !utils.Contains(boundPorts, port) {
+			failed = append(failed, port)
+		}
+	}
+	k.failedToBind = failed
+	k.bindMutex.Unlock()
+	for _, port := range ports {
+		if missing, ok := stillMissing[port]; ok {
+			fmt.Println("Listening on", subtractAddresses(missingAddresses[port], missing), port)
+		}
+	}
+	return listeners
+}
+
+// Addresses from 'a' which are not in 'b'
+func subtractAddresses(a, b []string) []string {
+	result := []string{}
+	for _, address := range a {
+		if !containsAddress(b, address) {
+			result = append(result, address)
+		}
+	}
+	return result
+}
+
+func portsToText(ports []int) string {
+	var text bytes.Buffer
+	for _, port := range ports {
+		text.WriteString(fmt.Sprintf("%d,", port))
+	}
+	return text.String()
+}
+
+// Send the bound and failed ports to the server
+func (k *knocks) advertisePorts(client *http.Client) error {
+	boundPorts, failedToBind := k.getPorts()
+	query := url.Values{}
+	query.Set("bound", portsToText(boundPorts))
+	query.Set("failed", portsToText(failedToBind))
+	response, err := client.Get(k.hostURL + "/ports?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// Goroutine which rebinds the failed ports until the context is done
+func (k *knocks) rebind(ctx context.Context, period time.Duration) {
+	client := &http.Client{Timeout: period}
+	for {
+		for _, listener := range k.rebindPorts() {
+			go k.handleAccept(listener)
+		}
+		if err := k.advertisePorts(client); err != nil {
+			fmt.Println("Failed to advertise ports", err)
+		}
+		select {
+		case <-time.After(period):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
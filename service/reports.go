@@ -0,0 +1,372 @@
+// Report queue delivers the completed knock sequences to the server
+// The accept handler and the expiration scheduler add reports to a bounded
+// queue and never wait for the network. If the queue is full I drop the report.
+// Worker goroutines send the reports. If the server is not reachable or
+// returns 5xx the worker retries with exponential backoff and jitter until
+// the deadline of the report. I count the outcomes of the delivery
+// If the spool is enabled I write the report to the spool before adding it to
+// the queue and remove it when the server processed the report. The reports
+// which did not make it stay in the spool. I replay them periodically, after a
+// restart and when a delivery succeeds - the network is back. See spool.go
+// When the service shuts down drain() waits for the queued reports until the
+// shutdown timeout and aborts the rest. The aborted reports stay in the spool
+// When the server matches the session I notify the knocking process, see notify.go,
+// and hand the payload of the session to the consumer, see payload.go
+// The enrolled service signs the report before every attempt, see keyring.go
+// The reports wait while the service is enrolling, the server rejects unsigned reports
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type report struct {
+	url      string
+	deadline time.Time
+	attempts int
+	// nil if the spool is disabled
+	entry    *spoolEntry
+}
+
+// Delivery outcomes, see reportQueue.getStatistics()
+type reportStatistics struct {
+	Queued    uint64
+	Delivered uint64
+	Retried   uint64
+	// The queue was full
+	Dropped   uint64
+	// The queue was full, the report waits in the spool
+	Spooled   uint64
+	Replayed  uint64
+	// Deadline expired before the server accepted the report
+	Expired   uint64
+	// The report can not be sent, for example bad URL, or the server 
+	// rejected the report: no matching session, session expired
+	Failed    uint64
+	// Payloads handed to the consumer and payloads I failed to hand
+	Payloads  uint64
+	PayloadsFailed uint64
+}
+
+type reportQueue struct {
+	reports    chan *report
+	client     *http.Client
+	clock      clock
+	// Timeout of a single HTTP request
+	timeout    time.Duration
+	// Time to deliver a report
+	deadline   time.Duration
+	backoffMin time.Duration
+	backoffMax time.Duration
+	mutex      sync.Mutex
+	statistics reportStatistics
+	spool      *spool
+	// The server forgets the session after this time, I drop older reports
+	lifetime   time.Duration
+	replayPeriod time.Duration
+	replayWakeup chan struct{}
+	// Reports in the queue and in the workers, protected by the mutex
+	pending    int
+	draining   bool
+	// drain() cancels the context, the workers exit
+	ctx        context.Context
+	cancel     context.CancelFunc
+	// Called when the server matched the session, nil to disable, see notify.go
+	notify     func(url string)
+	// Receives the payload of the matched session, see payload.go
+	consumer   payloadConsumer
+	// Decrypts the payload, nil if the service has no keys, see keyring.go
+	keyring    *keyring
+}
+
+func createReportQueue(size int, timeout time.Duration, deadline time.Duration) *reportQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &reportQueue{
+		ctx:        ctx,
+		cancel:     cancel,
+		reports:    make(chan *report, size),
+		client:     &http.Client{},
+		clock:      systemClock{},
+		timeout:    timeout,
+		deadline:   deadline,
+		backoffMin: 100 * time.Millisecond,
+		backoffMax: 5 * time.Second,
+		replayPeriod: 5 * time.Second,
+		replayWakeup: make(chan struct{}, 1),
+	}
+}
+
+// Enable the spool, the reports expire after 'lifetime'
+func (q *reportQueue) setSpool(s *spool, lifetime time.Duration) {
+	q.spool = s
+	q.lifetime = lifetime
+}
+
+// Start the worker goroutines
+func (q *reportQueue) start(workers int) {
+	for i := 0;i < workers;i++ {
+		go q.worker()
+	}
+	if q.spool != nil {
+		go q.replay()
+	}
+}
+
+// Add the report to the queue, returns false if the queue is full
+// I never block here
+func (q *reportQueue) enqueue(url string) bool {
+	now := q.clock.Now()
+	r := &report{url: url, deadline: now.Add(q.deadline)}
+	if q.spool != nil {
+		entry, err := q.spool.add(url, now, now.Add(q.lifetime))
+		if err == nil {
+			r.entry = entry
+		} else {
+			fmt.Println("Failed to spool report", err)
+		}
+	}
+	return q.push(r)
+}
+
+func (q *reportQueue) push(r *report) bool {
+	if r.entry != nil && r.entry.expires.Before(r.deadline) {
+		r.deadline = r.entry.expires
+	}
+	q.addPending(1)
+	select {
+	case q.reports <- r:
+		q.count(func(s *reportStatistics) { s.Queued++ })
+		return true
+	default:
+	}
+	q.addPending(-1)
+	if r.entry != nil {
+		q.spool.release(r.entry.id)
+		q.count(func(s *reportStatistics) { s.Spooled++ })
+		fmt.Println("Report queue is full, spooled", r.url)
+	} else {
+		q.count(func(s *reportStatistics) { s.Dropped++ })
+		fmt.Println("Report queue is full, dropped", r.url)
+	}
+	return false
+}
+
+// Update the spool when the delivery is over
+// If the server processed the report I remove it from the spool, otherwise
+// the report waits in the spool for replay
+func (q *reportQueue) finish(r *report, processed bool) {
+	if r.entry == nil {
+		return
+	}
+	if !processed {
+		q.spool.release(r.entry.id)
+		return
+	}
+	if err := q.spool.remove(r.entry.id); err != nil {
+		fmt.Println("Failed to update spool", err)
+	}
+}
+
+// Goroutine which adds the spooled reports to the queue for the life of the service
+// I stop replaying when the queue drains
+func (q *reportQueue) replay() {
+	for {
+		q.mutex.Lock()
+		draining := q.draining
+		q.mutex.Unlock()
+		if !draining {
+			for _, entry := range q.spool.pending(q.clock.Now()) {
+				q.count(func(s *reportStatistics) { s.Replayed++ })
+				q.push(&report{url: entry.url, deadline: q.clock.Now().Add(q.deadline), entry: entry})
+			}
+		}
+		select {
+		case <-q.clock.After(q.replayPeriod):
+		case <-q.replayWakeup:
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *reportQueue) addPending(delta int) {
+	q.mutex.Lock()
+	q.pending += delta
+	q.mutex.Unlock()
+}
+
+// Wait until the workers deliver the queued reports or the context is done
+// Abort the deliveries in progress, stop the workers
+func (q *reportQueue) drain(ctx context.Context) error {
+	q.mutex.Lock()
+	q.draining = true
+	q.mutex.Unlock()
+	defer q.cancel()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		q.mutex.Lock()
+		pending := q.pending
+		q.mutex.Unlock()
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d reports are not delivered: %v", pending, ctx.Err())
+		}
+	}
+}
+
+func (q *reportQueue) count(f func(s *reportStatistics)) {
+	q.mutex.Lock()
+	f(&q.statistics)
+	q.mutex.Unlock()
+}
+
+func (q *reportQueue) getStatistics() reportStatistics {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.statistics
+}
+
+// Exponential backoff with full jitter: random delay in [backoffMin, min(backoffMin*2^attempts, backoffMax)]
+func (q *reportQueue) backoff(attempts int) time.Duration {
+	limit := q.backoffMin
+	for i := 1;i < attempts && limit < q.backoffMax;i++ {
+		limit *= 2
+	}
+	if limit > q.backoffMax {
+		limit = q.backoffMax
+	}
+	return q.backoffMin + time.Duration(rand.Int63n(int64(limit-q.backoffMin)+1))
+}
+
+// Send the report once, returns true if I should retry
+func (q *reportQueue) send(r *report) (bool, error) {
+	deadline := q.clock.Now().Add(q.timeout)
+	if r.deadline.Before(deadline) {
+		deadline = r.deadline
+	}
+	ctx, cancel := context.WithTimeout(q.ctx, deadline.Sub(q.clock.Now()))
+	defer cancel()
+	// The spool keeps the report without the signature, see keyring.go
+	signedURL := r.url
+	if q.keyring != nil {
+		if q.keyring.awaitingEnrollment() {
+			return true, fmt.Errorf("Service is not enrolled yet")
+		}
+		var err error
+		signedURL, err = q.keyring.sign(r.url, q.clock.Now())
+		if err != nil {
+			return false, err
+		}
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", signedURL, nil)
+	if err != nil {
+		return false, err
+	}
+	// The server responds with a typed status
+	request.Header.Set("Accept", "application/json")
+	response, err := q.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	text, err := ioutil.ReadAll(response.Body)
+	if response.StatusCode >= 500 {
+		return true, fmt.Errorf("Status %d", response.StatusCode)
+	}
+	status := struct {
+		Status   string   `json:"status"`
+		Message  string   `json:"message"`
+		Sessions []uint32 `json:"sessions"`
+		Service  string   `json:"service"`
+		Payload  []byte   `json:"payload"`
+	}{}
+	if err == nil && json.Unmarshal(text, &status) == nil {
+		fmt.Printf("Got repsonse for ulr='%s': %s %s\n", r.url, status.Status, status.Message)
+	}
+	if status.Status == "matched" && q.notify != nil {
+		q.notify(r.url)
+	}
+	// The server does not send the payload again, I do not retry
+	if status.Status == "matched" && len(status.Payload) != 0 && len(status.Sessions) == 1 {
+		payload, err := openPayload(q.keyring, status.Service, status.Sessions[0], status.Payload)
+		if err == nil {
+			err = deliverPayload(q.consumer, r.url, status.Sessions[0], payload)
+		}
+		if err != nil {
+			fmt.Println(err)
+			q.count(func(s *reportStatistics) { s.PayloadsFailed++ })
+		} else {
+			q.count(func(s *reportStatistics) { s.Payloads++ })
+		}
+	}
+	// The server processed the report. 4xx will not change if I retry
+	if response.StatusCode >= 400 {
+		return false, fmt.Errorf("Status %d %s", response.StatusCode, status.Status)
+	}
+	return false, nil
+}
+
+// Deliver the report, retry until the deadline
+func (q *reportQueue) deliver(r *report) {
+	for {
+		r.attempts++
+		retry, err := q.send(r)
+		if err == nil {
+			q.count(func(s *reportStatistics) { s.Delivered++ })
+			q.finish(r, true)
+			// The server is reachable, replay the spool
+			select {
+			case q.replayWakeup <- struct{}{}:
+			default:
+			}
+			return
+		}
+		if !retry {
+			q.count(func(s *reportStatistics) { s.Failed++ })
+			q.finish(r, true)
+			fmt.Printf("Failed to GET %s: %v\n", r.url, err)
+			return
+		}
+		delay := q.backoff(r.attempts)
+		if q.clock.Now().Add(delay).After(r.deadline) {
+			q.count(func(s *reportStatistics) { s.Expired++ })
+			q.finish(r, false)
+			fmt.Printf("Failed to GET %s after %d attempts: %v\n", r.url, r.attempts, err)
+			return
+		}
+		q.count(func(s *reportStatistics) { s.Retried++ })
+		select {
+		case <-q.clock.After(delay):
+		case <-q.ctx.Done():
+			q.finish(r, false)
+			fmt.Printf("Aborted GET %s after %d attempts\n", r.url, r.attempts)
+			return
+		}
+	}
+}
+
+// Goroutine which delivers reports until the queue drains
+func (q *reportQueue) worker() {
+	for {
+		select {
+		case r := <-q.reports:
+			q.deliver(r)
+			q.addPending(-1)
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,251 @@
+// Resolvers of the PID of the process which knocked a port
+// The service accepts a connection and looks for the socket of the other end of the 
+// connection - local port is the remote port of the accepted connection, remote port is 
+// the port the service listens.
+// procResolver parses /proc/net/tcp and /proc/net/tcp6, finds the inode of the socket 
+// and looks for the process which has a file descriptor "socket:[inode]" in /proc/PID/fd 
+// The browser knocks many ports in a row. I keep a cache inode -> (PID, fd) and rescan 
+// the file descriptors of the recently resolved processes before I scan the whole
+// process table. 
+// netstatResolver runs 'netstat -ntp', slow, requires net-tools, but works where 
+// /proc is not available
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"port-knocking-ipc/utils"
+)
+
+type pidResolver interface {
+	// Returns PID of the process which owns the socket clientPort->servicePort 
+	resolve(clientPort, servicePort int) (int, bool)
+}
+
+type netstatResolver struct {
+}
+
+// Try the resolvers one by one
+type fallbackResolver struct {
+	resolvers []pidResolver
+}
+
+type socketOwner struct {
+	pid int
+	fd  string
+}
+
+type procResolver struct {
+	root       string
+	mutex      sync.Mutex
+	cache      map[uint64]socketOwner
+	recentPIDs []int
+}
+
+// Reset the cache if it grows above this size
+const maxSocketsCacheSize = 64*1024
+// Number of recently resolved processes I rescan first
+const maxRecentPIDs = 8
+
+// Create a resolver by name: "proc", "netstat" or "auto" - /proc with fallback to netstat
+func createPIDResolver(name string) (pidResolver, error) {
+	switch name {
+	case "proc":
+		return createProcResolver("/proc"), nil
+	case "netstat":
+		return &netstatResolver{}, nil
+	case "auto":
+		return &fallbackResolver{[]pidResolver{createProcResolver("/proc"), &netstatResolver{}}}, nil
+	}
+	return nil, fmt.Errorf("Unknown PID resolver '%s'", name)
+}
+
+func (r *fallbackResolver) resolve(clientPort, servicePort int) (int, bool) {
+	for _, resolver := range r.resolvers {
+		if pid, ok := resolver.resolve(clientPort, servicePort); ok {
+			return pid, ok
+		}
+	}
+	return 0, false
+}
+
+// I am looking for line like 
+// "tcp        0      0 127.0.0.1:36518         127.0.0.1:21380         ESTABLISHED 26396/firefox  "
+// In the output of the 'netstat'
+func (r *netstatResolver) resolve(clientPort, servicePort int) (int, bool) {
+	command := exec.Command("netstat", "-ntp")
+	var out bytes.Buffer
+	command.Stdout = &out
+	err := command.Run()
+	if err == nil {
+		output := strings.Split(out.String(), "\n")
+		re := regexp.MustCompile(fmt.Sprintf("tcp6?\\s+\\S+\\s+\\S+\\s+\\S+:%d\\s+\\S+:%d\\s+ESTABLISHED\\s+([0-9]+)/(\\S+)", clientPort, servicePort))
+		for _, line := range output {
+			 match := re.FindStringSubmatch(line)
+			 if len(match) > 0 {
+			 	pid, ok := utils.AtoPID(match[1])
+			 	return pid, ok
+			 }
+		} 
+		fmt.Println("Failed to match port", clientPort)
+		return 0, false		 	
+	} 
+	fmt.Println("Failed to start nestat:", err)
+	return 0, false		 	
+}
+
+func createProcResolver(root string) *procResolver {
+	return &procResolver{
+		root:  root,
+		cache: make(map[uint64]socketOwner),
+	}
+}
+
+// Parse "0100007F:5384" or "00000000000000000000000001000000:5384", return the port
+func parseProcNetAddress(address string) (int, bool) {
+	colon := strings.LastIndex(address, ":")
+	if colon < 0 {
+		return 0, false
+	}
+	port, err := strconv.ParseUint(address[colon+1:], 16, 16)
+	if err != nil {
+		return 0, false
+	}
+	return int(port), true
+}
+
+// Find the inode of the socket localPort->remotePort in /proc/net/tcp or /proc/net/tcp6
+// The format of the file is 
+// "sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode"
+func (r *procResolver) findInode(localPort, remotePort int) (uint64, bool) {
+	for _, name := range []string{"tcp", "tcp6"} {
+		file, err := os.Open(filepath.Join(r.root, "net", name))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			local, ok := parseProcNetAddress(fields[1])
+			if !ok || local != localPort {
+				continue
+			}
+			remote, ok := parseProcNetAddress(fields[2])
+			if !ok || remote != remotePort {
+				continue
+			}
+			inode, err := strconv.ParseUint(fields[9], 10, 64)
+			if err != nil || inode == 0 {
+				continue
+			}
+			file.Close()
+			return inode, true
+		}
+		file.Close()
+	}
+	return 0, false
+}
+
+// Returns true if the file descriptor still refers to the socket
+func (r *procResolver) isOwner(owner socketOwner, inode uint64) bool {
+	link, err := os.Readlink(filepath.Join(r.root, strconv.Itoa(owner.pid), "fd", owner.fd))
+	return err == nil && link == fmt.Sprintf("socket:[%d]", inode)
+}
+
+// Add all sockets of the process to the cache
+func (r *procResolver) scanProcess(pid int) {
+	fdDir := filepath.Join(r.root, strconv.Itoa(pid), "fd")
+	fds, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		return
+	}
+	for _, fd := range fds {
+		link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+		inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), 10, 64)
+		if err == nil {
+			r.cache[inode] = socketOwner{pid, fd.Name()}
+		}
+	}
+}
+
+// Add sockets of all processes to the cache
+func (r *procResolver) scanAllProcesses() {
+	entries, err := ioutil.ReadDir(r.root)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if pid, ok := utils.AtoPID(entry.Name()); ok {
+			r.scanProcess(pid)
+		}
+	}
+}
+
+// Returns the cached owner of the socket if the owner is still valid
+func (r *procResolver) lookup(inode uint64) (int, bool) {
+	owner, ok := r.cache[inode]
+	if !ok {
+		return 0, false
+	}
+	if !r.isOwner(owner, inode) {
+		delete(r.cache, inode)
+		return 0, false
+	}
+	return owner.pid, true
+}
+
+func (r *procResolver) addRecentPID(pid int) {
+	for _, recentPID := range r.recentPIDs {
+		if recentPID == pid {
+			return
+		}
+	}
+	r.recentPIDs = append(r.recentPIDs, pid)
+	if len(r.recentPIDs) > maxRecentPIDs {
+		r.recentPIDs = r.recentPIDs[1:]
+	}
+}
+
+func (r *procResolver) resolve(clientPort, servicePort int) (int, bool) {
+	// The client's end of the connection: local port is the client's port
+	inode, ok := r.findInode(clientPort, servicePort)
+	if !ok {
+		return 0, false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.cache) > maxSocketsCacheSize {
+		r.cache = make(map[uint64]socketOwner)
+	}
+	if pid, ok := r.lookup(inode); ok {
+		return pid, true
+	}
+	for _, pid := range r.recentPIDs {
+		r.scanProcess(pid)
+	}
+	pid, ok := r.lookup(inode)
+	if !ok {
+		r.scanAllProcesses()
+		pid, ok = r.lookup(inode)
+	}
+	if ok {
+		r.addRecentPID(pid)
+	}
+	return pid, ok
+}
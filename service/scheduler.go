@@ -0,0 +1,119 @@
+// Expiration scheduler flushes knock sequences which timed out
+// Every knock extends the expiration time of the sequence. I keep a min-heap of
+// (expiration time, sequence) ordered by the expiration time and push a new entry
+// on every knock. The scheduler sleeps until the top of the heap expires, pops
+// the expired entries and sends the sequences to the server
+// Entries of the sequences which were extended or completed by the accept handler
+// are stale. The scheduler skips such entries when popped. This way every sequence
+// is flushed exactly once: either by the accept handler or by the scheduler
+// The clock is an interface, tests replace the system time by a fake clock
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+type clock interface {
+	Now() time.Time
+	// Returns a channel which fires after the duration
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct {
+}
+
+func (c systemClock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (c systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Schedule expiration of the sequence, called by addKnock with the mutex locked
+// I wake up the scheduler if the new entry is the nearest deadline
+func (k *knocks) scheduleExpiration(state *knockingState) {
+	k.expirations.Push(state.expirationTime, state)
+	if expirationTime, top, _ := k.expirations.Peek(); top == state && expirationTime.Equal(state.expirationTime) {
+		select {
+		case k.wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Remove all sequences which expired by 'now' from the map, return the removed sequences
+func (k *knocks) expireKnocks(now time.Time) []*knockingState {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	expired := []*knockingState{}
+	for {
+		expirationTime, entry, ok := k.expirations.PopExpired(now)
+		if !ok {
+			break
+		}
+		state, ok := k.state[entry.pid]
+		// The sequence could be completed or extended since
+		if !ok || state != entry || !state.expirationTime.Equal(expirationTime) {
+			continue
+		}
+		delete(k.state, state.pid)
+		expired = append(expired, state)
+	}
+	return expired
+}
+
+// Returns time until the nearest expiration, false if there is nothing to expire
+func (k *knocks) nextExpiration(now time.Time) (time.Duration, bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	expirationTime, _, ok := k.expirations.Peek()
+	if !ok {
+		return 0, false
+	}
+	return expirationTime.Sub(now), true
+}
+
+// Goroutine which flushes expired knock sequences until the context is done
+func (k *knocks) completeKnocks(ctx context.Context) {
+	for {
+		wait, ok := k.nextExpiration(k.clock.Now())
+		if !ok {
+			select {
+			case <-k.wakeup:
+			case <-ctx.Done():
+				return
+			}
+		} else if wait > 0 {
+			select {
+			case <-k.clock.After(wait):
+			case <-k.wakeup:
+			case <-ctx.Done():
+				return
+			}
+		}
+		// I do not send the queries while holding the mutex
+		for _, state := range k.expireKnocks(k.clock.Now()) {
+			k.send(state.group(), k.getCandidates(state))
+		}
+	}
+}
+
+// Send all collected sequences, called when the service shuts down
+// Returns number of flushed sequences
+func (k *knocks) flushKnocks() int {
+	k.mutex.Lock()
+	states := []*knockingState{}
+	for _, state := range k.state {
+		states = append(states, state)
+	}
+	k.state = make(map[int]*knockingState)
+	k.expirations.Reset()
+	k.mutex.Unlock()
+	for _, state := range states {
+		k.send(state.group(), k.getCandidates(state))
+	}
+	return len(states)
+}
@@ -10,81 +10,204 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"fmt"
 	"flag"
 	"time"
-	"regexp"
-	"os/exec"
 	"bytes"
-	"strings"
 	"sync"
+	"sort"
+	"strings"
     "math/rand"
-	"io/ioutil"
 	"port-knocking-ipc/utils"
-	"port-knocking-ipc/utils/combinations"
+	"port-knocking-ipc/utils/lifecycle"
+	"port-knocking-ipc/utils/process"
+	"port-knocking-ipc/utils/systemd"
+	"port-knocking-ipc/utils/timeheap"
 )
 
 type knockingState struct {
 	ports []int
 	expirationTime time.Time
 	pid int
+	// Ports collected between "frame start" knocks, only in the frame start mode
+	frames [][]int
+	// Identity of the knocking process, read when the first knock arrives
+	// This is the root of the group if the service groups the processes
+	identity process.Identity
+	// Processes which contributed knocks
+	pids []int
+	// Ports which the service failed to bind when the first knock arrived
+	// The service can bind a port while the client knocks, see rebind.go
+	failedToBind []int
 }
 type knocks struct {
 	mutex sync.Mutex
 	state map[int]*knockingState
 	portsBase        int
+	// Optional "frame start" port, zero if disabled
+	framePort        int
 	portsRange      []int
 	portsToSkip     int
+	// Ports which I do not bind to emulate failure of bind
+	skippedPorts    []int
+	// Protects failedToBind, missingAddresses, listeners and boundPorts, see rebind.go
+	bindMutex       sync.Mutex
 	failedToBind    []int
+	// Addresses I failed to bind by port, includes the failed ports
+	missingAddresses map[int][]string
 	listeners       []net.Listener
 	boundPorts      []int
+	addresses       []string
+	// The service is shutting down, see daemon.go
+	closed          bool
 	portsRangeSize  int
 	tolerance       int
 	tupleSize       int
 	host            string
 	port            int
 	hostURL         string
+	resolver        pidResolver
+	grouping        processGrouping
+	procRoot        string
+	// Expiration scheduler, see scheduler.go
+	clock           clock
+	expirations     timeheap.Heap[*knockingState]
+	wakeup          chan struct{}
+	// Sends the candidates to the server, sendQueryToServer by default
+	send            func(group process.Group, candidates [][][]int)
+	// Outbound queue of the queries, see reports.go
+	reports         *reportQueue
 }
 
 var knocksCollection knocks
 
 // Add the port to the map of knocking sequences 
-func (k *knocks) addKnock(pid int, port int) *knockingState{
+// The knocks are collected by the root of the process group, see grouping.go
+// In the frame start mode a knock on the frame start port opens a new frame, other
+// knocks go to the last frame. I drop knocks which arrive before the first frame start
+func (k *knocks) addKnock(root int, pid int, port int) *knockingState{
 	const timeout = time.Duration(5) //s
-	expirationTime := time.Now().UTC().Add(time.Second*timeout)
+	expirationTime := k.clock.Now().Add(time.Second*timeout)
 	
-	state, ok := k.state[pid]
+	state, ok := k.state[root]
 	if !ok {
-		state = &knockingState{ []int{}, expirationTime, int(pid) } 
-		k.state[pid] = state 
+		state = &knockingState{ []int{}, expirationTime, int(root), [][]int{}, process.Identity{PID: root}, []int{}, k.getFailedToBind() } 
+		k.state[root] = state 
 	}
-	state.ports = append(state.ports, port)
 	state.expirationTime = expirationTime
+	k.scheduleExpiration(state)
+	if !utils.Contains(state.pids, pid) {
+		state.pids = append(state.pids, pid)
+	}
+	if k.framePort == 0 {
+		state.ports = append(state.ports, port)
+		return state
+	}
+	if port == k.framePort {
+		state.frames = append(state.frames, []int{})
+		return state
+	}
+	lastFrame := len(state.frames)-1
+	if lastFrame >= 0 {
+		state.frames[lastFrame] = append(state.frames[lastFrame], port)
+		state.ports = append(state.ports, port)
+	}
 	return state
 }
 
+// Returns the collected knocks divided into tuples
+// In the frame start mode every frame is a tuple. The client can knock the ports of 
+// a tuple in any order, I sort the ports. 
+func (k *knocks) getKnockedTuples(state *knockingState) [][]int {
+	if k.framePort == 0 {
+		return [][]int{state.ports}
+	}
+	tuples := [][]int{}
+	for _, frame := range state.frames {
+		if len(frame) == 0 {
+			continue
+		}
+		tuple := utils.CloneSlice(frame)
+		sort.Ints(tuple)
+		tuples = append(tuples, tuple)
+	}
+	return tuples
+}
+
+// Returns all candidate sets of tuples for the collected knocks, see tuples.go
+// A port could fail to bind at any time during the sequence, I use the ports
+// which failed when the sequence started and the ports which fail now
+func (k *knocks) getCandidates(state *knockingState) [][][]int {
+	failedToBind := k.getFailedToBind()
+	for _, port := range state.failedToBind {
+		if !utils.Contains(failedToBind, port) {
+			failedToBind = append(failedToBind, port)
+		}
+	}
+	var candidates [][][]int
+	var err error
+	if k.framePort != 0 {
+		candidates, err = getFramesTuples(k.getKnockedTuples(state), failedToBind, k.tupleSize)
+	} else {
+		tuplesCount := utils.GetTuplesCount(k.tolerance, k.tupleSize)
+		candidates, err = getTuples(state.ports, failedToBind, k.tupleSize, tuplesCount)
+	}
+	if err != nil {
+		fmt.Printf("Failed to reconstruct the tuples of %d: %v\n", state.pid, err)
+	}
+	return candidates
+}
+
 // get list of ports to bind
+// The ports range can be a union of disjoint ranges
 func (k *knocks) getPortsToBind() []int{
-	ports := []int{}
-	for i := 0;i < k.portsRangeSize; i++ {
-		ports = append(ports, k.portsBase+i)
-	}  	
-	return ports
+	return utils.CloneSlice(k.portsRange)
+}
+
+// The clients knock 127.0.0.1, see client.go
+// If the service does not listen 127.0.0.1 I require the first listen address
+func knockAddress(addresses []string) string {
+	for _, address := range addresses {
+		if address == "127.0.0.1" {
+			return address
+		}
+	}
+	return addresses[0]
+}
+
+func containsAddress(addresses []string, address string) bool {
+	for _, a := range addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
 }
 
 // bind the specified ports 
-func bindPorts(ports, portsToSkip []int) (listeners []net.Listener, boundPorts []int, failedToBind []int) {
+// I bind every port on all specified addresses, for example 127.0.0.1 and ::1 
+// The port is bound if I managed to bind the address which the clients knock. A 
+// host can lack IPv6. I keep the addresses I failed to bind, rebind.go retries them
+func bindPorts(addresses []string, ports, portsToSkip []int) (listeners []net.Listener, boundPorts []int, failedToBind []int, missingAddresses map[int][]string) {
 	listeners = []net.Listener{}
 	failedToBind = []int{}
 	boundPorts = []int{}
+	missingAddresses = make(map[int][]string)
+	required := knockAddress(addresses)
 	for _, port := range ports {
-		name := fmt.Sprintf(":%d", port)
-		listener, err := net.Listen("tcp", name)
-		if err == nil {
-			listeners = append(listeners, listener)
+		portListeners, missing := bindPort(addresses, port)
+		listeners = append(listeners, portListeners...)
+		if len(missing) != 0 {
+			missingAddresses[port] = missing
+		}
+		if !containsAddress(missing, required) {
 			boundPorts = append(boundPorts, port)
 		} else {
 			failedToBind = append(failedToBind, port)
@@ -94,38 +217,61 @@ func bindPorts(ports, portsToSkip []int) (listeners []net.Listener, boundPorts [
 	if len(failedToBind) != 0 {
 		fmt.Printf("Failed to bind ports %v\n", failedToBind)		
 	}
-	fmt.Println("Listening on", ports)
-	return listeners, boundPorts, failedToBind	
+	for _, port := range boundPorts {
+		if missing, ok := missingAddresses[port]; ok {
+			fmt.Printf("Failed to bind port %d on %v\n", port, missing)
+		}
+	}
+	fmt.Println("Listening on", addresses, boundPorts)
+	return listeners, boundPorts, failedToBind, missingAddresses
 }
 
-// I am looking for line like 
-// "tcp        0      0 127.0.0.1:36518         127.0.0.1:21380         ESTABLISHED 26396/firefox  "
-// In the output of the 'netstat'
-func getPID(port int) (pid int, ok bool) {
-	command := exec.Command("netstat", "-ntp")
-	var out bytes.Buffer
-	command.Stdout = &out
-	err := command.Run()
-	if err == nil {
-		output := strings.Split(out.String(), "\n")
-		re := regexp.MustCompile(fmt.Sprintf("tcp\\s+\\S+\\s+\\S+\\s+\\S+:%d.+ESTABLISHED\\s+([0-9]+)/(\\S+)", port))
-		for _, line := range output {
-			 match := re.FindStringSubmatch(line)
-			 if len(match) > 0 {
-			 	pid, ok := utils.AtoPID(match[1])
-			 	return pid, ok
-			 }
-		} 
-		fmt.Println("Failed to match port", port)
-		return 0, false		 	
-	} 
-	fmt.Println("Failed to start nestat:", err)
-	return 0, false		 	
+// Bind the port on all addresses, returns the listeners for the addresses I managed to bind
+// and the addresses I failed to bind
+func bindPort(addresses []string, port int) ([]net.Listener, []string) {
+	listeners := []net.Listener{}
+	missing := []string{}
+	for _, address := range addresses {
+		name := net.JoinHostPort(address, fmt.Sprint(port))
+		listener, err := net.Listen("tcp", name)
+		if err == nil {
+			listeners = append(listeners, listener)
+		} else {
+			missing = append(missing, address)
+		}
+	}
+	return listeners, missing
+}
+
+// Parse the list of addresses to listen "127.0.0.1,::1"
+func parseListenAddresses(s string) ([]string, error) {
+	addresses := []string{}
+	for _, address := range strings.Split(s, ",") {
+		address = strings.Trim(strings.TrimSpace(address), "[]")
+		if address == "" {
+			continue
+		}
+		if net.ParseIP(address) == nil {
+			return nil, fmt.Errorf("Bad address '%s'", address)
+		}
+		addresses = append(addresses, address)
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("No addresses in '%s'", s)
+	}
+	return addresses, nil
+}
+
+// Returns true if the peer is 127.0.0.0/8 or ::1
+// Only local applications are allowed to knock 
+func isLoopbackAddress(address net.Addr) bool {
+	tcpAddress, ok := address.(*net.TCPAddr)
+	return ok && tcpAddress.IP.IsLoopback()
 }
 
 // Return true if all tuples are collected or timeout
 func (k *knocks) isCompleted(state *knockingState) bool {
-	if state.expirationTime.Before(time.Now().UTC()) {
+	if !state.expirationTime.After(k.clock.Now()) {
 		return true 
 	}
 	// I want to allocate enough tuples to reach the specifed tolerance level
@@ -134,12 +280,36 @@ func (k *knocks) isCompleted(state *knockingState) bool {
 	if k.tolerance == 0 {
 		tuples = 1		
 	}  
+	if k.framePort != 0 {
+		// All frames are collected and the last frame is full
+		frames := len(state.frames)
+		return (frames >= tuples) && (len(state.frames[frames-1]) >= k.tupleSize)
+	}
 	if len(state.ports) % (tuples * k.tupleSize) == 0{
 		return true
 	}
 	return false
 }
 
+// I keep the spool in the user cache, for example /root/.cache/port-knocking-ipc
+func defaultSpoolPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "port-knocking-ipc", "reports.spool")
+}
+
+func printSpoolStatus(path string) {
+	spool, err := loadSpool(path)
+	if err != nil {
+		fmt.Println("Failed to read spool", err)
+		return
+	}
+	depth, age := spool.status(time.Now().UTC())
+	fmt.Printf("Reports in spool %d, oldest %v\n", depth, age)
+}
+
 // Choose randomly ports to emulate failure of port bind
 func blockPorts(ports []int, portsToSkipCount int) ([]int, []int) {
 	portsToSkip := []int{}
@@ -151,100 +321,110 @@ func blockPorts(ports []int, portsToSkipCount int) ([]int, []int) {
 	return ports, portsToSkip
 }
 
-// getTuples generates all possible combinations of collected ports and failed to bind ports 
-// If I bind all ports the getTuples returns the original ports divided into tuples  
-func getTuples(ports, failedToBind []int, tupleSize int) [][]int {
-	lastPort := -1
-	tuple := []int{}
-	for port := range ports {
-		if port > lastPort {
-			tuple = append(tuple, port)
-		} else {
-			if len(tuple) < tupleSize {
-				state := combinations.Init(append(tuple, failedToBind...), tupleSize)
-				state.Next()				
-			}
-		}
-	
-		lastPort = port
-	}	
-	return nil
-}
-
-// Send "/session?ports=...&pid=..." to the server
+// Send "/session?ports=...&pid=...&uid=..." to the server
 // I have to divide the collected ports by tuples of size knocks.tupleSize -ports in a tuple are ascending
 // If a tuple is not full I check if there are ports which I failed to bind which 
 // fall in the tuple's range and create all possible port tuples - combinations of collected ports and
-// ports I failed to bind 
-func (k *knocks) sendQueryToServer(pid int, ports []int) {
+// ports I failed to bind. The candidates are separated by semicolons
+// The query contains the identity of the knocking process and the PIDs which 
+// contributed the knocks, see process.Group.Encode(). The enrolled service adds
+// "service=ID", the server encrypts the payload of the session to the key of the
+// service, see keyring.go
+// I only add the query to the reports queue, the workers of the queue send it
+func (k *knocks) sendQueryToServer(group process.Group, candidates [][][]int) {
+	if len(candidates) == 0 {
+		fmt.Printf("No tuples for %v\n", group)
+		return
+	}
+	query := url.Values{}
+	query.Set("ports", candidatesToText(candidates))
+	group.Encode(query)
+	if k.reports.keyring != nil {
+		if serviceID := k.reports.keyring.getServiceID(); serviceID != "" {
+			query.Set("service", serviceID)
+		}
+	}
 	var text bytes.Buffer
 	text.WriteString(k.hostURL) 
-	text.WriteString("/session?ports=")
-	for _, port := range ports {
-		text.WriteString(fmt.Sprintf("%d,", port))
-	}
-	text.WriteString("&pid=")
-	text.WriteString(fmt.Sprintf("%d", pid))
+	text.WriteString("/session?")
+	text.WriteString(query.Encode())
 	
-	urlQuery := text.String()
-	response, err := http.Get(urlQuery)
-	if err == nil {
-		defer response.Body.Close()
-		text, err := ioutil.ReadAll(response.Body)
-		if err == nil {
-			fmt.Printf("Got repsonse for ulr='%s': %s\n", urlQuery, string(text))
-		}		
-	} else {
-		fmt.Println("Failed to GET", urlQuery)		
-	}	
+	k.reports.enqueue(text.String())
 }
 
-// Goroutine which periodically checks if any knocking sequences completed
-func (k *knocks) completeKnocks() {
-	k.mutex.Lock()	
-	completedKnocks := []*knockingState{}
-	for _, state := range k.state {
-		if k.isCompleted(state) {
-			completedKnocks = append(completedKnocks, state)
-		}
+func (state *knockingState) group() process.Group {
+	return process.Group{Root: state.identity, PIDs: utils.CloneSlice(state.pids)}
+}
+
+
+// Read the identity of the process if this is the first knock of the process
+// I do not want to read the /proc while holding the mutex
+func (k *knocks) readIdentity(pid int) (process.Identity, bool) {
+	k.mutex.Lock()
+	state, ok := k.state[pid]
+	known := ok && state.identity.StartTime != 0
+	k.mutex.Unlock()
+	if known {
+		return process.Identity{}, false
 	}
-	for _, state := range completedKnocks {
-		delete(k.state, state.pid)
-		k.sendQueryToServer(state.pid, state.ports)
+	identity, err := process.ReadIdentity(k.procRoot, pid)
+	if err != nil {
+		fmt.Println("Failed to read identity", err)
+		return process.Identity{}, false
 	}
-	k.mutex.Unlock()
-	time.Sleep(1 * time.Second)
+	return identity, true
 }
 
-
 // Goroutine to accept incoming connection
 func (k *knocks) handleAccept(listener net.Listener) {
 	localPort := listener.Addr().(*net.TCPAddr).Port
 	defer listener.Close()	
 	for {
 		connection, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		// For example too many open files, I do not want to spin
 		if err != nil {
 			fmt.Println("Accept failed", err)
+			time.Sleep(10 * time.Millisecond)
 			continue
 		}
 		remoteAddress := connection.RemoteAddr()
-		// TODO - make sure that remote IP is localhost
+		// Drop knocks from other hosts before I spend time on the PID lookup 
+		if !isLoopbackAddress(remoteAddress) {
+			connection.Close()
+			fmt.Println("Dropped connection from", remoteAddress)
+			continue
+		}
 		
 		// Based on https://groups.google.com/forum/#!topic/golang-nuts/JLzchxXm5Vs
 		// See also https://golang.org/ref/spec#Type_assertions
 		port := remoteAddress.(*net.TCPAddr).Port
-		pid, ok := getPID(port)
+		pid, ok := k.resolver.resolve(port, localPort)
 		connection.Close()
 		if ok {			
+			root, ok := k.grouping.group(pid)
+			if !ok {
+				root = pid
+			}
+			identity, identityOk := k.readIdentity(root)
 			k.mutex.Lock()
-			//fmt.Printf("New connection localPort=%d, remotePort=%d, pid=%d\n", localPort, port, pid)
-			state := k.addKnock(pid, localPort)
-			if k.isCompleted(state) {
+			//fmt.Printf("New connection localPort=%d, remotePort=%d, pid=%d, root=%d\n", localPort, port, pid, root)
+			state := k.addKnock(root, pid, localPort)
+			if identityOk {
+				state.identity = identity
+			}
+			completed := k.isCompleted(state)
+			if completed {
 				//fmt.Printf("Completed pid=%d\n", pid)
 				delete(k.state, state.pid)
-				k.sendQueryToServer(state.pid, state.ports)
 			}
 			k.mutex.Unlock()
+			// The state is not in the map anymore, I can read it without the mutex
+			if completed {
+				k.send(state.group(), k.getCandidates(state))
+			}
 		} else {
 			fmt.Println("Failed to recover pid for port", port)			
 		}
@@ -256,38 +436,173 @@ func main() {
 	utils.InitRand()
 	portBase := flag.Int("port_base", 21380, "Base port number")
 	portRange := flag.Int("port_range", 10, "Size of the ports range")
+	portsRanges := flag.String("ports", "", "Ports ranges, for example 21380-21389,31000-31015. Overrides port_base and port_range")
 	skipPorts := flag.Int("skip_ports", 0, "Nummber of ports to skip")
 	tolerance := flag.Int("tolerance", 20, "Percent of tolerance for port bind failures")
+	framePort := flag.Int("frame_port", 0, "Frame start port, 0 to disable")
+	resolverName := flag.String("pid_resolver", "auto", "PID resolver: proc, netstat or auto")
+	listen := flag.String("listen", "127.0.0.1,::1", "Addresses to listen, IPv4 and IPv6 loopback by default")
+	groupingName := flag.String("grouping", "browser", "Process grouping: pid, browser, pgid or sid")
+	browsers := flag.String("browsers", defaultBrowsers, "Browser executables for the browser grouping")
+	reportWorkers := flag.Int("report_workers", 2, "Number of goroutines sending the reports to the server")
+	reportQueueSize := flag.Int("report_queue", 1024, "Maximum number of reports waiting for delivery")
+	reportTimeout := flag.Duration("report_timeout", 5*time.Second, "Timeout of a single report request")
+	reportDeadline := flag.Duration("report_deadline", 30*time.Second, "Time to deliver a report before I give up")
+	spoolPath := flag.String("spool", defaultSpoolPath(), "File to keep the reports until the server confirms them, empty to disable")
+	spoolStatus := flag.Bool("spool_status", false, "Print number of reports in the spool and age of the oldest report, exit")
+	sessionLifetime := flag.Duration("session_lifetime", 10*time.Second, "Time the server keeps a session, I drop older reports")
+	rebindPeriod := flag.Duration("rebind_period", 10*time.Second, "Period of retrying the failed ports and advertising the ports to the server")
+	shutdownTimeout := flag.Duration("shutdown_timeout", 10*time.Second, "Time to deliver the pending reports when the service stops")
+	payloadConsumerName := flag.String("payload_consumer", "", "Consumer of the session payloads: exec:COMMAND, file:DIR or unix:PATH, empty to drop the payloads")
+	keyDir := flag.String("key_dir", defaultKeyDir(), "Directory of the service keys, empty to disable the enrollment and the payloads")
+	enrollmentToken := flag.String("enrollment_token", "", "Token to enroll the service with the server")
+	rotateKey := flag.Bool("rotate_key", false, "Rotate the key of the enrolled service on start")
+	keyLifetime := flag.Duration("key_lifetime", 0, "Rotate the key when the key is older, 0 to disable")
+	notify := flag.Bool("notify", true, "Notify the knocking process via the unix socket when the server matches the session")
 	host := flag.String("host", "127.0.0.1", "Server name")
 	port := flag.Int("port", 8080, "Server port")
 	flag.Parse()
+	life := lifecycle.New(*shutdownTimeout)
+	life.HandleSignals()
+	if *spoolStatus {
+		printSpoolStatus(*spoolPath)
+		return
+	}
+	portsRange, err := utils.MakePortsRange(*portsRanges, *portBase, *portRange)
+	if err != nil {
+		fmt.Println("Bad ports range", err)
+		os.Exit(1)
+	}
+	addresses, err := parseListenAddresses(*listen)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	inherited, err := systemd.Listeners()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	resolver, err := createPIDResolver(*resolverName)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	grouping, err := createProcessGrouping(*groupingName, "/proc", *browsers)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	consumer, err := createPayloadConsumer(*payloadConsumerName)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var keys *keyring
+	if *keyDir != "" {
+		keys, err = openKeyring(*keyDir)
+		if err != nil {
+			fmt.Println("Failed to open keyring", err)
+			os.Exit(1)
+		}
+		// The reports wait for the enrollment, see reports.go
+		keys.setEnrolling(*enrollmentToken != "")
+	}
+	// The server never allocates the frame start port in the tuples
+	if *framePort != 0 {
+		portsRange = utils.ExcludePort(portsRange, *framePort)
+	}
 	knocksCollection = knocks{state: make(map[int]*knockingState),
-		portsBase : *portBase,
-		portsRangeSize : *portRange,
+		portsBase : portsRange[0],
+		framePort : *framePort,
+		portsRange : portsRange,
+		portsRangeSize : len(portsRange),
 		portsToSkip : *skipPorts,
 		tolerance : *tolerance,
 		host : *host,
 		port : *port,
+		resolver : resolver,
+		grouping : grouping,
+		procRoot : "/proc",
+		clock : systemClock{},
+		wakeup : make(chan struct{}, 1),
+		reports : createReportQueue(*reportQueueSize, *reportTimeout, *reportDeadline),
+	}
+	knocksCollection.send = knocksCollection.sendQueryToServer
+	if *notify {
+		knocksCollection.reports.notify = func(url string) { notifyClients(url) }
+	}
+	knocksCollection.reports.consumer = consumer
+	knocksCollection.reports.keyring = keys
+	if *spoolPath != "" {
+		os.MkdirAll(filepath.Dir(*spoolPath), 0700)
+		spool, err := openSpool(*spoolPath)
+		if err != nil {
+			fmt.Println("Failed to open spool", err)
+			os.Exit(1)
+		}
+		knocksCollection.reports.setSpool(spool, *sessionLifetime)
 	}
 	knocksCollection.tupleSize = utils.GetTupleSize(knocksCollection.portsRangeSize)
 	ports := knocksCollection.getPortsToBind()
 	ports, portsToSkip := blockPorts(ports, knocksCollection.portsToSkip)
-	knocksCollection.listeners, knocksCollection.boundPorts, knocksCollection.failedToBind = bindPorts(ports, portsToSkip)
+	if knocksCollection.framePort != 0 {
+		ports = append(ports, knocksCollection.framePort)
+	}
+	knocksCollection.addresses = addresses
+	knocksCollection.skippedPorts = portsToSkip
+	if err := knocksCollection.bindAll(inherited, ports, portsToSkip); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if knocksCollection.framePort != 0 && utils.Contains(knocksCollection.failedToBind, knocksCollection.framePort) {
+		fmt.Println("Failed to bind frame start port", knocksCollection.framePort)
+		os.Exit(1)
+	}
 	url := &url.URL{
 		Scheme:   "http",
 		Host:     fmt.Sprintf("%s:%d", knocksCollection.host, knocksCollection.port),
 	}
 	knocksCollection.hostURL = url.String()  
+	knocksCollection.reports.start(*reportWorkers)
 	for _, listener := range knocksCollection.listeners {
 		go knocksCollection.handleAccept(listener)
 	}
 	
 	// Start a background thread to handle timeout expiration 
-	// of knock sequences
-	go knocksCollection.completeKnocks()
+	// of knock sequences, see scheduler.go
+	go knocksCollection.completeKnocks(life.Context())
+
+	// Retry the ports I failed to bind, see rebind.go
+	go knocksCollection.rebind(life.Context(), *rebindPeriod)
+
+	// Enroll the service and rotate the key, see keyring.go
+	if keys != nil {
+		go keys.maintain(life.Context(), &http.Client{Timeout: *reportTimeout}, knocksCollection.hostURL, *enrollmentToken, *rotateKey, *keyLifetime, *rebindPeriod)
+	}
 	
-	// Block the main thread, TODO turn to daemon
-	for {
-		time.Sleep(100 * time.Millisecond)
-	}		
+	// The hooks run in the reverse order: stop accepting knocks, flush
+	// the collected knocks, deliver the reports, close the spool 
+	if knocksCollection.reports.spool != nil {
+		life.OnShutdown("spool", func(ctx context.Context) error {
+			return knocksCollection.reports.spool.close()
+		})
+	}
+	life.OnShutdown("reports", knocksCollection.reports.drain)
+	life.OnShutdown("knocks", func(ctx context.Context) error {
+		fmt.Println("Flushed knock sequences", knocksCollection.flushKnocks())
+		return nil
+	})
+	life.OnShutdown("listeners", func(ctx context.Context) error {
+		systemd.Notify("STOPPING=1")
+		knocksCollection.closeListeners()
+		return nil
+	})
+	systemd.Notify(fmt.Sprintf("READY=1\nSTATUS=Listening on %d ports", len(knocksCollection.boundPorts)))
+	if timeout, ok := systemd.WatchdogTimeout(); ok {
+		go systemd.Watchdog(timeout, life.Context().Done())
+	}
+	
+	// Block the main thread until systemd or the user stops the service
+	life.Exit()
 }
@@ -0,0 +1,1576 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"port-knocking-ipc/utils"
+	"port-knocking-ipc/utils/envelope"
+	"port-knocking-ipc/utils/process"
+	"port-knocking-ipc/utils/signature"
+	"port-knocking-ipc/utils/systemd"
+)
+
+func createTestKnocks(framePort int, portsRangeSize int, tolerance int) *knocks {
+	k := &knocks{state: make(map[int]*knockingState),
+		framePort : framePort,
+		portsRange : utils.MakeRange(21380, portsRangeSize),
+		portsRangeSize : portsRangeSize,
+		tolerance : tolerance,
+		clock : systemClock{},
+		wakeup : make(chan struct{}, 1),
+	}
+	k.send = func(group process.Group, candidates [][][]int) {}
+	k.tupleSize = utils.GetTupleSize(k.portsRangeSize)
+	k.addresses = []string{"127.0.0.1"}
+	return k
+}
+
+func compareTuples(a, b [][]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !utils.Compare(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFrameStart(t *testing.T) {
+	k := createTestKnocks(21379, 4, 20)
+	pid := 1
+	// A knock before the first frame start is dropped
+	knocks := []int{21381, 21379, 21383, 21380}
+	var state *knockingState
+	for _, port := range knocks {
+		state = k.addKnock(pid, pid, port)
+		if k.isCompleted(state) {
+			t.Fatalf("Completed after port %d, frames %v\n", port, state.frames)
+		}
+	}
+	tuplesCount := utils.GetTuplesCount(k.tolerance, k.tupleSize)
+	for i := 1;i < tuplesCount;i++ {
+		state = k.addKnock(pid, pid, 21379)
+		state = k.addKnock(pid, pid, 21382)
+		state = k.addKnock(pid, pid, 21381)
+	}
+	if !k.isCompleted(state) {
+		t.Errorf("Not completed, frames %v\n", state.frames)
+	}
+	tuples := k.getKnockedTuples(state)
+	expected := [][]int{{21380, 21383}}
+	for i := 1;i < tuplesCount;i++ {
+		expected = append(expected, []int{21381, 21382})
+	}
+	if !compareTuples(tuples, expected) {
+		t.Errorf("Got %v expected %v\n", tuples, expected)
+	}
+}
+
+func TestNoFrameStart(t *testing.T) {
+	k := createTestKnocks(0, 4, 0)
+	state := k.addKnock(1, 1, 21380)
+	if k.isCompleted(state) {
+		t.Errorf("Completed after one knock\n")
+	}
+	state = k.addKnock(1, 1, 21381)
+	if !k.isCompleted(state) {
+		t.Errorf("Not completed, ports %v\n", state.ports)
+	}
+	tuples := k.getKnockedTuples(state)
+	if !compareTuples(tuples, [][]int{{21380, 21381}}) {
+		t.Errorf("Got %v\n", tuples)
+	}
+}
+
+type readmeTestSet struct {
+	failedToBind []int
+	// Sorted knocks of every candidate for every session, see README.md 
+	responses [][][]int
+}
+
+// The sessions from the README: 2-tuples of 6 ports, three tuples in a session
+var readmeSessions = [][][]int{
+	{{0,1}, {0,2}, {0,3}},
+	{{0,4}, {0,5}, {1,2}},
+	{{1,3}, {1,4}, {1,5}},
+	{{2,3}, {2,4}, {2,5}},
+	{{3,4}, {3,5}, {4,5}},
+}
+
+// Knocks the service collects if it failed to bind some ports
+func collectKnocks(session [][]int, failedToBind []int) []int {
+	ports := []int{}
+	for _, tuple := range session {
+		for _, port := range tuple {
+			if !utils.Contains(failedToBind, port) {
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports
+}
+
+// Sorted knocks of the candidates, duplicates removed
+func candidatesToKnocks(candidates [][][]int) [][]int {
+	result := [][]int{}
+	for _, candidate := range candidates {
+		knocks := []int{}
+		for _, tuple := range candidate {
+			knocks = append(knocks, tuple...)
+		}
+		sort.Ints(knocks)
+		found := false
+		for _, r := range result {
+			found = found || utils.Compare(r, knocks)
+		}
+		if !found {
+			result = append(result, knocks)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return utils.ToString(result[i], ",") < utils.ToString(result[j], ",")
+	})
+	return result
+}
+
+func containsCandidate(candidates [][][]int, tuples [][]int) bool {
+	for _, candidate := range candidates {
+		if compareTuples(candidate, tuples) {
+			return true
+		}
+	}
+	return false
+}
+
+// Examples A and B from the README
+func TestReadmeExamples(t *testing.T) {
+	testSets := []readmeTestSet {
+		// A failed to bind port 0
+		{[]int{0}, [][][]int{
+			{{0,0,0,1,2,3}},
+			{{0,0,1,2,4,5}},
+			{{1,1,1,3,4,5}},
+			{{2,2,2,3,4,5}},
+			{{3,3,4,4,5,5}},
+		}},
+		// B failed to bind port 1
+		{[]int{1}, [][][]int{
+			{{0,0,0,1,2,3}},
+			{{0,0,1,2,4,5}},
+			{{1,1,1,3,4,5}},
+			{{2,2,2,3,4,5}},
+			{{3,3,4,4,5,5}},
+		}},
+		// B failed to bind ports 0 and 1
+		{[]int{0,1}, [][][]int{
+			{{0,0,0,1,2,3}, {0,0,1,1,2,3}, {0,1,1,1,2,3}},
+			{{0,0,0,2,4,5}, {0,0,1,2,4,5}, {0,1,1,2,4,5}, {1,1,1,2,4,5}},
+			{{0,0,0,3,4,5}, {0,0,1,3,4,5}, {0,1,1,3,4,5}, {1,1,1,3,4,5}},
+			{{2,2,2,3,4,5}},
+			{{3,3,4,4,5,5}},
+		}},
+	}
+	for testIndex, testSet := range testSets {
+		for sessionIndex, session := range readmeSessions {
+			ports := collectKnocks(session, testSet.failedToBind)
+			candidates, _ := getTuples(ports, testSet.failedToBind, 2, 3)
+			if !containsCandidate(candidates, session) {
+				t.Errorf("Session %v is not in the candidates %v, test %d\n", session, candidates, testIndex)
+			}
+			knocks := candidatesToKnocks(candidates)
+			if !compareTuples(knocks, testSet.responses[sessionIndex]) {
+				t.Errorf("Got %v expected %v for session %v, test %d\n", knocks, testSet.responses[sessionIndex], session, testIndex)
+			}
+		}
+	}
+}
+
+// Pairs like (0,0) are ruled out
+func TestNoDuplicatePairs(t *testing.T) {
+	candidates, _ := getTuples([]int{2,3}, []int{0,1}, 2, 3)
+	for _, candidate := range candidates {
+		for _, tuple := range candidate {
+			if tuple[0] >= tuple[1] {
+				t.Errorf("Got tuple %v in candidate %v\n", tuple, candidate)
+			}
+		}
+		if hasDuplicateTuples(candidate) {
+			t.Errorf("Got duplicate tuples in candidate %v\n", candidate)
+		}
+	}
+}
+
+// Random session of 'tuplesCount' tuples of 'tupleSize' ascending ports in [0, rangeSize)
+func randomSession(r *rand.Rand, rangeSize, tupleSize, tuplesCount int) [][]int {
+	session := [][]int{}
+	for i := 0;i < tuplesCount;i++ {
+		tuple := r.Perm(rangeSize)[:tupleSize]
+		sort.Ints(tuple)
+		session = append(session, tuple)
+	}
+	return session
+}
+
+// The search on a large ports range with many failed ports is bounded
+func TestLargeRangeTuples(t *testing.T) {
+	testSets := []struct {
+		rangeSize int
+		failed    int
+	}{
+		{40, 8},
+		{50, 10},
+		{100, 20},
+		{200, 40},
+	}
+	r := rand.New(rand.NewSource(1))
+	for _, testSet := range testSets {
+		tupleSize := utils.GetTupleSize(testSet.rangeSize)
+		tuplesCount := utils.GetTuplesCount(20, tupleSize)
+		failedToBind := r.Perm(testSet.rangeSize)[:testSet.failed]
+		session := randomSession(r, testSet.rangeSize, tupleSize, tuplesCount)
+		start := time.Now()
+		candidates, err := getTuples(collectKnocks(session, failedToBind), failedToBind, tupleSize, tuplesCount)
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Search took %v for %+v\n", elapsed, testSet)
+		}
+		if err != nil && err != errTooManyTuplesNodes {
+			t.Errorf("Got %v for %+v\n", err, testSet)
+		}
+		if err == nil && len(candidates) == 0 {
+			t.Errorf("No candidates for %+v\n", testSet)
+		}
+	}
+	// Collected knocks which do not fit the tuples are pruned right away
+	b := tuplesBuilder{ports: utils.MakeRange(0, 30), failedToBind: utils.MakeRange(30, 10), tupleSize: 10, tuplesCount: 2,
+		tuples: [][]int{}, tuple: []int{}, candidates: [][][]int{}}
+	b.build(0)
+	if len(b.candidates) != 0 || b.nodes != 1 {
+		t.Errorf("Got %d candidates after %d nodes\n", len(b.candidates), b.nodes)
+	}
+}
+
+func TestFramesTuples(t *testing.T) {
+	candidates, _ := getFramesTuples([][]int{{0,3}, {2}}, []int{1}, 3)
+	if len(candidates) != 0 {
+		t.Errorf("Got %v for short frames\n", candidates)
+	}
+	candidates, _ = getFramesTuples([][]int{{0,3}, {2,4}}, []int{1}, 3)
+	if len(candidates) != 1 || !compareTuples(candidates[0], [][]int{{0,1,3}, {1,2,4}}) {
+		t.Errorf("Got %v\n", candidates)
+	}
+}
+
+func TestCandidatesToText(t *testing.T) {
+	candidates, _ := getTuples([]int{3}, []int{1,2}, 2, 1)
+	text := candidatesToText(candidates)
+	if text != "1,3,;2,3," {
+		t.Errorf("Got text %s\n", text)
+	}
+}
+
+// Create a fixture /proc tree
+// net/tcp contains the client socket 127.0.0.1:36518->127.0.0.1:21380, inode 1001
+// net/tcp6 contains the client socket [::1]:36519->[::1]:21381, inode 1002
+// process 100 owns inode 1001, process 200 owns inode 1002
+func createProcFixture(t *testing.T) string {
+	root, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:5384 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 999 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:8EA6 0100007F:5384 01 00000000:00000000 00:00000000 00000000  1000        0 1001 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:5384 0100007F:8EA6 01 00000000:00000000 00:00000000 00000000  1000        0 1000 1 0000000000000000 20 4 30 10 -1
+`
+	tcp6 := `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000001000000:8EA7 00000000000000000000000001000000:5385 01 00000000:00000000 00:00000000 00000000  1000        0 1002 1 0000000000000000 20 4 30 10 -1
+`
+	files := map[string]string{"net/tcp": tcp, "net/tcp6": tcp6}
+	for name, text := range files {
+		os.MkdirAll(filepath.Join(root, "net"), 0700)
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"100/fd/0": "/dev/null",
+		"100/fd/7": "socket:[1001]",
+		"200/fd/3": "socket:[1002]",
+		"300/fd/3": "socket:[1000]",
+	}
+	for name, target := range links {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestProcResolver(t *testing.T) {
+	root := createProcFixture(t)
+	defer os.RemoveAll(root)
+	r := createProcResolver(root)
+	if pid, ok := r.resolve(36518, 21380); !ok || pid != 100 {
+		t.Errorf("Got pid %d, %t expected 100\n", pid, ok)
+	}
+	// IPv6
+	if pid, ok := r.resolve(36519, 21381); !ok || pid != 200 {
+		t.Errorf("Got pid %d, %t expected 200\n", pid, ok)
+	}
+	if pid, ok := r.resolve(36520, 21380); ok {
+		t.Errorf("Got pid %d for unknown port\n", pid)
+	}
+	// The cache is validated: the socket moves to another process
+	os.Remove(filepath.Join(root, "100/fd/7"))
+	os.MkdirAll(filepath.Join(root, "400/fd"), 0700)
+	os.Symlink("socket:[1001]", filepath.Join(root, "400/fd/5"))
+	if pid, ok := r.resolve(36518, 21380); !ok || pid != 400 {
+		t.Errorf("Got pid %d, %t expected 400\n", pid, ok)
+	}
+}
+
+type fakeResolver struct {
+	pid int
+	ok bool
+}
+
+func (r *fakeResolver) resolve(clientPort, servicePort int) (int, bool) {
+	return r.pid, r.ok
+}
+
+func TestFallbackResolver(t *testing.T) {
+	r := &fallbackResolver{[]pidResolver{&fakeResolver{0, false}, &fakeResolver{7, true}}}
+	if pid, ok := r.resolve(1, 2); !ok || pid != 7 {
+		t.Errorf("Got pid %d, %t expected 7\n", pid, ok)
+	}
+	if _, err := createPIDResolver("lsof"); err == nil {
+		t.Errorf("Expected error for unknown resolver\n")
+	}
+}
+
+// Create a fixture /proc tree with a process chain 
+// 1 (systemd) -> 500 (bash) -> 600 (chrome) -> 610 (chrome) -> 620 (chrome)
+// 700 (Web Content, firefox executable) <- 690 (firefox) <- 500 
+func createProcessesFixture(t *testing.T) string {
+	root, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	processes := []struct {
+		pid int
+		command string
+		ppid int
+		pgid int
+		executable string
+	}{
+		{1, "systemd", 0, 1, "/usr/lib/systemd/systemd"},
+		{500, "bash", 1, 500, "/usr/bin/bash"},
+		{600, "chrome", 500, 600, "/opt/google/chrome/chrome"},
+		{610, "chrome", 600, 600, "/opt/google/chrome/chrome"},
+		{620, "chrome", 610, 600, "/opt/google/chrome/chrome"},
+		{690, "firefox", 500, 690, "/usr/lib/firefox/firefox"},
+		{700, "Web Content", 690, 690, "/usr/lib/firefox/firefox"},
+	}
+	for _, p := range processes {
+		dir := filepath.Join(root, fmt.Sprint(p.pid))
+		os.MkdirAll(dir, 0700)
+		stat := fmt.Sprintf("%d (%s) S %d %d %d 0 -1 0 0 0 0 0 0 0 0 0 20 0 1 0 %d 0 0\n", p.pid, p.command, p.ppid, p.pgid, 500, 1000+p.pid)
+		ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0600)
+		os.Symlink(p.executable, filepath.Join(dir, "exe"))
+	}
+	return root
+}
+
+func TestProcessGrouping(t *testing.T) {
+	root := createProcessesFixture(t)
+	defer os.RemoveAll(root)
+	testSets := []struct {
+		grouping string
+		pid int
+		root int
+	}{
+		{"pid", 620, 620},
+		{"browser", 620, 600},
+		{"browser", 610, 600},
+		{"browser", 700, 690},
+		{"browser", 500, 500},
+		{"pgid", 620, 600},
+		{"pgid", 700, 690},
+		{"sid", 700, 500},
+	}
+	for testIndex, testSet := range testSets {
+		grouping, err := createProcessGrouping(testSet.grouping, root, defaultBrowsers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		group, ok := grouping.group(testSet.pid)
+		if !ok || group != testSet.root {
+			t.Errorf("Got %d, %t expected %d for test %d\n", group, ok, testSet.root, testIndex)
+		}
+	}
+	if _, err := createProcessGrouping("uid", root, defaultBrowsers); err == nil {
+		t.Errorf("Expected error for unknown grouping\n")
+	}
+}
+
+// Knocks from different processes of the same group form one sequence
+func TestGroupKnocks(t *testing.T) {
+	k := createTestKnocks(0, 4, 0)
+	k.addKnock(600, 610, 21380)
+	state := k.addKnock(600, 620, 21381)
+	if !k.isCompleted(state) || len(k.state) != 1 {
+		t.Errorf("Got state %v\n", k.state)
+	}
+	group := state.group()
+	if group.Root.PID != 600 || !utils.Compare(group.PIDs, []int{610, 620}) {
+		t.Errorf("Got group %v\n", group)
+	}
+}
+
+func TestLoopbackAddress(t *testing.T) {
+	testSets := []struct {
+		ip string
+		loopback bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"192.168.1.10", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+	}
+	for _, testSet := range testSets {
+		address := &net.TCPAddr{IP: net.ParseIP(testSet.ip), Port: 36518}
+		if isLoopbackAddress(address) != testSet.loopback {
+			t.Errorf("Got %t for %s\n", !testSet.loopback, testSet.ip)
+		}
+	}
+	addresses, err := parseListenAddresses("127.0.0.1, [::1]")
+	if err != nil || len(addresses) != 2 || addresses[1] != "::1" {
+		t.Errorf("Got %v, %v\n", addresses, err)
+	}
+	if _, err := parseListenAddresses("localhost"); err == nil {
+		t.Errorf("Expected error for a host name\n")
+	}
+}
+
+// IPv4 and IPv6 knocks of the same process reach the same port
+func TestBindLoopback(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	listeners, boundPorts, failedToBind, _ := bindPorts([]string{"127.0.0.1", "::1"}, []int{port}, []int{})
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+	if !utils.Compare(boundPorts, []int{port}) || len(failedToBind) != 0 {
+		t.Fatalf("Got bound %v, failed %v\n", boundPorts, failedToBind)
+	}
+	for _, listener := range listeners {
+		address := listener.Addr().(*net.TCPAddr)
+		if !address.IP.IsLoopback() || address.Port != port {
+			t.Errorf("Listening on %v\n", address)
+		}
+	}
+}
+
+// fakeClock moves only when the test calls advance()
+type fakeClock struct {
+	mutex sync.Mutex
+	now time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	c chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := fakeTimer{c.now.Add(d), make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+	} else {
+		c.timers = append(c.timers, timer)
+	}
+	return timer.c
+}
+
+func (c *fakeClock) pendingTimers() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.timers)
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	timers := []fakeTimer{}
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			timers = append(timers, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = timers
+}
+
+func TestExpireKnocks(t *testing.T) {
+	k := createTestKnocks(0, 10, 20)
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	k.clock = clock
+	start := clock.Now()
+	k.addKnock(1, 1, 21380)
+	k.addKnock(2, 2, 21380)
+	k.addKnock(3, 3, 21380)
+	clock.advance(3*time.Second)
+	// The second knock extends the sequence of 1
+	k.addKnock(1, 1, 21381)
+	// The accept handler completes the sequence of 3 
+	delete(k.state, 3)
+	testSets := []struct {
+		now time.Duration
+		expected []int
+	}{
+		{4*time.Second, []int{}},
+		{5*time.Second, []int{2}},
+		{5*time.Second, []int{}},
+		{7*time.Second, []int{}},
+		{8*time.Second, []int{1}},
+		{20*time.Second, []int{}},
+	}
+	for _, testSet := range testSets {
+		pids := []int{}
+		for _, state := range k.expireKnocks(start.Add(testSet.now)) {
+			pids = append(pids, state.pid)
+		}
+		if !utils.Compare(pids, testSet.expected) {
+			t.Errorf("At %v got %v, expected %v\n", testSet.now, pids, testSet.expected)
+		}
+	}
+	if len(k.state) != 0 || k.expirations.Len() != 0 {
+		t.Errorf("Left %v, %d entries\n", k.state, k.expirations.Len())
+	}
+	if _, ok := k.nextExpiration(start); ok {
+		t.Errorf("Nothing to expire\n")
+	}
+}
+
+// The scheduler flushes every sequence once and keeps running
+func TestCompleteKnocks(t *testing.T) {
+	k := createTestKnocks(0, 10, 20)
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	k.clock = clock
+	sent := make(chan process.Group, 10)
+	k.send = func(group process.Group, candidates [][][]int) {
+		sent <- group
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go k.completeKnocks(ctx)
+	waitTimer := func() {
+		for i := 0;clock.pendingTimers() == 0;i++ {
+			if i > 1000 {
+				t.Fatalf("Scheduler does not wait\n")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for _, pid := range []int{10, 20} {
+		k.mutex.Lock()
+		k.addKnock(pid, pid, 21380)
+		k.mutex.Unlock()
+		waitTimer()
+		clock.advance(4*time.Second)
+		select {
+		case group := <-sent:
+			t.Fatalf("Early flush of %v\n", group)
+		case <-time.After(10*time.Millisecond):
+		}
+		clock.advance(time.Second)
+		select {
+		case group := <-sent:
+			if group.Root.PID != pid {
+				t.Errorf("Flushed %d, expected %d\n", group.Root.PID, pid)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Sequence %d is not flushed\n", pid)
+		}
+	}
+	select {
+	case group := <-sent:
+		t.Errorf("Second flush of %v\n", group)
+	case <-time.After(10*time.Millisecond):
+	}
+}
+
+func createTestReportQueue(size int, deadline time.Duration) *reportQueue {
+	q := createReportQueue(size, time.Second, deadline)
+	q.backoffMin = time.Millisecond
+	q.backoffMax = 4*time.Millisecond
+	return q
+}
+
+// Wait until the condition is true or a second passed 
+func waitReports(q *reportQueue, condition func(s reportStatistics) bool) (reportStatistics, bool) {
+	for i := 0;i < 1000;i++ {
+		statistics := q.getStatistics()
+		if condition(statistics) {
+			return statistics, true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return q.getStatistics(), false
+}
+
+func TestReportQueueRetry(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		requests++
+		failed := requests <= 2
+		mutex.Unlock()
+		if failed {
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	q := createTestReportQueue(4, 5*time.Second)
+	q.start(1)
+	if !q.enqueue(server.URL + "/session?ports=21380,21381,") {
+		t.Fatalf("Failed to enqueue\n")
+	}
+	statistics, ok := waitReports(q, func(s reportStatistics) bool { return s.Delivered == 1 })
+	if !ok || statistics.Retried != 2 || statistics.Expired != 0 {
+		t.Errorf("Got %+v\n", statistics)
+	}
+	mutex.Lock()
+	if requests != 3 {
+		t.Errorf("Got %d requests\n", requests)
+	}
+	mutex.Unlock()
+}
+
+func TestReportQueueExpired(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	q := createTestReportQueue(4, 50*time.Millisecond)
+	q.start(2)
+	q.enqueue(server.URL + "/session")
+	statistics, ok := waitReports(q, func(s reportStatistics) bool { return s.Expired == 1 })
+	if !ok || statistics.Delivered != 0 || statistics.Retried == 0 {
+		t.Errorf("Got %+v\n", statistics)
+	}
+	// The server is not listening
+	server.Close()
+	q.enqueue(server.URL + "/session")
+	statistics, ok = waitReports(q, func(s reportStatistics) bool { return s.Expired == 2 })
+	if !ok {
+		t.Errorf("Got %+v\n", statistics)
+	}
+}
+
+// The queue never blocks the caller
+func TestReportQueueFull(t *testing.T) {
+	q := createTestReportQueue(2, time.Second)
+	expected := []bool{true, true, false, false}
+	for i, ok := range expected {
+		if q.enqueue(fmt.Sprintf("http://127.0.0.1:1/session?%d", i)) != ok {
+			t.Errorf("Enqueue %d, expected %t\n", i, ok)
+		}
+	}
+	statistics := q.getStatistics()
+	if statistics.Queued != 2 || statistics.Dropped != 2 {
+		t.Errorf("Got %+v\n", statistics)
+	}
+}
+
+func TestReportBackoff(t *testing.T) {
+	q := createTestReportQueue(1, time.Second)
+	testSets := []struct {
+		attempts int
+		max time.Duration
+	}{
+		{1, time.Millisecond},
+		{2, 2*time.Millisecond},
+		{3, 4*time.Millisecond},
+		{10, 4*time.Millisecond},
+	}
+	for _, testSet := range testSets {
+		for i := 0;i < 100;i++ {
+			delay := q.backoff(testSet.attempts)
+			if delay < q.backoffMin || delay > testSet.max {
+				t.Fatalf("Attempt %d, delay %v\n", testSet.attempts, delay)
+			}
+		}
+	}
+}
+
+func TestSendQueryToServer(t *testing.T) {
+	k := createTestKnocks(0, 4, 20)
+	k.hostURL = "http://127.0.0.1:8080"
+	k.reports = createTestReportQueue(2, time.Second)
+	group := process.Group{Root: process.Identity{PID: 600}, PIDs: []int{600, 610}}
+	k.sendQueryToServer(group, [][][]int{{{21380, 21381}}})
+	k.sendQueryToServer(group, [][][]int{})
+	if len(k.reports.reports) != 1 {
+		t.Fatalf("Got %d reports\n", len(k.reports.reports))
+	}
+	r := <-k.reports.reports
+	if !strings.HasPrefix(r.url, "http://127.0.0.1:8080/session?") || !strings.Contains(r.url, "pid=600") || strings.Contains(r.url, "service=") {
+		t.Errorf("Got %s\n", r.url)
+	}
+	// The enrolled service adds the service ID
+	k.reports.keyring, _ = openKeyring(filepath.Join(t.TempDir(), "keys"))
+	k.reports.keyring.setEnrollment("a1b2", "secret")
+	k.sendQueryToServer(group, [][][]int{{{21380, 21381}}})
+	if r := <-k.reports.reports; !strings.Contains(r.url, "service=a1b2") {
+		t.Errorf("Got %s\n", r.url)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reports.spool")
+	s, err := openSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0;i < 3;i++ {
+		created := now.Add(time.Duration(i)*time.Second)
+		if _, err := s.add(fmt.Sprintf("http://127.0.0.1:8080/session?ports=%d", i), created, created.Add(10*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.remove(2)
+	s.close()
+	// A torn record written before a crash
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString("1234abcd add 4 1")
+	file.Close()
+
+	s, err = openSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	depth, age := s.status(now.Add(5*time.Second))
+	if depth != 2 || age != 5*time.Second {
+		t.Errorf("Got depth %d, age %v\n", depth, age)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if strings.Count(string(data), "\n") != 2 || strings.Contains(string(data), "del") {
+		t.Errorf("Not compacted %s\n", string(data))
+	}
+	// The IDs continue after the restart
+	entry, _ := s.add("http://127.0.0.1:8080/session?ports=4", now.Add(3*time.Second), now.Add(13*time.Second))
+	if entry.id != 4 {
+		t.Errorf("Got ID %d\n", entry.id)
+	}
+	testSets := []struct {
+		now time.Duration
+		expected []uint64
+		depth int
+	}{
+		// The entry 4 is in flight
+		{1*time.Second, []uint64{1, 3}, 3},
+		// The entry 3 is released
+		{2*time.Second, []uint64{3}, 3},
+		// Expired entries are dropped unless in flight
+		{12500*time.Millisecond, []uint64{}, 2},
+	}
+	for _, testSet := range testSets {
+		ids := []uint64{}
+		for _, entry := range s.pending(now.Add(testSet.now)) {
+			ids = append(ids, entry.id)
+		}
+		depth, _ := s.status(now)
+		if fmt.Sprint(ids) != fmt.Sprint(testSet.expected) || depth != testSet.depth {
+			t.Errorf("At %v got %v, depth %d\n", testSet.now, ids, depth)
+		}
+		s.release(3)
+	}
+	// Compaction keeps the file small
+	for i := 0;i < 200;i++ {
+		entry, _ := s.add("http://127.0.0.1:8080/session", now, now.Add(time.Minute))
+		s.remove(entry.id)
+	}
+	if s.records > 2*len(s.entries) + 64 {
+		t.Errorf("Got %d records\n", s.records)
+	}
+	s.close()
+	s, err = loadSpool(path)
+	if err != nil || len(s.entries) != 2 {
+		t.Errorf("Got %v, %v\n", s.entries, err)
+	}
+}
+
+// The spooled report survives the server outage and the restart of the service
+func TestReportQueueSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reports.spool")
+	var mutex sync.Mutex
+	down := true
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if down {
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	setDown := func(value bool) {
+		mutex.Lock()
+		down = value
+		mutex.Unlock()
+	}
+
+	s, err := openSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := createTestReportQueue(4, 20*time.Millisecond)
+	q.setSpool(s, time.Minute)
+	q.replayPeriod = time.Hour
+	q.start(1)
+	q.enqueue(server.URL + "/session?ports=1")
+	statistics, ok := waitReports(q, func(s reportStatistics) bool { return s.Expired == 1 })
+	if depth, _ := s.status(time.Now()); !ok || depth != 1 {
+		t.Fatalf("Got %+v, depth %d\n", statistics, depth)
+	}
+	s.close()
+
+	// Restart
+	setDown(false)
+	s, err = openSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q = createTestReportQueue(4, 20*time.Millisecond)
+	q.setSpool(s, time.Minute)
+	q.replayPeriod = time.Hour
+	q.start(1)
+	statistics, ok = waitReports(q, func(s reportStatistics) bool { return s.Delivered == 1 })
+	if depth, _ := s.status(time.Now()); !ok || depth != 0 || statistics.Replayed != 1 {
+		t.Fatalf("Got %+v, depth %d\n", statistics, depth)
+	}
+
+	// The network returns, successful delivery triggers the replay
+	setDown(true)
+	q.enqueue(server.URL + "/session?ports=2")
+	waitReports(q, func(s reportStatistics) bool { return s.Expired == 1 })
+	setDown(false)
+	q.enqueue(server.URL + "/session?ports=3")
+	statistics, ok = waitReports(q, func(s reportStatistics) bool { return s.Delivered == 3 })
+	if depth, _ := s.status(time.Now()); !ok || depth != 0 {
+		t.Errorf("Got %+v, depth %d\n", statistics, depth)
+	}
+}
+
+// The service binds the port when the conflicting program exits
+func TestRebindPorts(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := busy.Addr().(*net.TCPAddr).Port
+	skipped, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	skippedPort := skipped.Addr().(*net.TCPAddr).Port
+	skipped.Close()
+	k := createTestKnocks(0, 4, 20)
+	k.skippedPorts = []int{skippedPort}
+	k.listeners, k.boundPorts, k.failedToBind, k.missingAddresses = bindPorts(k.addresses, []int{port}, []int{skippedPort})
+	if !utils.Compare(k.failedToBind, []int{port, skippedPort}) {
+		t.Fatalf("Got failed %v\n", k.failedToBind)
+	}
+	k.addKnock(1, 1, 21380)
+	if listeners := k.rebindPorts(); len(listeners) != 0 {
+		t.Fatalf("Bound busy port %v\n", listeners)
+	}
+	busy.Close()
+	listeners := k.rebindPorts()
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+	boundPorts, failedToBind := k.getPorts()
+	if len(listeners) != 1 || !utils.Compare(boundPorts, []int{port}) || !utils.Compare(failedToBind, []int{skippedPort}) {
+		t.Errorf("Got %d listeners, bound %v, failed %v\n", len(listeners), boundPorts, failedToBind)
+	}
+	// The sequence started when the port failed
+	if !utils.Contains(k.state[1].failedToBind, port) {
+		t.Errorf("Got %v\n", k.state[1].failedToBind)
+	}
+}
+
+// The port is bound only if the address which the clients knock is bound
+// I retry the missing addresses of the bound ports too
+func TestRebindAddresses(t *testing.T) {
+	busyKnock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	knockPort := busyKnock.Addr().(*net.TCPAddr).Port
+	busyOther, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("No 127.0.0.2", err)
+	}
+	otherPort := busyOther.Addr().(*net.TCPAddr).Port
+	k := createTestKnocks(0, 4, 20)
+	k.addresses = []string{"127.0.0.2", "127.0.0.1"}
+	k.listeners, k.boundPorts, k.failedToBind, k.missingAddresses = bindPorts(k.addresses, []int{knockPort, otherPort}, []int{})
+	defer k.closeListeners()
+	if !utils.Compare(k.boundPorts, []int{otherPort}) || !utils.Compare(k.failedToBind, []int{knockPort}) || len(k.listeners) != 2 {
+		t.Fatalf("Got bound %v, failed %v, listeners %d\n", k.boundPorts, k.failedToBind, len(k.listeners))
+	}
+	busyKnock.Close()
+	busyOther.Close()
+	listeners := k.rebindPorts()
+	boundPorts, failedToBind := k.getPorts()
+	expected := []int{knockPort, otherPort}
+	sort.Ints(expected)
+	if len(listeners) != 2 || !utils.Compare(boundPorts, expected) || len(failedToBind) != 0 || len(k.getMissingAddresses()) != 0 {
+		t.Errorf("Got %d listeners, bound %v, failed %v, missing %v\n", len(listeners), boundPorts, failedToBind, k.getMissingAddresses())
+	}
+}
+
+func TestAdvertisePorts(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		query = request.URL.Path + "?" + request.URL.RawQuery
+	}))
+	defer server.Close()
+	k := createTestKnocks(0, 4, 20)
+	k.hostURL = server.URL
+	k.boundPorts = []int{21380, 21381}
+	k.failedToBind = []int{21382}
+	if err := k.advertisePorts(&http.Client{}); err != nil {
+		t.Fatal(err)
+	}
+	if query != "/ports?bound=21380%2C21381%2C&failed=21382%2C" {
+		t.Errorf("Got %s\n", query)
+	}
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// A socket which is not on the loopback never gets a knock, I refuse to start
+func TestAdoptNonLoopback(t *testing.T) {
+	listener, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loopback, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	inherited := []systemd.Listener{{Listener: loopback, Name: "knock"}, {Listener: listener, Name: "any"}}
+	k := createTestKnocks(0, 4, 20)
+	err = k.bindAll(inherited, []int{port, loopback.Addr().(*net.TCPAddr).Port}, []int{})
+	if err == nil || !strings.Contains(err.Error(), "loopback") || len(k.listeners) != 0 {
+		t.Fatalf("Got %v, listeners %d\n", err, len(k.listeners))
+	}
+	// I closed the sockets
+	for _, l := range []net.Listener{listener, loopback} {
+		if _, err := l.Accept(); err == nil {
+			t.Errorf("Socket %v is not closed\n", l.Addr())
+		}
+	}
+}
+
+// The sockets passed by systemd and clean shutdown
+func TestBindAll(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	freePort := freePort(t)
+	inherited := []systemd.Listener{{Listener: listener, Name: "knock"}, {Listener: other, Name: "other"}}
+	k := createTestKnocks(0, 4, 20)
+	if err := k.bindAll(inherited, []int{port, freePort}, []int{}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{port, freePort}
+	sort.Ints(expected)
+	boundPorts, failedToBind := k.getPorts()
+	if !utils.Compare(boundPorts, expected) || len(failedToBind) != 0 || len(k.listeners) != 2 {
+		t.Fatalf("Got bound %v, failed %v, listeners %d\n", boundPorts, failedToBind, len(k.listeners))
+	}
+	// The port is not in the range
+	if _, err := other.Accept(); err == nil {
+		t.Errorf("Socket is not closed\n")
+	}
+	done := make(chan struct{})
+	for _, listener := range k.listeners {
+		go func(listener net.Listener) {
+			k.handleAccept(listener)
+			done <- struct{}{}
+		}(listener)
+	}
+	k.closeListeners()
+	for i := 0;i < 2;i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("handleAccept did not exit\n")
+		}
+	}
+	if listeners := k.rebindPorts(); len(listeners) != 0 {
+		t.Errorf("Bound after shutdown\n")
+	}
+}
+
+// The service flushes the collected knocks and drains the reports when it stops
+func TestShutdown(t *testing.T) {
+	var mutex sync.Mutex
+	queries := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		queries = append(queries, request.URL.Query().Get("pid"))
+		mutex.Unlock()
+	}))
+	defer server.Close()
+	k := createTestKnocks(0, 10, 20)
+	k.hostURL = server.URL
+	k.reports = createTestReportQueue(4, time.Second)
+	// The partial sequence can not be divided to tuples
+	k.send = func(group process.Group, candidates [][][]int) {
+		k.sendQueryToServer(group, [][][]int{{{21380, 21381}}})
+	}
+	k.reports.start(1)
+	k.addKnock(600, 600, 21380)
+	k.addKnock(600, 600, 21381)
+	if flushed := k.flushKnocks(); flushed != 1 || len(k.state) != 0 || k.expirations.Len() != 0 {
+		t.Fatalf("Flushed %d, left %d\n", flushed, len(k.state))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := k.reports.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	if len(queries) != 1 || queries[0] != "600" {
+		t.Errorf("Got %v\n", queries)
+	}
+	mutex.Unlock()
+
+	// The server is down, the shutdown timeout aborts the delivery
+	server.Close()
+	k.reports = createTestReportQueue(4, time.Minute)
+	k.reports.start(1)
+	k.reports.enqueue(server.URL + "/session")
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := k.reports.drain(ctx); err == nil {
+		t.Errorf("Drained undelivered report\n")
+	}
+}
+
+// The server rejects the report, I do not retry
+func TestReportQueueRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Accept") != "application/json" {
+			response.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		response.WriteHeader(http.StatusGone)
+		fmt.Fprint(response, `{"version":1,"status":"expired","message":"Session expired"}`)
+	}))
+	defer server.Close()
+	q := createTestReportQueue(4, 5*time.Second)
+	q.start(1)
+	q.enqueue(server.URL + "/session?ports=21380,21381,")
+	statistics, ok := waitReports(q, func(s reportStatistics) bool { return s.Failed == 1 })
+	if !ok || statistics.Retried != 0 || statistics.Delivered != 0 {
+		t.Errorf("Got %+v\n", statistics)
+	}
+}
+
+// The client listens on the socket, the service writes "matched" when the server
+// matches the session
+func TestNotifyClients(t *testing.T) {
+	if _, err := utils.CreateRuntimeDir(); err != nil {
+		t.Fatal(err)
+	}
+	pid := os.Getpid()
+	listener, err := net.Listen("unix", utils.GetSocketFilename(os.Getuid(), pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text, _ := ioutil.ReadAll(conn)
+		received <- string(text)
+	}()
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		fmt.Fprint(response, `{"version":1,"status":"matched","message":""}`)
+	}))
+	defer server.Close()
+	q := createTestReportQueue(4, 5*time.Second)
+	notified := make(chan int, 1)
+	q.notify = func(url string) { notified <- notifyClients(url) }
+	q.start(1)
+	query := url.Values{}
+	// The process 1 does not listen
+	process.Group{Root: process.Identity{PID: pid, RealUID: os.Getuid()}, PIDs: []int{1, pid}}.Encode(query)
+	q.enqueue(server.URL + "/session?ports=21380,21381,&" + query.Encode())
+	select {
+	case count := <-notified:
+		if count != 1 {
+			t.Errorf("Notified %d processes\n", count)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No notification\n")
+	}
+	if text := <-received; text != "matched\n" {
+		t.Errorf("Got '%s'\n", text)
+	}
+}
+
+func TestPayloadConsumers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, specification := range []string{"", "exec", "file:", "ftp:/tmp"} {
+		consumer, err := createPayloadConsumer(specification)
+		if (specification == "") != (err == nil && consumer == nil) {
+			t.Errorf("Got %v %v for '%s'\n", consumer, err, specification)
+		}
+	}
+	message := payloadMessage{Session: 7, PID: 1234, UID: 1000, Payload: []byte("secret key")}
+	// file
+	consumer, err := createPayloadConsumer("file:" + filepath.Join(dir, "payloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.consume(message); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "payloads", "payload_7")
+	if data, err := ioutil.ReadFile(filename); err != nil || string(data) != "secret key" {
+		t.Errorf("Got '%s' %v\n", data, err)
+	}
+	if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Got mode %v %v\n", info.Mode().Perm(), err)
+	}
+	if err := consumer.consume(message); err == nil {
+		t.Errorf("Overwrote %s\n", filename)
+	}
+	// exec
+	output := filepath.Join(dir, "exec")
+	script := filepath.Join(dir, "consumer.sh")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\n(echo $KNOCK_SESSION $KNOCK_PID $KNOCK_UID;cat) > "+output+"\n"), 0700)
+	consumer, _ = createPayloadConsumer("exec:" + script)
+	if err := consumer.consume(message); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(output); err != nil || string(data) != "7 1234 1000\nsecret key" {
+		t.Errorf("Got '%s' %v\n", data, err)
+	}
+	// unix
+	socketPath := filepath.Join(dir, "consumer.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan payloadMessage, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var message payloadMessage
+		json.NewDecoder(conn).Decode(&message)
+		received <- message
+	}()
+	consumer, _ = createPayloadConsumer("unix:" + socketPath)
+	if err := consumer.consume(message); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got.Session != 7 || got.PID != 1234 || string(got.Payload) != "secret key" {
+		t.Errorf("Got %+v\n", got)
+	}
+}
+
+// The server sends the encrypted payload of the matched session, the queue decrypts
+// the payload and hands it to the consumer
+func TestReportQueuePayload(t *testing.T) {
+	keys, err := openKeyring(filepath.Join(t.TempDir(), "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.setEnrollment("a1b2", "secret")
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		sealed, _ := envelope.Seal(keys.publicKey(keys.getCurrent()), []byte("secret key"), envelope.AssociatedData("a1b2", 7))
+		json.NewEncoder(response).Encode(map[string]interface{}{"version": 1, "status": "matched", "sessions": []uint32{7}, "service": "a1b2", "payload": sealed})
+	}))
+	defer server.Close()
+	consumed := make(chan payloadMessage, 2)
+	q := createTestReportQueue(4, 5*time.Second)
+	q.consumer = &testConsumer{consumed}
+	q.keyring = keys
+	q.start(1)
+	query := url.Values{}
+	process.Group{Root: process.Identity{PID: 1234, RealUID: 1000}, PIDs: []int{1234}}.Encode(query)
+	q.enqueue(server.URL + "/session?ports=21380,21381,&" + query.Encode())
+	statistics, ok := waitReports(q, func(s reportStatistics) bool { return s.Payloads == 1 })
+	if !ok || statistics.PayloadsFailed != 0 {
+		t.Errorf("Got %+v\n", statistics)
+	}
+	if message := <-consumed; message.Session != 7 || message.PID != 1234 || message.UID != 1000 {
+		t.Errorf("Got %+v\n", message)
+	}
+	// No consumer, the payload is dropped
+	q.consumer = nil
+	q.enqueue(server.URL + "/session?ports=21380,21381,&" + query.Encode())
+	if statistics, ok := waitReports(q, func(s reportStatistics) bool { return s.PayloadsFailed == 1 }); !ok {
+		t.Errorf("Got %+v\n", statistics)
+	}
+	// No keyring, the payload is dropped
+	q.consumer = &testConsumer{consumed}
+	q.keyring = nil
+	q.enqueue(server.URL + "/session?ports=21380,21381,&" + query.Encode())
+	if statistics, ok := waitReports(q, func(s reportStatistics) bool { return s.PayloadsFailed == 2 }); !ok || statistics.Payloads != 1 {
+		t.Errorf("Got %+v\n", statistics)
+	}
+}
+
+// Emulation of POST /enroll, see server/enroll.go
+type testEnrollServer struct {
+	mutex      sync.Mutex
+	publicKeys map[string][]byte
+	enrolled   int
+	rotated    int
+	failures   int
+	// The rotation replaces the secret
+	secret     string
+}
+
+func (s *testEnrollServer) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		http.Error(response, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var enrollRequest struct {
+		ServiceID string `json:"service_id"`
+		Secret    string `json:"secret"`
+		PublicKey []byte `json:"public_key"`
+	}
+	json.NewDecoder(request.Body).Decode(&enrollRequest)
+	if enrollRequest.ServiceID == "" {
+		if request.Header.Get("Authorization") != "Bearer token" {
+			response.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(response, `{"version":1,"status":"denied"}`)
+			return
+		}
+		s.enrolled++
+		s.publicKeys["a1b2"] = enrollRequest.PublicKey
+		s.secret = "secret"
+		fmt.Fprint(response, `{"version":1,"status":"enrolled","service_id":"a1b2","secret":"secret"}`)
+		return
+	}
+	if enrollRequest.ServiceID != "a1b2" || enrollRequest.Secret != s.secret {
+		response.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(response, `{"version":1,"status":"denied"}`)
+		return
+	}
+	s.rotated++
+	s.publicKeys["a1b2"] = enrollRequest.PublicKey
+	s.secret = fmt.Sprintf("secret%d", s.rotated)
+	fmt.Fprintf(response, `{"version":1,"status":"rotated","service_id":"a1b2","secret":"%s"}`, s.secret)
+}
+
+// Key storage, enrollment and rotation with the files in a temporary directory
+func TestKeyring(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	keys, err := openKeyring(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := keys.getCurrent()
+	if info, err := os.Stat(filepath.Join(dir, "keys", first + ".key")); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Got %v %v\n", info, err)
+	}
+	enrollServer := &testEnrollServer{publicKeys: make(map[string][]byte), failures: 1}
+	server := httptest.NewServer(enrollServer)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		keys.maintain(ctx, server.Client(), server.URL, "token", false, 0, 10*time.Millisecond)
+		close(done)
+	}()
+	for i := 0;i < 100 && keys.getServiceID() == "";i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	// The first attempt failed, I retried
+	if keys.getServiceID() != "a1b2" || enrollServer.enrolled != 1 {
+		t.Fatalf("Got '%s' %+v\n", keys.getServiceID(), enrollServer)
+	}
+	// Restart, I load the same key and the service ID
+	keys, err = openKeyring(dir)
+	if err != nil || keys.getCurrent() != first || keys.getServiceID() != "a1b2" {
+		t.Fatalf("Got %v %v\n", keys, err)
+	}
+	sealed, _ := envelope.Seal(enrollServer.publicKeys["a1b2"], []byte("secret key"), envelope.AssociatedData("a1b2", 7))
+	for i := 0;i < 2;i++ {
+		if err := keys.rotate(server.Client(), server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	second := keys.getCurrent()
+	if second == first || enrollServer.rotated != 2 || envelope.KeyID(enrollServer.publicKeys["a1b2"]) != second || keys.secret != "secret2" {
+		t.Errorf("Got %s %+v\n", second, enrollServer)
+	}
+	// I keep the current and the previous key
+	filenames, _ := filepath.Glob(filepath.Join(dir, "keys", "*.key"))
+	if len(filenames) != 2 || utils.PathExists(filepath.Join(dir, "keys", first + ".key")) {
+		t.Errorf("Got %v\n", filenames)
+	}
+	if _, err := keys.open("a1b2", 7, sealed); err == nil {
+		t.Errorf("Opened the payload for the removed key\n")
+	}
+	sealed, _ = envelope.Seal(enrollServer.publicKeys["a1b2"], []byte("secret key"), envelope.AssociatedData("a1b2", 7))
+	testSets := []struct {
+		service string
+		session uint32
+		ok bool
+	}{
+		{"a1b2", 7, true},
+		{"a1b2", 8, false},
+		{"other", 7, false},
+	}
+	for _, testSet := range testSets {
+		payload, err := keys.open(testSet.service, testSet.session, sealed)
+		if (err == nil) != testSet.ok || (testSet.ok && string(payload) != "secret key") {
+			t.Errorf("Got '%s' %v for %+v\n", payload, err, testSet)
+		}
+	}
+	// The server rejects the rotation, the current key stays
+	// I keep the new key, the server could accept the key and lose the response
+	enrollServer.secret = "other"
+	if err := keys.rotate(server.Client(), server.URL); err == nil || keys.getCurrent() != second || keys.secret != "secret2" {
+		t.Errorf("Got %v %s\n", err, keys.getCurrent())
+	}
+	pending := keys.pending
+	if filenames, _ := filepath.Glob(filepath.Join(dir, "keys", "*.key")); len(filenames) != 3 || pending == "" {
+		t.Errorf("Got %v, pending '%s'\n", filenames, pending)
+	}
+	// Restart, I send the same key again
+	keys, err = openKeyring(dir)
+	if err != nil || keys.pending != pending || keys.getCurrent() != second {
+		t.Fatalf("Got %v %v\n", keys, err)
+	}
+	enrollServer.secret = "secret2"
+	if err := keys.rotate(server.Client(), server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if keys.getCurrent() != pending || keys.pending != "" || envelope.KeyID(enrollServer.publicKeys["a1b2"]) != pending {
+		t.Errorf("Got %s, pending '%s', server %s\n", keys.getCurrent(), keys.pending, envelope.KeyID(enrollServer.publicKeys["a1b2"]))
+	}
+	if filenames, _ := filepath.Glob(filepath.Join(dir, "keys", "*.key")); len(filenames) != 2 || utils.PathExists(filepath.Join(dir, "pending")) {
+		t.Errorf("Got %v\n", filenames)
+	}
+	// Other users can read the directory
+	os.Chmod(dir, 0755)
+	if _, err := openKeyring(dir); err == nil {
+		t.Errorf("Opened the public directory\n")
+	}
+	os.Chmod(dir, 0700)
+	// The enrolled service lost the current key
+	os.Remove(filepath.Join(dir, "keys", pending + ".key"))
+	if _, err := openKeyring(dir); err == nil {
+		t.Errorf("Opened the keyring without the current key\n")
+	}
+}
+
+type testConsumer struct {
+	consumed chan payloadMessage
+}
+
+func (c *testConsumer) consume(message payloadMessage) error {
+	if string(message.Payload) != "secret key" {
+		return fmt.Errorf("Got payload '%s'", message.Payload)
+	}
+	c.consumed <- message
+	return nil
+}
+
+func (c *testConsumer) String() string {
+	return "test"
+}
+
+// The enrolled service signs every attempt, the spool keeps the unsigned report
+func TestReportQueueSigned(t *testing.T) {
+	keys, err := openKeyring(filepath.Join(t.TempDir(), "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.setEnrollment("a1b2", "secret")
+	nonces := make(chan string, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		_, err := signature.Verify(query, signature.ReportKey("secret"), time.Now(), time.Minute)
+		if err != nil || query.Get("service") != "a1b2" {
+			http.Error(response, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		nonces <- query.Get(signature.NonceParam)
+		// The first attempt fails, the retry is signed again
+		if len(nonces) == 1 {
+			http.Error(response, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(response, `{"version":1,"status":"matched"}`)
+	}))
+	defer server.Close()
+	q := createTestReportQueue(4, 5*time.Second)
+	q.keyring = keys
+	q.backoffMin = time.Millisecond
+	q.backoffMax = time.Millisecond
+	q.start(1)
+	q.enqueue(server.URL + "/session?ports=21380,21381,&pid=1234")
+	statistics, ok := waitReports(q, func(s reportStatistics) bool { return s.Delivered == 1 })
+	if !ok || statistics.Retried != 1 {
+		t.Fatalf("Got %+v\n", statistics)
+	}
+	if first, second := <-nonces, <-nonces; first == second {
+		t.Errorf("Got the same nonce %s\n", first)
+	}
+	// The service is not enrolled, the report is not signed and the server rejects it
+	q.keyring = nil
+	q.enqueue(server.URL + "/session?ports=21380,21381,&pid=1234")
+	if statistics, ok := waitReports(q, func(s reportStatistics) bool { return s.Failed == 1 }); !ok {
+		t.Errorf("Got %+v\n", statistics)
+	}
+}
+
+// The reports wait until the service enrolls
+func TestReportQueueEnrolling(t *testing.T) {
+	keys, err := openKeyring(filepath.Join(t.TempDir(), "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.setEnrolling(true)
+	var mutex sync.Mutex
+	services := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		services = append(services, request.URL.Query().Get("service"))
+		mutex.Unlock()
+		fmt.Fprint(response, `{"version":1,"status":"matched"}`)
+	}))
+	defer server.Close()
+	q := createTestReportQueue(4, 5*time.Second)
+	q.keyring = keys
+	q.start(1)
+	q.enqueue(server.URL + "/session?ports=21380,21381,&pid=1234")
+	if statistics, ok := waitReports(q, func(s reportStatistics) bool { return s.Retried >= 3 }); !ok || statistics.Delivered != 0 {
+		t.Fatalf("Got %+v\n", statistics)
+	}
+	keys.setEnrollment("a1b2", "secret")
+	if statistics, ok := waitReports(q, func(s reportStatistics) bool { return s.Delivered == 1 }); !ok {
+		t.Fatalf("Got %+v\n", statistics)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(services) != 1 || services[0] != "a1b2" {
+		t.Errorf("Got %v\n", services)
+	}
+	// The server rejects the token, the reports do not wait
+	keys, _ = openKeyring(filepath.Join(t.TempDir(), "keys"))
+	keys.setEnrolling(true)
+	enrollServer := httptest.NewServer(&testEnrollServer{publicKeys: make(map[string][]byte)})
+	defer enrollServer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		keys.maintain(ctx, enrollServer.Client(), enrollServer.URL, "other", false, 0, 10*time.Millisecond)
+		close(done)
+	}()
+	for i := 0;i < 100 && keys.awaitingEnrollment();i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if keys.awaitingEnrollment() || keys.getServiceID() != "" {
+		t.Errorf("Reports wait for the rejected enrollment\n")
+	}
+}
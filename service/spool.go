@@ -0,0 +1,280 @@
+// Spool keeps the reports which the server did not confirm yet
+// The spool is an append-only text file. Every line is a record:
+//     CRC32 add ID CREATED EXPIRES URL
+//     CRC32 del ID
+// CREATED and EXPIRES are Unix time in nanoseconds, the URL is escaped and contains
+// no spaces. CRC32 is the checksum of the rest of the line in hex. I call fsync after
+// every record. When loading the file I ignore a torn or corrupted record, for example
+// the last line written before a crash
+// I drop entries when the session could not be valid on the server anymore
+// When the file contains mostly deleted records I compact it: write the live entries
+// to a temporary file, fsync, rename over the spool
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type spoolEntry struct {
+	id       uint64
+	created  time.Time
+	expires  time.Time
+	url      string
+	// The entry is in the reports queue or a worker sends it
+	inFlight bool
+}
+
+type spool struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	entries map[uint64]*spoolEntry
+	lastID  uint64
+	// Number of records in the file
+	records int
+}
+
+func recordToText(record string) string {
+	return fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE([]byte(record)), record)
+}
+
+// Returns the record without the checksum, false if the checksum does not match
+func textToRecord(line string) (string, bool) {
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) != 2 {
+		return "", false
+	}
+	checksum, err := strconv.ParseUint(fields[0], 16, 32)
+	if err != nil || uint32(checksum) != crc32.ChecksumIEEE([]byte(fields[1])) {
+		return "", false
+	}
+	return fields[1], true
+}
+
+func (e *spoolEntry) record() string {
+	return fmt.Sprintf("add %d %d %d %s", e.id, e.created.UnixNano(), e.expires.UnixNano(), e.url)
+}
+
+// Apply the record to the map of entries
+func (s *spool) load(record string) bool {
+	fields := strings.Split(record, " ")
+	if len(fields) < 2 {
+		return false
+	}
+	id, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	if id > s.lastID {
+		s.lastID = id
+	}
+	switch {
+	case fields[0] == "del" && len(fields) == 2:
+		delete(s.entries, id)
+		return true
+	case fields[0] == "add" && len(fields) == 5:
+		created, err1 := strconv.ParseInt(fields[2], 10, 64)
+		expires, err2 := strconv.ParseInt(fields[3], 10, 64)
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		s.entries[id] = &spoolEntry{id, time.Unix(0, created).UTC(), time.Unix(0, expires).UTC(), fields[4], false}
+		return true
+	}
+	return false
+}
+
+// Read the spool without modifying the file
+func loadSpool(path string) (*spool, error) {
+	s := &spool{path: path, entries: make(map[uint64]*spoolEntry)}
+	file, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			record, ok := textToRecord(scanner.Text())
+			if !ok || !s.load(record) {
+				fmt.Println("Skipped corrupted record in", path)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load the spool and compact the file, the spool is ready for appending
+func openSpool(path string) (*spool, error) {
+	s, err := loadSpool(path)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.compactLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *spool) sortedEntries() []*spoolEntry {
+	entries := []*spoolEntry{}
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+	return entries
+}
+
+// Rewrite the file with the live entries only
+func (s *spool) compactLocked() error {
+	tmpPath := s.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, entry := range s.sortedEntries() {
+		writer.WriteString(recordToText(entry.record()))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	// The rename is durable after the fsync of the directory
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	s.records = len(s.entries)
+	return nil
+}
+
+// Append the record to the file and fsync
+func (s *spool) appendLocked(record string) error {
+	if s.file == nil {
+		return fmt.Errorf("Spool %s is closed", s.path)
+	}
+	if _, err := s.file.WriteString(recordToText(record)); err != nil {
+		return err
+	}
+	s.records++
+	return s.file.Sync()
+}
+
+// Add the report to the spool, the entry is in flight
+func (s *spool) add(url string, created time.Time, expires time.Time) (*spoolEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := &spoolEntry{s.lastID+1, created, expires, url, true}
+	if err := s.appendLocked(entry.record()); err != nil {
+		return nil, err
+	}
+	s.lastID = entry.id
+	s.entries[entry.id] = entry
+	return entry, nil
+}
+
+func (s *spool) removeLocked(id uint64) error {
+	if _, ok := s.entries[id]; !ok {
+		return nil
+	}
+	delete(s.entries, id)
+	if err := s.appendLocked(fmt.Sprintf("del %d", id)); err != nil {
+		return err
+	}
+	if s.records > 2*len(s.entries) + 64 {
+		return s.compactLocked()
+	}
+	return nil
+}
+
+// Remove the entry, for example when the server confirmed the report
+func (s *spool) remove(id uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.removeLocked(id)
+}
+
+// The entry is not in flight anymore, I will replay it later
+func (s *spool) release(id uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if entry, ok := s.entries[id]; ok {
+		entry.inFlight = false
+	}
+}
+
+// Drop the expired entries, returns the entries which are not in flight
+// ordered by age. The returned entries are in flight
+func (s *spool) pending(now time.Time) []*spoolEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pending := []*spoolEntry{}
+	for _, entry := range s.sortedEntries() {
+		if !entry.expires.After(now) {
+			if !entry.inFlight {
+				if err := s.removeLocked(entry.id); err != nil {
+					fmt.Println("Failed to update spool", err)
+				}
+			}
+			continue
+		}
+		if !entry.inFlight {
+			entry.inFlight = true
+			pending = append(pending, entry)
+		}
+	}
+	return pending
+}
+
+// Returns number of entries in the spool and age of the oldest entry
+func (s *spool) status(now time.Time) (int, time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var age time.Duration
+	for _, entry := range s.entries {
+		if now.Sub(entry.created) > age {
+			age = now.Sub(entry.created)
+		}
+	}
+	return len(s.entries), age
+}
+
+func (s *spool) close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
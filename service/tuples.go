@@ -0,0 +1,210 @@
+// Reconstruction of the ports tuples from the collected knocks
+// The client knocks the tuples one after another, the ports in a tuple are ascending.
+// The service could fail to bind some ports. Knocks on such ports are lost. 
+// I insert the ports I failed to bind into the stream of collected knocks in all 
+// possible ways which divide the stream into the expected number of ascending tuples.
+// Every way is a candidate set of tuples. The server looks for a session matching
+// any of the candidates
+// Example. The client knocks (0,1),(0,2),(0,3), the service failed to bind port 1,
+// collected knocks are 0,0,2,0,3. The only candidate is (0,1),(0,2),(0,3)
+// Candidates which contain the same tuple twice are pruned. A tuple never contains 
+// the same port twice, for example (0,0), because ports in a tuple are ascending
+// The search is exponential. I stop a branch as soon as the remaining collected 
+// knocks and the ports I failed to bind can not fill the remaining tuples. I give 
+// up after maxTuplesNodes steps, a large ports range with many failed ports should 
+// not stall the knocks handling
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"port-knocking-ipc/utils"
+)
+
+// Limit the number of candidates I send to the server
+const maxCandidates = 256
+
+// Limit the number of steps of the search
+const maxTuplesNodes = 1 << 18
+
+var errTooManyTuplesNodes = errors.New("Too many combinations of the failed ports, giving up")
+
+type tuplesBuilder struct {
+	ports        []int
+	failedToBind []int
+	tupleSize    int
+	tuplesCount  int
+	tuples       [][]int
+	tuple        []int
+	candidates   [][][]int
+	nodes        int
+	err          error
+}
+
+// Returns true if the candidate contains the same tuple twice 
+func hasDuplicateTuples(tuples [][]int) bool {
+	for i := 0;i < len(tuples);i++ {
+		for j := i+1;j < len(tuples);j++ {
+			if utils.Compare(tuples[i], tuples[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func cloneTuples(tuples [][]int) [][]int {
+	result := make([][]int, 0, len(tuples))
+	for _, tuple := range tuples {
+		result = append(result, utils.CloneSlice(tuple))
+	}
+	return result
+}
+
+// Returns number of the ports I failed to bind which are larger than 'port'
+func (b *tuplesBuilder) failedAbove(port int) int {
+	return len(b.failedToBind) - sort.SearchInts(b.failedToBind, port+1)
+}
+
+// Returns false if the remaining collected knocks and the ports I failed to bind 
+// can not fill the remaining tuples. A tuple contains a failed port at most once
+// The collected knocks which are not above the last port start the next tuple
+func (b *tuplesBuilder) feasible(position int, lastPort int) bool {
+	remainingPorts := len(b.ports) - position
+	freeSlots := (b.tuplesCount - len(b.tuples)) * b.tupleSize - len(b.tuple)
+	if remainingPorts > freeSlots {
+		return false
+	}
+	tupleSlots := b.tupleSize - len(b.tuple)
+	if remainingPorts > 0 && b.ports[position] <= lastPort && tupleSlots > b.failedAbove(lastPort) {
+		return false
+	}
+	capacity := (b.tuplesCount - len(b.tuples) - 1) * len(b.failedToBind) + b.failedAbove(lastPort)
+	return freeSlots - remainingPorts <= capacity
+}
+
+// Recursively build the tuples, 'position' is the next collected knock
+// Every port in the tuple is either the next collected knock or a port I failed 
+// to bind. Ports in a tuple are ascending
+func (b *tuplesBuilder) build(position int) {
+	if len(b.candidates) >= maxCandidates || b.err != nil {
+		return
+	}
+	b.nodes++
+	if b.nodes > maxTuplesNodes {
+		b.err = errTooManyTuplesNodes
+		return
+	}
+	if len(b.tuple) == b.tupleSize {
+		tuple := b.tuple
+		b.tuples = append(b.tuples, tuple)
+		b.tuple = []int{}
+		b.build(position)
+		b.tuple = tuple
+		b.tuples = b.tuples[:len(b.tuples)-1]
+		return
+	}
+	if len(b.tuples) == b.tuplesCount {
+		if position == len(b.ports) && !hasDuplicateTuples(b.tuples) {
+			b.candidates = append(b.candidates, cloneTuples(b.tuples))
+		}
+		return
+	}
+	lastPort := -1
+	if len(b.tuple) > 0 {
+		lastPort = b.tuple[len(b.tuple)-1]
+	}
+	if !b.feasible(position, lastPort) {
+		return
+	}
+	if position < len(b.ports) && b.ports[position] > lastPort {
+		b.tuple = append(b.tuple, b.ports[position])
+		b.build(position+1)
+		b.tuple = b.tuple[:len(b.tuple)-1]
+	}
+	for _, port := range b.failedToBind {
+		if port > lastPort {
+			b.tuple = append(b.tuple, port)
+			b.build(position)
+			b.tuple = b.tuple[:len(b.tuple)-1]
+		}
+	}
+}
+
+// getTuples generates all possible combinations of collected ports and failed to bind ports 
+// If I bind all ports the getTuples returns the original ports divided into tuples  
+// If there are more knocks than expected I assume more tuples
+// Returns an error if the search is too long
+func getTuples(ports, failedToBind []int, tupleSize int, tuplesCount int) ([][][]int, error) {
+	if tupleSize <= 0 {
+		return nil, nil
+	}
+	if count := (len(ports)+tupleSize-1)/tupleSize; count > tuplesCount {
+		tuplesCount = count
+	}
+	failed := utils.CloneSlice(failedToBind)
+	sort.Ints(failed)
+	b := tuplesBuilder{
+		ports:        ports,
+		failedToBind: failed,
+		tupleSize:    tupleSize,
+		tuplesCount:  tuplesCount,
+		tuples:       [][]int{},
+		tuple:        []int{},
+		candidates:   [][][]int{},
+	}
+	b.build(0)
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.candidates, nil
+}
+
+// In the frame start mode I know the tuples boundaries. Every frame is completed 
+// by the ports I failed to bind. The candidates are all combinations of the 
+// completed frames
+func getFramesTuples(frames [][]int, failedToBind []int, tupleSize int) ([][][]int, error) {
+	candidates := [][][]int{{}}
+	for _, frame := range frames {
+		frameCandidates, err := getTuples(frame, failedToBind, tupleSize, 1)
+		if err != nil {
+			return nil, err
+		}
+		next := [][][]int{}
+		for _, candidate := range candidates {
+			for _, frameCandidate := range frameCandidates {
+				if len(next) >= maxCandidates {
+					break
+				}
+				tuples := append(cloneTuples(candidate), frameCandidate...)
+				if !hasDuplicateTuples(tuples) {
+					next = append(next, tuples)
+				}
+			}
+		}
+		candidates = next
+	}
+	if len(candidates) == 1 && len(candidates[0]) == 0 {
+		return nil, nil
+	}
+	return candidates, nil
+}
+
+// Presentation of the candidates in the URL query: ports separated by commas,
+// candidates separated by semicolons "0,1,0,2,;0,1,1,2,"
+func candidatesToText(candidates [][][]int) string {
+	texts := []string{}
+	for _, tuples := range candidates {
+		var text strings.Builder
+		for _, tuple := range tuples {
+			for _, port := range tuple {
+				text.WriteString(fmt.Sprintf("%d,", port))
+			}
+		}
+		texts = append(texts, text.String())
+	}
+	return strings.Join(texts, ";")
+}
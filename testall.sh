@@ -4,3 +4,10 @@ go test $DIR/utils/combinations -cover $VERBOSE
 go test $DIR/server -cover $VERBOSE
 go test $DIR/client -cover $VERBOSE
 
+go test $DIR/service -cover $VERBOSE
+go test $DIR/utils/process -cover $VERBOSE
+go test $DIR/utils/systemd -cover $VERBOSE
+go test $DIR/utils/lifecycle -cover $VERBOSE
+go test $DIR/utils/envelope -cover $VERBOSE
+go test $DIR/utils/signature -cover $VERBOSE
+go test $DIR/utils/timeheap -cover $VERBOSE
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// XML format of an allocated session, see server/session.xsd
+//     <session version="1" id="1" token="..." expires="2018-04-23T10:00:10Z" tuple_size="2" frame_start="21379">
+//       <tuple><port>21380</port><port>21382</port></tuple>
+//     </session>
+// The order of the tuples is the order of knocking
+// The ports and the frame start port are strings, the client validates them
+
+// XMLSessionVersion is the version of the format
+const XMLSessionVersion = 1
+
+// XMLTuple is a tuple of ports
+type XMLTuple struct {
+	Ports []string `xml:"port"`
+}
+
+// XMLSession is an allocated session
+type XMLSession struct {
+	XMLName    xml.Name   `xml:"session"`
+	Version    int        `xml:"version,attr"`
+	ID         uint32     `xml:"id,attr"`
+	Token      string     `xml:"token,attr,omitempty"`
+	Expires    time.Time  `xml:"expires,attr"`
+	TupleSize  int        `xml:"tuple_size,attr"`
+	FrameStart string     `xml:"frame_start,attr,omitempty"`
+	Tuples     []XMLTuple `xml:"tuple"`
+}
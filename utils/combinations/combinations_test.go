@@ -2,6 +2,7 @@ package combinations
 
 import (
 	"testing"
+	"math/big"
 	"port-knocking-ipc/utils"
 )
 
@@ -58,3 +59,87 @@ func TestMain(t *testing.T) {
 	}
 }
 
+
+type countTestSet struct {
+	n int
+	m int
+	count string
+}
+
+func TestCount(t *testing.T) {
+	testSets := []countTestSet {
+		{10, 5, "252"},
+		{4, 2, "6"},
+		{4, 0, "1"},
+		{4, 5, "0"},
+		{128, 8, "1429702652400"},
+		{64, 32, "1832624140942590534"},
+		{128, 64, "23951146041928082866135587776380551750"},
+	}
+	for testIndex, testSet := range testSets {
+		expected, _ := new(big.Int).SetString(testSet.count, 10)
+		count := CountBig(testSet.n, testSet.m)
+		if count.Cmp(expected) != 0 {
+			t.Errorf("Got %v expected %v for test %d\n", count, expected, testIndex)
+		}
+		count64, ok := Count(testSet.n, testSet.m)
+		if ok != expected.IsUint64() || (ok && count64 != expected.Uint64()) {
+			t.Errorf("Got %d, %t expected %v for test %d\n", count64, ok, expected, testIndex)
+		}
+	}
+}
+
+// Rank and Unrank shall agree with the Next() order
+func TestRank(t *testing.T) {
+	source := []int{3, 5, 7, 11, 13, 17, 19}
+	for m := 1;m <= len(source);m++ {
+		var state = Init(source, m)
+		index := uint64(0)
+		for combination := state.Next(); combination != nil; combination = state.Next() {
+			rank, ok := Rank(source, combination)
+			if !ok || rank != index {
+				t.Errorf("Got rank %d expected %d for %v\n", rank, index, combination)
+			}
+			unranked := Unrank(source, m, index)
+			if !utils.Compare(unranked, combination) {
+				t.Errorf("Got %v expected %v for index %d\n", unranked, combination, index)
+			}
+			unranked = UnrankBig(source, m, new(big.Int).SetUint64(index))
+			if !utils.Compare(unranked, combination) {
+				t.Errorf("Got %v expected %v for index %d\n", unranked, combination, index)
+			}
+			index++
+		}
+		if count, _ := Count(len(source), m); count != index {
+			t.Errorf("Got %d combinations expected %d\n", index, count)
+		}
+		if Unrank(source, m, index) != nil {
+			t.Errorf("Expected nil for index %d\n", index)
+		}
+	}
+	if _, ok := Rank(source, []int{5, 3}); ok {
+		t.Errorf("Expected failure for a not ordered combination\n")
+	}
+	if _, ok := Rank(source, []int{3, 4}); ok {
+		t.Errorf("Expected failure for a missing element\n")
+	}
+}
+
+func TestRankBig(t *testing.T) {
+	source := make([]int, 128)
+	for i := range source {
+		source[i] = i
+	}
+	last := source[64:]
+	rank, ok := RankBig(source, last)
+	expected := new(big.Int).Sub(CountBig(128, 64), big.NewInt(1))
+	if !ok || rank.Cmp(expected) != 0 {
+		t.Errorf("Got %v expected %v\n", rank, expected)
+	}
+	if !utils.Compare(UnrankBig(source, 64, rank), last) {
+		t.Errorf("Got %v expected %v\n", UnrankBig(source, 64, rank), last)
+	}
+	if _, ok := Rank(source, last); ok {
+		t.Errorf("Expected overflow\n")
+	}
+}
@@ -0,0 +1,143 @@
+// Ranking and unranking of combinations
+// The rank of a combination is the index of the combination in the order 
+// State.Next() generates the combinations - lexicographic order of the 
+// positions in the source array. The source array should not contain duplicates
+
+package combinations
+
+import (
+	"math/big"
+	"math/bits"
+)
+
+// Count returns number of combinations of size m from n elements - n choose m
+// Returns false if the result does not fit uint64, use CountBig() in this case
+func Count(n, m int) (uint64, bool) {
+	if m < 0 || m > n {
+		return 0, true
+	}
+	if m > n-m {
+		m = n - m
+	}
+	result := uint64(1)
+	for i := 1; i <= m; i++ {
+		// result*(n-m+i)/i is always an integer
+		hi, lo := bits.Mul64(result, uint64(n-m+i))
+		if hi >= uint64(i) {
+			return 0, false
+		}
+		result, _ = bits.Div64(hi, lo, uint64(i))
+	}
+	return result, true
+}
+
+// CountBig returns n choose m 
+func CountBig(n, m int) *big.Int {
+	if m < 0 || m > n {
+		return big.NewInt(0)
+	}
+	if count, ok := Count(n, m); ok {
+		return new(big.Int).SetUint64(count)
+	}
+	return new(big.Int).Binomial(int64(n), int64(m))
+}
+
+// Find positions of the combination's elements in the source
+// Positions are ascending, every element is looked for after the previous one
+func positions(source []int, combination []int) ([]int, bool) {
+	result := make([]int, 0, len(combination))
+	position := 0
+	for _, value := range combination {
+		for position < len(source) && source[position] != value {
+			position++
+		}
+		if position == len(source) {
+			return nil, false
+		}
+		result = append(result, position)
+		position++
+	}
+	return result, true
+}
+
+// Rank returns the index of the combination in the State.Next() order
+// Returns false if the combination is not a combination of the source 
+// or the rank does not fit uint64 
+func Rank(source []int, combination []int) (uint64, bool) {
+	if _, ok := Count(len(source), len(combination)); !ok {
+		return 0, false
+	}
+	rank, ok := RankBig(source, combination)
+	if !ok {
+		return 0, false
+	}
+	return rank.Uint64(), true
+}
+
+// RankBig is Rank() for any size of the combinations space
+func RankBig(source []int, combination []int) (*big.Int, bool) {
+	indexes, ok := positions(source, combination)
+	if !ok {
+		return nil, false
+	}
+	n, m := len(source), len(combination)
+	rank := new(big.Int)
+	candidate := 0
+	for i, index := range indexes {
+		// Skip all combinations which have a smaller element in this position
+		for ; candidate < index; candidate++ {
+			rank.Add(rank, CountBig(n-candidate-1, m-i-1))
+		}
+		candidate = index + 1
+	}
+	return rank, true
+}
+
+// Unrank returns the combination of size m with the specified index 
+// in the State.Next() order. Returns nil if the index is out of range
+func Unrank(source []int, m int, index uint64) []int {
+	count, ok := Count(len(source), m)
+	if ok && index >= count {
+		return nil
+	}
+	n := len(source)
+	combination := make([]int, 0, m)
+	candidate := 0
+	for position := 0; position < m; position++ {
+		for {
+			count, ok := Count(n-candidate-1, m-position-1)
+			if !ok || index < count {
+				break
+			}
+			index -= count
+			candidate++
+		}
+		combination = append(combination, source[candidate])
+		candidate++
+	}
+	return combination
+}
+
+// UnrankBig is Unrank() for any size of the combinations space
+func UnrankBig(source []int, m int, index *big.Int) []int {
+	if index.Sign() < 0 || index.Cmp(CountBig(len(source), m)) >= 0 {
+		return nil
+	}
+	n := len(source)
+	index = new(big.Int).Set(index)
+	combination := make([]int, 0, m)
+	candidate := 0
+	for position := 0; position < m; position++ {
+		for {
+			count := CountBig(n-candidate-1, m-position-1)
+			if index.Cmp(count) < 0 {
+				break
+			}
+			index.Sub(index, count)
+			candidate++
+		}
+		combination = append(combination, source[candidate])
+		candidate++
+	}
+	return combination
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Files of the confirmation channels
+// The client creates the PID file or listens on the unix socket, the server removes
+// the file, the service connects to the socket when the session is matched
+// The files are in the per-user runtime directory /run/user/UID/port-knocking-ipc
+// If there is no /run/user/UID I fall back to /tmp/port-knocking-ipc-UID
+// The server and the service find the directory by UID of the knocking process
+
+// GetRuntimeDir returns the runtime directory of the user
+func GetRuntimeDir(uid int) string {
+	userDir := fmt.Sprintf("/run/user/%d", uid)
+	if info, err := os.Stat(userDir); err == nil && info.IsDir() {
+		return filepath.Join(userDir, "port-knocking-ipc")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("port-knocking-ipc-%d", uid))
+}
+
+// CreateRuntimeDir creates the runtime directory of the current user with mode 0700
+// In /tmp another user could create the directory first. I refuse a directory which
+// is a symlink, belongs to another user or is accessible by other users
+func CreateRuntimeDir() (string, error) {
+	uid := os.Getuid()
+	dir := GetRuntimeDir(uid)
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return dir, err
+	}
+	return dir, CheckRuntimeDir(uid)
+}
+
+// CheckRuntimeDir returns an error if the runtime directory of the user is not safe
+func CheckRuntimeDir(uid int) error {
+	dir := GetRuntimeDir(uid)
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != uid {
+		return fmt.Errorf("Directory %s does not belong to UID %d", dir, uid)
+	}
+	if info.Mode().Perm() & 0077 != 0 {
+		return fmt.Errorf("Directory %s is accessible by other users, mode %v", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// GetPidFilename returns RUNTIME_DIR/knock_PID
+func GetPidFilename(uid int, pid int) string {
+	return filepath.Join(GetRuntimeDir(uid), fmt.Sprintf("knock_%d", pid))
+}
+
+// GetSocketFilename returns RUNTIME_DIR/knock_PID.sock
+func GetSocketFilename(uid int, pid int) string {
+	return filepath.Join(GetRuntimeDir(uid), fmt.Sprintf("knock_%d.sock", pid))
+}
@@ -0,0 +1,146 @@
+// Encryption of the session payloads to the public key of the service
+// The service has a long-term X25519 keypair. The server generates an ephemeral
+// keypair for every payload, derives the AES-256-GCM key from the shared secret
+// and encrypts the payload. Only the holder of the private key can open the envelope
+// Envelope
+//     version (1 byte) | key ID (8 bytes) | ephemeral public key (32 bytes) | nonce (12 bytes) | ciphertext
+// Key = SHA-256("port-knocking-ipc envelope" | shared secret | ephemeral public key | recipient public key)
+// The key ID is the first 8 bytes of SHA-256 of the recipient public key. After
+// a key rotation the service finds the private key by the key ID
+// The associated data, for example the service ID and the session ID, binds the
+// envelope to the session. The envelope of one session does not open for another
+
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Version of the envelope format
+const Version = 1
+
+const keyIDSize = 8
+const publicKeySize = 32
+const nonceSize = 12
+const headerSize = 1 + keyIDSize + publicKeySize + nonceSize
+
+// GenerateKey returns a new X25519 private key
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// ParsePrivateKey parses the raw X25519 private key
+func ParsePrivateKey(key []byte) (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().NewPrivateKey(key)
+}
+
+// ParsePublicKey parses the raw X25519 public key
+func ParsePublicKey(key []byte) (*ecdh.PublicKey, error) {
+	return ecdh.X25519().NewPublicKey(key)
+}
+
+func keyID(publicKey []byte) []byte {
+	hash := sha256.Sum256(publicKey)
+	return hash[:keyIDSize]
+}
+
+// KeyID returns the ID of the public key, 16 hex digits
+func KeyID(publicKey []byte) string {
+	return hex.EncodeToString(keyID(publicKey))
+}
+
+func createAEAD(sharedSecret []byte, ephemeralKey []byte, recipientKey []byte) (cipher.AEAD, error) {
+	hash := sha256.New()
+	hash.Write([]byte("port-knocking-ipc envelope"))
+	hash.Write(sharedSecret)
+	hash.Write(ephemeralKey)
+	hash.Write(recipientKey)
+	block, err := aes.NewCipher(hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts the plaintext to the public key
+func Seal(publicKey []byte, plaintext []byte, associatedData []byte) ([]byte, error) {
+	recipient, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralKey := ephemeral.PublicKey().Bytes()
+	aead, err := createAEAD(sharedSecret, ephemeralKey, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, headerSize)
+	header = append(header, Version)
+	header = append(header, keyID(publicKey)...)
+	header = append(header, ephemeralKey...)
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	// The header is authenticated too
+	return aead.Seal(header, nonce, plaintext, append(clone(header), associatedData...)), nil
+}
+
+func clone(b []byte) []byte {
+	return append([]byte{}, b...)
+}
+
+// EnvelopeKeyID returns the ID of the key the envelope is encrypted to
+func EnvelopeKeyID(envelope []byte) (string, error) {
+	if len(envelope) < headerSize || envelope[0] != Version {
+		return "", fmt.Errorf("Bad envelope")
+	}
+	return hex.EncodeToString(envelope[1:1+keyIDSize]), nil
+}
+
+// Open decrypts the envelope
+func Open(privateKey *ecdh.PrivateKey, envelope []byte, associatedData []byte) ([]byte, error) {
+	if len(envelope) < headerSize || envelope[0] != Version {
+		return nil, fmt.Errorf("Bad envelope")
+	}
+	publicKey := privateKey.PublicKey().Bytes()
+	if !bytes.Equal(envelope[1:1+keyIDSize], keyID(publicKey)) {
+		return nil, fmt.Errorf("Envelope is encrypted to key %s, not %s", hex.EncodeToString(envelope[1:1+keyIDSize]), KeyID(publicKey))
+	}
+	ephemeralKey := envelope[1+keyIDSize:1+keyIDSize+publicKeySize]
+	ephemeral, err := ParsePublicKey(ephemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := privateKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := createAEAD(sharedSecret, ephemeralKey, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	header := envelope[:headerSize]
+	nonce := header[headerSize-nonceSize:]
+	return aead.Open(nil, nonce, envelope[headerSize:], append(clone(header), associatedData...))
+}
+
+// AssociatedData binds the envelope of the session payload to the service and the session
+func AssociatedData(serviceID string, session uint32) []byte {
+	return []byte(fmt.Sprintf("service=%s session=%d", serviceID, session))
+}
@@ -0,0 +1,57 @@
+package envelope
+
+import (
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _ := GenerateKey()
+	publicKey := key.PublicKey().Bytes()
+	sealed, err := Seal(publicKey, []byte("secret key"), []byte("service 1 session 7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := EnvelopeKeyID(sealed); err != nil || id != KeyID(publicKey) || len(id) != 16 {
+		t.Errorf("Got key ID %s %v\n", id, err)
+	}
+	plaintext, err := Open(key, sealed, []byte("service 1 session 7"))
+	if err != nil || string(plaintext) != "secret key" {
+		t.Errorf("Got '%s' %v\n", plaintext, err)
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	testSets := []struct {
+		name string
+		envelope []byte
+		associatedData string
+	}{
+		{"other session", sealed, "service 1 session 8"},
+		{"other key", sealed, "service 1 session 7"},
+		{"tampered", tampered, "service 1 session 7"},
+		{"short", sealed[:10], "service 1 session 7"},
+	}
+	for _, testSet := range testSets {
+		privateKey := key
+		if testSet.name == "other key" {
+			privateKey = otherKey
+		}
+		if _, err := Open(privateKey, testSet.envelope, []byte(testSet.associatedData)); err == nil {
+			t.Errorf("Opened the envelope: %s\n", testSet.name)
+		}
+	}
+	// Restore the key from the raw bytes
+	restored, err := ParsePrivateKey(key.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := Open(restored, sealed, []byte("service 1 session 7")); err != nil || string(plaintext) != "secret key" {
+		t.Errorf("Got '%s' %v\n", plaintext, err)
+	}
+	if _, err := Seal([]byte("short"), []byte("secret key"), nil); err == nil {
+		t.Errorf("Sealed to a bad key\n")
+	}
+}
@@ -0,0 +1,131 @@
+// Lifecycle of the server, the service and the client
+// The main goroutine creates a Lifecycle and passes the context to the goroutines.
+// A signal, a fatal error or the end of the work cancels the context. The
+// goroutines exit when the context is done. The main goroutine calls Wait() which
+// runs the drain hooks, for example flush pending knocks, finish in-flight HTTP 
+// requests, persist the state. The hooks run in the reverse order of registration
+// and share the shutdown timeout. Every hook gets an equal slice of the time left,
+// the time which a fast hook did not use goes to the following hooks. Wait() does 
+// not wait for a hook which missed its slice, but runs the following hooks. A 
+// stuck HTTP server does not prevent persisting the state
+
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type hook struct {
+	name string
+	f    func(ctx context.Context) error
+}
+
+// Lifecycle keeps the context and the drain hooks
+type Lifecycle struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+	mutex   sync.Mutex
+	hooks   []hook
+	// The first error which stopped the binary
+	err     error
+}
+
+// New returns a running lifecycle, timeout limits the time of the drain hooks
+func New(timeout time.Duration) *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Lifecycle{ctx: ctx, cancel: cancel, timeout: timeout}
+}
+
+// Context is done when the shutdown starts
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+// OnShutdown registers a drain hook 
+// The hook should return when the context is done
+func (l *Lifecycle) OnShutdown(name string, f func(ctx context.Context) error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.hooks = append(l.hooks, hook{name, f})
+}
+
+// Stop starts the shutdown, err is nil if the binary completed the work
+// I keep the first error
+func (l *Lifecycle) Stop(err error) {
+	l.mutex.Lock()
+	if l.err == nil {
+		l.err = err
+	}
+	l.mutex.Unlock()
+	l.cancel()
+}
+
+// HandleSignals stops the lifecycle on SIGTERM or SIGINT
+func (l *Lifecycle) HandleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case s := <-signals:
+			fmt.Println("Got signal", s)
+			l.Stop(nil)
+		case <-l.ctx.Done():
+		}
+	}()
+}
+
+// Run the hook, give up when the context is done
+func runHook(ctx context.Context, h hook) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- h.f(ctx)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%s: %v", h.name, ctx.Err())
+	}
+}
+
+// Wait blocks until the shutdown starts, runs the drain hooks
+// Returns the error which stopped the binary or the first error of the hooks
+func (l *Lifecycle) Wait() error {
+	<-l.ctx.Done()
+	deadline := time.Now().Add(l.timeout)
+	l.mutex.Lock()
+	hooks := l.hooks
+	err := l.err
+	l.mutex.Unlock()
+	for i := len(hooks)-1;i >= 0;i-- {
+		slice := time.Until(deadline) / time.Duration(i+1)
+		ctx, cancel := context.WithTimeout(context.Background(), slice)
+		hookErr := runHook(ctx, hooks[i])
+		cancel()
+		if hookErr != nil {
+			fmt.Printf("Shutdown %s failed: %v\n", hooks[i].name, hookErr)
+			if err == nil {
+				err = hookErr
+			}
+		}
+	}
+	return err
+}
+
+// Exit runs the drain hooks and exits the process, the exit code is 1 if an error stopped 
+// the binary or a hook failed 
+func (l *Lifecycle) Exit() {
+	if err := l.Wait(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,79 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHooksOrder(t *testing.T) {
+	l := New(time.Second)
+	order := []string{}
+	for _, name := range []string{"listeners", "knocks", "spool"} {
+		name := name
+		l.OnShutdown(name, func(ctx context.Context) error {
+			order = append(order, name)
+			return nil
+		})
+	}
+	select {
+	case <-l.Context().Done():
+		t.Fatalf("Context is done before Stop\n")
+	default:
+	}
+	l.Stop(nil)
+	if err := l.Wait(); err != nil {
+		t.Errorf("Got %v\n", err)
+	}
+	if len(order) != 3 || order[0] != "spool" || order[2] != "listeners" {
+		t.Errorf("Got order %v\n", order)
+	}
+}
+
+// A hook which hangs does not block the shutdown and does not skip the following hooks
+func TestShutdownTimeout(t *testing.T) {
+	l := New(20*time.Millisecond)
+	ran := false
+	l.OnShutdown("second", func(ctx context.Context) error {
+		ran = (ctx.Err() == nil)
+		return nil
+	})
+	l.OnShutdown("hang", func(ctx context.Context) error {
+		select {}
+	})
+	fatal := errors.New("bind failed")
+	l.Stop(fatal)
+	l.Stop(errors.New("ignored"))
+	start := time.Now()
+	err := l.Wait()
+	if err != fatal {
+		t.Errorf("Got %v\n", err)
+	}
+	if time.Since(start) > time.Second || !ran {
+		t.Errorf("Hooks did not time out, %v, %t\n", time.Since(start), ran)
+	}
+	l = New(time.Second)
+	l.OnShutdown("failed", func(ctx context.Context) error {
+		return fatal
+	})
+	l.Stop(nil)
+	if err := l.Wait(); err != fatal {
+		t.Errorf("Got %v\n", err)
+	}
+}
+
+func TestSignals(t *testing.T) {
+	l := New(time.Second)
+	l.HandleSignals()
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	select {
+	case <-l.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatalf("SIGTERM did not stop\n")
+	}
+	if err := l.Wait(); err != nil {
+		t.Errorf("Got %v\n", err)
+	}
+}
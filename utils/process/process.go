@@ -0,0 +1,326 @@
+// Identity of a process read from /proc/PID
+// The service collects the identity of the knocking process and sends the identity 
+// to the server in the URL query together with the ports
+
+package process
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"port-knocking-ipc/utils"
+)
+
+// Identity describes a process
+type Identity struct {
+	PID          int
+	PPID         int
+	RealUID      int
+	EffectiveUID int
+	RealGID      int
+	EffectiveGID int
+	User         string
+	Executable   string
+	Cmdline      []string
+	// Time the process started after system boot, clock ticks 
+	StartTime    uint64
+	ProcessGroup int
+	Session      int
+}
+
+// Stat is a subset of the fields in /proc/PID/stat
+type Stat struct {
+	PID          int
+	Command      string
+	PPID         int
+	ProcessGroup int
+	Session      int
+	StartTime    uint64
+}
+
+// Group is a logical process - for example a browser - and the processes 
+// which knocked on behalf of the logical process
+type Group struct {
+	Root Identity
+	PIDs []int
+}
+
+// Parse lines like "Uid:	1000	1000	1000	1000", return real and effective IDs
+func parseStatusIDs(value string) (int, int, bool) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return 0, 0, false
+	}
+	real, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	effective, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	return real, effective, true
+}
+
+// Read PPID, UIDs and GIDs from /proc/PID/status
+func (identity *Identity) readStatus(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "status"))
+	if err != nil {
+		return err
+	}
+	found := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		name, value := line[:colon], line[colon+1:]
+		ok := true
+		switch name {
+		case "PPid":
+			identity.PPID, err = strconv.Atoi(strings.TrimSpace(value))
+			ok = (err == nil)
+		case "Uid":
+			identity.RealUID, identity.EffectiveUID, ok = parseStatusIDs(value)
+		case "Gid":
+			identity.RealGID, identity.EffectiveGID, ok = parseStatusIDs(value)
+		default:
+			continue
+		}
+		if !ok {
+			return fmt.Errorf("Failed to parse '%s' in %s/status", line, dir)
+		}
+		found++
+	}
+	if found < 3 {
+		return fmt.Errorf("Missing fields in %s/status", dir)
+	}
+	return nil
+}
+
+// ReadStat parses /proc/PID/stat
+// The second field is the command in parenthesis and can contain spaces
+// PPID is field 4, process group is field 5, session is field 6, start time is field 22
+func ReadStat(root string, pid int) (Stat, error) {
+	stat := Stat{PID: pid}
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return stat, err
+	}
+	text := string(data)
+	open, parenthesis := strings.Index(text, "("), strings.LastIndex(text, ")")
+	if open < 0 || parenthesis < open {
+		return stat, fmt.Errorf("Failed to parse %s/stat", dir)
+	}
+	stat.Command = text[open+1:parenthesis]
+	// The fields after the command start from field 3 - state 
+	fields := strings.Fields(text[parenthesis+1:])
+	const startTimeField = 22 - 3
+	if len(fields) <= startTimeField {
+		return stat, fmt.Errorf("Failed to parse %s/stat", dir)
+	}
+	values := []*int{&stat.PPID, &stat.ProcessGroup, &stat.Session}
+	for i, value := range values {
+		*value, err = strconv.Atoi(fields[i+1])
+		if err != nil {
+			return stat, fmt.Errorf("Failed to parse %s/stat", dir)
+		}
+	}
+	stat.StartTime, err = strconv.ParseUint(fields[startTimeField], 10, 64)
+	return stat, err
+}
+
+// ReadExecutable returns the path of the executable of the process or an empty string
+func ReadExecutable(root string, pid int) string {
+	executable, err := os.Readlink(filepath.Join(root, strconv.Itoa(pid), "exe"))
+	if err != nil {
+		return ""
+	}
+	return executable
+}
+
+// ReadIdentity collects the identity of the process from the /proc 
+// 'root' is usually "/proc"
+// The executable and the command line are not always accessible, for example 
+// for processes of other users. I ignore such failures
+func ReadIdentity(root string, pid int) (Identity, error) {
+	identity := Identity{PID: pid}
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	if err := identity.readStatus(dir); err != nil {
+		return identity, err
+	}
+	stat, err := ReadStat(root, pid)
+	if err != nil {
+		return identity, err
+	}
+	identity.StartTime = stat.StartTime
+	identity.ProcessGroup = stat.ProcessGroup
+	identity.Session = stat.Session
+	identity.Executable = ReadExecutable(root, pid)
+	if cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		cmdline := strings.TrimRight(string(cmdline), "\x00")
+		if cmdline != "" {
+			identity.Cmdline = strings.Split(cmdline, "\x00")
+		}
+	}
+	if u, err := user.LookupId(strconv.Itoa(identity.RealUID)); err == nil {
+		identity.User = u.Username
+	}
+	return identity, nil
+}
+
+// Encode adds the identity to the URL query
+// "pid=...&ppid=...&uid=REAL,EFFECTIVE&gid=REAL,EFFECTIVE&user=...&exe=...&start=...&arg=...&arg=..."
+func (identity Identity) Encode(query url.Values) {
+	query.Set("pid", strconv.Itoa(identity.PID))
+	query.Set("ppid", strconv.Itoa(identity.PPID))
+	query.Set("uid", fmt.Sprintf("%d,%d", identity.RealUID, identity.EffectiveUID))
+	query.Set("gid", fmt.Sprintf("%d,%d", identity.RealGID, identity.EffectiveGID))
+	query.Set("start", strconv.FormatUint(identity.StartTime, 10))
+	query.Set("pgid", strconv.Itoa(identity.ProcessGroup))
+	query.Set("sid", strconv.Itoa(identity.Session))
+	if identity.User != "" {
+		query.Set("user", identity.User)
+	}
+	if identity.Executable != "" {
+		query.Set("exe", identity.Executable)
+	}
+	for _, arg := range identity.Cmdline {
+		query.Add("arg", arg)
+	}
+}
+
+func decodeIDs(values []string) (int, int, bool) {
+	if len(values) != 1 {
+		return 0, 0, false
+	}
+	ids := strings.Split(values[0], ",")
+	if len(ids) != 2 {
+		return 0, 0, false
+	}
+	real, err := strconv.Atoi(ids[0])
+	if err != nil || real < 0 {
+		return 0, 0, false
+	}
+	effective, err := strconv.Atoi(ids[1])
+	if err != nil || effective < 0 {
+		return 0, 0, false
+	}
+	return real, effective, true
+}
+
+// DecodeIdentity parses the identity in the URL query
+// Only 'pid' is mandatory. Older services send only the PID
+func DecodeIdentity(query url.Values) (Identity, bool) {
+	identity := Identity{}
+	pidStr, ok := query["pid"]
+	if !ok || len(pidStr) != 1 {
+		return identity, false
+	}
+	identity.PID, ok = utils.AtoPID(pidStr[0])
+	if !ok {
+		return identity, false
+	}
+	if values, found := query["ppid"]; found {
+		if len(values) != 1 {
+			return identity, false
+		}
+		// PPID of the init process is 0
+		ppid, err := strconv.Atoi(values[0])
+		if err != nil || ppid < 0 {
+			return identity, false
+		}
+		identity.PPID = ppid
+	}
+	if values, found := query["uid"]; found {
+		identity.RealUID, identity.EffectiveUID, ok = decodeIDs(values)
+		if !ok {
+			return identity, false
+		}
+	}
+	if values, found := query["gid"]; found {
+		identity.RealGID, identity.EffectiveGID, ok = decodeIDs(values)
+		if !ok {
+			return identity, false
+		}
+	}
+	for name, value := range map[string]*int{"pgid": &identity.ProcessGroup, "sid": &identity.Session} {
+		values, found := query[name]
+		if !found {
+			continue
+		}
+		if len(values) != 1 {
+			return identity, false
+		}
+		id, err := strconv.Atoi(values[0])
+		if err != nil || id < 0 {
+			return identity, false
+		}
+		*value = id
+	}
+	if values, found := query["start"]; found {
+		if len(values) != 1 {
+			return identity, false
+		}
+		startTime, err := strconv.ParseUint(values[0], 10, 64)
+		if err != nil {
+			return identity, false
+		}
+		identity.StartTime = startTime
+	}
+	identity.User = query.Get("user")
+	identity.Executable = query.Get("exe")
+	identity.Cmdline = query["arg"]
+	return identity, true
+}
+
+// Encode adds the root's identity and the list of PIDs "pids=PID1,PID2" to the URL query
+func (group Group) Encode(query url.Values) {
+	group.Root.Encode(query)
+	query.Set("pids", utils.ToString(group.PIDs, ","))
+}
+
+// DecodeGroup parses the group in the URL query
+// If there is no 'pids' the group contains only the root process
+func DecodeGroup(query url.Values) (Group, bool) {
+	root, ok := DecodeIdentity(query)
+	if !ok {
+		return Group{}, false
+	}
+	group := Group{Root: root, PIDs: []int{root.PID}}
+	values, found := query["pids"]
+	if !found {
+		return group, true
+	}
+	if len(values) != 1 {
+		return Group{}, false
+	}
+	group.PIDs = []int{}
+	for _, pidStr := range strings.Split(values[0], ",") {
+		pid, ok := utils.AtoPID(pidStr)
+		if !ok {
+			return Group{}, false
+		}
+		group.PIDs = append(group.PIDs, pid)
+	}
+	return group, true
+}
+
+// String returns a short presentation of the group
+func (group Group) String() string {
+	return fmt.Sprintf("%v pids=%v", group.Root, group.PIDs)
+}
+
+// String returns a short presentation of the identity 
+func (identity Identity) String() string {
+	return fmt.Sprintf("pid=%d ppid=%d pgid=%d sid=%d uid=%d/%d gid=%d/%d user=%s exe=%s start=%d cmdline=%q",
+		identity.PID, identity.PPID, identity.ProcessGroup, identity.Session, identity.RealUID, identity.EffectiveUID,
+		identity.RealGID, identity.EffectiveGID, identity.User, identity.Executable, 
+		identity.StartTime, identity.Cmdline)
+}
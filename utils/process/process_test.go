@@ -0,0 +1,102 @@
+package process
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func createProcFixture(t *testing.T) string {
+	root, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "4242")
+	os.MkdirAll(dir, 0700)
+	status := "Name:\tWeb Content\nState:\tS (sleeping)\nPid:\t4242\nPPid:\t4200\nUid:\t1000\t1001\t1000\t1000\nGid:\t100\t101\t100\t100\n"
+	stat := "4242 (Web Content) S 4200 4200 4200 0 -1 4194560 1 0 0 0 0 0 0 0 20 0 1 0 987654 1000 10 18446744073709551615\n"
+	cmdline := "/usr/lib/firefox/firefox\x00-contentproc\x00-childID\x001\x00"
+	ioutil.WriteFile(filepath.Join(dir, "status"), []byte(status), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "cmdline"), []byte(cmdline), 0600)
+	os.Symlink("/usr/lib/firefox/firefox", filepath.Join(dir, "exe"))
+	return root
+}
+
+func TestReadIdentity(t *testing.T) {
+	root := createProcFixture(t)
+	defer os.RemoveAll(root)
+	identity, err := ReadIdentity(root, 4242)
+	if err != nil {
+		t.Fatalf("Failed to read identity %v\n", err)
+	}
+	expected := Identity{
+		PID: 4242, PPID: 4200,
+		RealUID: 1000, EffectiveUID: 1001,
+		RealGID: 100, EffectiveGID: 101,
+		User: identity.User,
+		Executable: "/usr/lib/firefox/firefox",
+		Cmdline: []string{"/usr/lib/firefox/firefox", "-contentproc", "-childID", "1"},
+		StartTime: 987654,
+		ProcessGroup: 4200,
+		Session: 4200,
+	}
+	if !reflect.DeepEqual(identity, expected) {
+		t.Errorf("Got %v expected %v\n", identity, expected)
+	}
+	if _, err := ReadIdentity(root, 4243); err == nil {
+		t.Errorf("Expected error for missing process\n")
+	}
+}
+
+func TestEncodeDecodeIdentity(t *testing.T) {
+	identity := Identity{
+		PID: 4242, PPID: 1, RealUID: 1000, EffectiveUID: 0, RealGID: 100, EffectiveGID: 100,
+		User: "user", Executable: "/usr/bin/curl", Cmdline: []string{"curl", "http://127.0.0.1:21380"},
+		StartTime: 12345, ProcessGroup: 4000, Session: 3000,
+	}
+	query := url.Values{}
+	identity.Encode(query)
+	decoded, ok := DecodeIdentity(query)
+	if !ok || !reflect.DeepEqual(decoded, identity) {
+		t.Errorf("Got %v expected %v\n", decoded, identity)
+	}
+	// Only PID
+	decoded, ok = DecodeIdentity(url.Values{"pid": {"17"}})
+	if !ok || decoded.PID != 17 {
+		t.Errorf("Got %v, %t\n", decoded, ok)
+	}
+	badQueries := []url.Values{
+		{},
+		{"pid": {"0"}},
+		{"pid": {"17"}, "uid": {"1000"}},
+		{"pid": {"17"}, "gid": {"a,b"}},
+		{"pid": {"17"}, "ppid": {"-1"}},
+		{"pid": {"17"}, "start": {"x"}},
+	}
+	for testIndex, query := range badQueries {
+		if _, ok := DecodeIdentity(query); ok {
+			t.Errorf("Expected failure for test %d\n", testIndex)
+		}
+	}
+}
+
+func TestEncodeDecodeGroup(t *testing.T) {
+	group := Group{Root: Identity{PID: 4200, User: "user"}, PIDs: []int{4242, 4243}}
+	query := url.Values{}
+	group.Encode(query)
+	decoded, ok := DecodeGroup(query)
+	if !ok || !reflect.DeepEqual(decoded, group) {
+		t.Errorf("Got %v expected %v\n", decoded, group)
+	}
+	decoded, ok = DecodeGroup(url.Values{"pid": {"17"}})
+	if !ok || !reflect.DeepEqual(decoded.PIDs, []int{17}) {
+		t.Errorf("Got %v, %t\n", decoded, ok)
+	}
+	if _, ok := DecodeGroup(url.Values{"pid": {"17"}, "pids": {"1,x"}}); ok {
+		t.Errorf("Expected failure for bad pids\n")
+	}
+}
@@ -0,0 +1,111 @@
+// Signature of the /session reports
+// Any process can send /session?ports=... to the server. The enrolled service
+// signs the report with the key derived from the secret of the service, see
+// server/enroll.go. The service adds the parameters to the query
+//     ts=UNIX_TIME&nonce=RANDOM&key=KEY_ID&sig=HMAC
+// HMAC-SHA256 covers all other parameters of the query: the ports, the identity of
+// the process, the service ID, the timestamp, the nonce and the key ID
+//     HMAC(key, "session?" + query without sig, sorted by the parameter name)
+// Key = SHA-256(secret), the server keeps the key and never the secret. The key
+// signs the reports: the server keeps the key private as the service keeps the secret
+// Key ID is the first 8 bytes of SHA-256 of the key, hex. The server keeps several
+// keys of the service during the rotation and finds the key by the key ID
+// The server rejects the stale timestamps and the nonces it has seen
+
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	TimestampParam = "ts"
+	NonceParam     = "nonce"
+	KeyParam       = "key"
+	SignatureParam = "sig"
+)
+
+// ReportKey returns the HMAC key derived from the secret
+// The key is as sensitive as the secret, whoever has the key signs the reports
+func ReportKey(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+	return hash[:]
+}
+
+// KeyID returns the ID of the HMAC key, 16 hex digits
+func KeyID(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:8])
+}
+
+// 128 random bits
+func createNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+func compute(key []byte, query url.Values) []byte {
+	signed := url.Values{}
+	for name, values := range query {
+		if name != SignatureParam {
+			signed[name] = values
+		}
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("session?"))
+	// Encode() sorts the parameters by the name
+	mac.Write([]byte(signed.Encode()))
+	return mac.Sum(nil)
+}
+
+// Sign adds the timestamp, the nonce, the key ID and the signature to the query
+func Sign(query url.Values, key []byte, now time.Time) error {
+	nonce, err := createNonce()
+	if err != nil {
+		return err
+	}
+	query.Set(TimestampParam, strconv.FormatInt(now.Unix(), 10))
+	query.Set(NonceParam, nonce)
+	query.Set(KeyParam, KeyID(key))
+	query.Set(SignatureParam, hex.EncodeToString(compute(key, query)))
+	return nil
+}
+
+// Signed returns true if the query contains a signature
+func Signed(query url.Values) bool {
+	_, ok := query[SignatureParam]
+	return ok
+}
+
+// Verify checks the signature and the timestamp. The caller checks the nonce
+// Returns the timestamp
+func Verify(query url.Values, key []byte, now time.Time, maxSkew time.Duration) (time.Time, error) {
+	for _, name := range []string{TimestampParam, NonceParam, KeyParam, SignatureParam} {
+		if len(query[name]) != 1 || query.Get(name) == "" {
+			return time.Time{}, fmt.Errorf("Missing or repeated parameter '%s'", name)
+		}
+	}
+	signature, err := hex.DecodeString(query.Get(SignatureParam))
+	if err != nil || !hmac.Equal(signature, compute(key, query)) {
+		return time.Time{}, fmt.Errorf("Bad signature")
+	}
+	seconds, err := strconv.ParseInt(query.Get(TimestampParam), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Bad timestamp '%s'", query.Get(TimestampParam))
+	}
+	timestamp := time.Unix(seconds, 0).UTC()
+	if timestamp.Before(now.Add(-maxSkew)) || timestamp.After(now.Add(maxSkew)) {
+		return timestamp, fmt.Errorf("Stale timestamp %v", timestamp)
+	}
+	return timestamp, nil
+}
@@ -0,0 +1,60 @@
+package signature
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	key := ReportKey("secret")
+	now := time.Now()
+	query := url.Values{}
+	query.Set("ports", "21380,21381,")
+	query.Set("pid", "1234")
+	query.Set("service", "a1b2")
+	if err := Sign(query, key, now); err != nil {
+		t.Fatal(err)
+	}
+	if !Signed(query) || query.Get(KeyParam) != KeyID(key) || len(query.Get(NonceParam)) != 32 {
+		t.Fatalf("Got %v\n", query)
+	}
+	if _, err := Verify(query, key, now, time.Minute); err != nil {
+		t.Errorf("Failed to verify %v: %v\n", query, err)
+	}
+	testSets := []struct {
+		name string
+		parameter string
+		value string
+		key []byte
+		now time.Time
+	}{
+		{"other ports", "ports", "21380,21382,", key, now},
+		{"other pid", "pid", "1235", key, now},
+		{"other service", "service", "a1b3", key, now},
+		{"added parameter", "uid", "0", key, now},
+		{"other nonce", NonceParam, "00", key, now},
+		{"bad signature", SignatureParam, "zz", key, now},
+		{"no timestamp", TimestampParam, "", key, now},
+		{"other key", "", "", ReportKey("other"), now},
+		{"stale", "", "", key, now.Add(2 * time.Minute)},
+		{"future", "", "", key, now.Add(-2 * time.Minute)},
+	}
+	for _, testSet := range testSets {
+		forged := url.Values{}
+		for name, values := range query {
+			forged[name] = values
+		}
+		if testSet.parameter != "" {
+			forged.Set(testSet.parameter, testSet.value)
+		}
+		if _, err := Verify(forged, testSet.key, testSet.now, time.Minute); err == nil {
+			t.Errorf("Verified %s\n", testSet.name)
+		}
+	}
+	// A repeated parameter is ambiguous
+	query.Add(NonceParam, "00")
+	if _, err := Verify(query, key, now, time.Minute); err == nil {
+		t.Errorf("Verified a repeated nonce\n")
+	}
+}
@@ -0,0 +1,136 @@
+// Integration with systemd
+// Socket activation: systemd opens the sockets and passes them to the service
+// starting from the file descriptor 3. See sd_listen_fds(3)
+//     LISTEN_PID=PID of the service LISTEN_FDS=number of sockets LISTEN_FDNAMES=name:name:...
+// Notifications: the service sends datagrams "READY=1", "STOPPING=1", "WATCHDOG=1"
+// to the unix socket NOTIFY_SOCKET. See sd_notify(3)
+// The functions do nothing if the service does not run under systemd
+
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The first file descriptor passed by systemd
+const listenFDsStart = 3
+
+// Listener is a socket passed by systemd
+type Listener struct {
+	Listener net.Listener
+	// Name from LISTEN_FDNAMES, for example the name of the socket unit
+	Name     string
+}
+
+// Returns the listening sockets passed by systemd
+// I unset the environment variables, the child processes should not use the sockets
+func Listeners() ([]Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	return listeners(os.Getenv, os.Getpid(), listenFDsStart)
+}
+
+func listeners(getenv func(string) string, pid int, firstFD int) ([]Listener, error) {
+	if getenv("LISTEN_PID") == "" {
+		return []Listener{}, nil
+	}
+	listenPID, err := strconv.Atoi(getenv("LISTEN_PID"))
+	if err != nil {
+		return nil, fmt.Errorf("Bad LISTEN_PID %v", err)
+	}
+	// The sockets are for another process
+	if listenPID != pid {
+		return []Listener{}, nil
+	}
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("Bad LISTEN_FDS '%s'", getenv("LISTEN_FDS"))
+	}
+	names := []string{}
+	if getenv("LISTEN_FDNAMES") != "" {
+		names = strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	}
+	result := []Listener{}
+	for i := 0;i < count;i++ {
+		fd := firstFD + i
+		syscall.CloseOnExec(fd)
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(names) {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		// FileListener duplicates the descriptor
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range result {
+				l.Listener.Close()
+			}
+			return nil, fmt.Errorf("Socket %s is not a listener: %v", name, err)
+		}
+		result = append(result, Listener{listener, name})
+	}
+	return result, nil
+}
+
+// Send the state to the notification socket
+// Returns false if NOTIFY_SOCKET is not set
+func Notify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+	// Abstract namespace
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+	address := &net.UnixAddr{Name: socketPath, Net: "unixgram"}
+	connection, err := net.DialUnix("unixgram", nil, address)
+	if err != nil {
+		return false, err
+	}
+	defer connection.Close()
+	if _, err := connection.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns the watchdog timeout, false if the watchdog is disabled
+// The service should send "WATCHDOG=1" at least every half of the timeout
+func WatchdogTimeout() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil || pid != os.Getpid() {
+			return 0, false
+		}
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// Goroutine which pings the watchdog until 'done' is closed
+func Watchdog(timeout time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := Notify("WATCHDOG=1"); err != nil {
+				fmt.Println("Failed to ping watchdog", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Fake notification socket, returns the received states
+func createNotifySocket(t *testing.T) (*net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "notify.sock")
+	connection, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("NOTIFY_SOCKET", path)
+	return connection, func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		connection.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readState(t *testing.T, connection *net.UnixConn) string {
+	buffer := make([]byte, 1024)
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := connection.Read(buffer)
+	if err != nil {
+		t.Fatalf("No notification %v\n", err)
+	}
+	return string(buffer[:n])
+}
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if ok, err := Notify("READY=1"); ok || err != nil {
+		t.Errorf("Got %t, %v without socket\n", ok, err)
+	}
+	connection, cleanup := createNotifySocket(t)
+	defer cleanup()
+	for _, state := range []string{"READY=1", "STOPPING=1"} {
+		if ok, err := Notify(state); !ok || err != nil {
+			t.Fatalf("Got %t, %v\n", ok, err)
+		}
+		if got := readState(t, connection); got != state {
+			t.Errorf("Got '%s', expected '%s'\n", got, state)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	connection, cleanup := createNotifySocket(t)
+	defer cleanup()
+	os.Setenv("WATCHDOG_USEC", "20000")
+	os.Setenv("WATCHDOG_PID", "1")
+	if _, ok := WatchdogTimeout(); ok {
+		t.Errorf("Watchdog for another process\n")
+	}
+	os.Unsetenv("WATCHDOG_PID")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	timeout, ok := WatchdogTimeout()
+	if !ok || timeout != 20*time.Millisecond {
+		t.Fatalf("Got %v, %t\n", timeout, ok)
+	}
+	done := make(chan struct{})
+	go Watchdog(timeout, done)
+	for i := 0;i < 2;i++ {
+		if got := readState(t, connection); got != "WATCHDOG=1" {
+			t.Errorf("Got '%s'\n", got)
+		}
+	}
+	close(done)
+}
+
+func TestListeners(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// Duplicate of the socket, systemd would pass it as fd 3
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// listeners() owns the descriptor
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := os.Getpid()
+	env := map[string]string{
+		"LISTEN_PID": "0",
+		"LISTEN_FDS": "1",
+		"LISTEN_FDNAMES": "knock",
+	}
+	getenv := func(name string) string { return env[name] }
+	// The sockets are for another process
+	if result, err := listeners(getenv, pid, fd); err != nil || len(result) != 0 {
+		t.Errorf("Got %v, %v\n", result, err)
+	}
+	env["LISTEN_PID"] = strconv.Itoa(pid)
+	result, err := listeners(getenv, pid, fd)
+	if err != nil || len(result) != 1 {
+		t.Fatalf("Got %v, %v\n", result, err)
+	}
+	defer result[0].Listener.Close()
+	if result[0].Name != "knock" || result[0].Listener.Addr().String() != listener.Addr().String() {
+		t.Errorf("Got %s %v\n", result[0].Name, result[0].Listener.Addr())
+	}
+	env["LISTEN_FDS"] = "x"
+	if _, err := listeners(getenv, pid, fd); err == nil {
+		t.Errorf("Expected error for bad LISTEN_FDS\n")
+	}
+}
@@ -0,0 +1,91 @@
+// Min-heap of values ordered by time
+// The server expires the sessions and the session statuses, the service expires
+// the knock sequences. All of them push (time, value) and pop the values which 
+// time is not after 'now'. The zero value of the Heap is an empty heap
+// The Heap is not thread safe, the caller holds the mutex
+
+package timeheap
+
+import (
+	"container/heap"
+	"time"
+)
+
+type entry[T any] struct {
+	time  time.Time
+	value T
+}
+
+// entries implements heap.Interface
+type entries[T any] []entry[T]
+
+func (q entries[T]) Len() int {
+	return len(q)
+}
+
+func (q entries[T]) Less(i, j int) bool {
+	return q[i].time.Before(q[j].time)
+}
+
+func (q entries[T]) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *entries[T]) Push(x interface{}) {
+	*q = append(*q, x.(entry[T]))
+}
+
+// I clear the popped entry, the value can hold a pointer
+func (q *entries[T]) Pop() interface{} {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = entry[T]{}
+	*q = old[:n-1]
+	return e
+}
+
+type Heap[T any] struct {
+	entries entries[T]
+}
+
+func (h *Heap[T]) Len() int {
+	return len(h.entries)
+}
+
+func (h *Heap[T]) Push(t time.Time, value T) {
+	heap.Push(&h.entries, entry[T]{t, value})
+}
+
+// Returns the nearest time and the value, false if the heap is empty
+func (h *Heap[T]) Peek() (time.Time, T, bool) {
+	if len(h.entries) == 0 {
+		var value T
+		return time.Time{}, value, false
+	}
+	return h.entries[0].time, h.entries[0].value, true
+}
+
+// Removes the top of the heap, false if the heap is empty
+func (h *Heap[T]) Pop() (time.Time, T, bool) {
+	if len(h.entries) == 0 {
+		var value T
+		return time.Time{}, value, false
+	}
+	e := heap.Pop(&h.entries).(entry[T])
+	return e.time, e.value, true
+}
+
+// Removes the top of the heap if the time of the top is not after 'now'
+func (h *Heap[T]) PopExpired(now time.Time) (time.Time, T, bool) {
+	if len(h.entries) == 0 || h.entries[0].time.After(now) {
+		var value T
+		return time.Time{}, value, false
+	}
+	return h.Pop()
+}
+
+// Removes all entries
+func (h *Heap[T]) Reset() {
+	h.entries = nil
+}
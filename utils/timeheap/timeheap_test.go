@@ -0,0 +1,47 @@
+package timeheap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeapOrder(t *testing.T) {
+	var h Heap[string]
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	testSets := []struct {
+		offset int
+		value  string
+	}{
+		{3, "c"},
+		{1, "a"},
+		{4, "d"},
+		{2, "b"},
+	}
+	for _, testSet := range testSets {
+		h.Push(now.Add(time.Duration(testSet.offset)*time.Second), testSet.value)
+	}
+	if top, value, ok := h.Peek(); !ok || value != "a" || !top.Equal(now.Add(time.Second)) {
+		t.Errorf("Got %v %s %t\n", top, value, ok)
+	}
+	expired := ""
+	for {
+		_, value, ok := h.PopExpired(now.Add(2*time.Second))
+		if !ok {
+			break
+		}
+		expired += value
+	}
+	if expired != "ab" || h.Len() != 2 {
+		t.Errorf("Got expired '%s', %d left\n", expired, h.Len())
+	}
+	if _, value, ok := h.Pop(); !ok || value != "c" {
+		t.Errorf("Got %s %t\n", value, ok)
+	}
+	h.Reset()
+	if _, _, ok := h.Pop(); ok || h.Len() != 0 {
+		t.Errorf("Heap is not empty\n")
+	}
+	if _, _, ok := h.PopExpired(now); ok {
+		t.Errorf("Popped from the empty heap\n")
+	}
+}
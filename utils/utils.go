@@ -3,6 +3,7 @@ package utils
 import (
     "strconv"
 	"strings"
+	"sort"
 	"os"
 	"fmt"
 	"time"
@@ -110,12 +111,6 @@ func PathExists(path string) bool {
 	return true
 }
 
-// GetPidFilename returns /tmp/knock_PID
-func GetPidFilename(pid int) string {
-	pidFilename := fmt.Sprintf("/tmp/knock_%d", pid)  
-	return pidFilename
-}
-
 // Contains returns true if the slice contains the specified value  
 // No "contains" method in Golang (rolling my eyes again)
 // https://stackoverflow.com/questions/10485743/contains-method-for-a-slice
@@ -128,6 +123,73 @@ func Contains(s []int, e int) bool {
     return false
 }
 
+// ParsePortsRanges parses ranges like "21380-21389,31000-31015,31020"
+// Returns sorted list of unique ports
+func ParsePortsRanges(s string) ([]int, error) {
+	ports := []int{}
+	for _, rangeStr := range strings.Split(s, ",") {
+		rangeStr = strings.TrimSpace(rangeStr)
+		if rangeStr == "" {
+			continue
+		}
+		limits := strings.SplitN(rangeStr, "-", 2)
+		first, ok := AtoIPPort(strings.TrimSpace(limits[0]))
+		if !ok {
+			return nil, fmt.Errorf("Bad port '%s' in range '%s'", limits[0], rangeStr)
+		}
+		last := first
+		if len(limits) > 1 {
+			last, ok = AtoIPPort(strings.TrimSpace(limits[1]))
+			if !ok {
+				return nil, fmt.Errorf("Bad port '%s' in range '%s'", limits[1], rangeStr)
+			}
+		}
+		if last < first {
+			return nil, fmt.Errorf("Bad range '%s'", rangeStr)
+		}
+		ports = append(ports, MakeRange(first, last-first+1)...)
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("No ports in '%s'", s)
+	}
+	sort.Ints(ports)
+	unique := ports[:1]
+	for _, port := range ports[1:] {
+		if port != unique[len(unique)-1] {
+			unique = append(unique, port)
+		}
+	}
+	return unique, nil
+}
+
+// MakePortsRange returns the ports specified by the ranges if not empty, 
+// otherwise the contiguous range base..base+size
+func MakePortsRange(ranges string, base, size int) ([]int, error) {
+	if ranges != "" {
+		return ParsePortsRanges(ranges)
+	}
+	return MakeRange(base, size), nil
+}
+
+// ExcludePort returns a copy of the ports without the specified port
+func ExcludePort(ports []int, port int) []int {
+	result := make([]int, 0, len(ports))
+	for _, p := range ports {
+		if p != port {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// FrameStartPrefix starts the line announcing the "frame start" port in the 
+// server's text response, for example "frame_start=21379"  
+const FrameStartPrefix = "frame_start="
+
+// SessionTokenPrefix starts the line with the session status token in the server's
+// text response, for example "token=0123456789abcdef0123456789abcdef"
+const SessionTokenPrefix = "token="
+
 // GetTupleSize returns number of ports in a tuple give the ports range size
 func GetTupleSize(portsRangeSize int) int {
 	return portsRangeSize/2